@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Inspect the audit log",
+}
+
+var (
+	auditAction string
+	auditUser   string
+	auditPage   uint
+	auditSince  string
+	auditUntil  string
+)
+
+// auditRecord is an entry of the audit log as exported, with the names of the users
+// and the title of the page it refers to
+type auditRecord struct {
+	ID      uint      `json:"id"`
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	ActorID uint      `json:"actor_id,omitempty"`
+	Actor   string    `json:"actor,omitempty"`
+	UserID  uint      `json:"user_id,omitempty"`
+	User    string    `json:"user,omitempty"`
+	PageID  uint      `json:"page_id,omitempty"`
+	Page    string    `json:"page,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Details string    `json:"details,omitempty"`
+}
+
+// parseAuditDate parses a date given to the audit flags, or returns the zero time if empty
+func parseAuditDate(flag, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		log.Fatalf("--%s must be a date like 2006-01-02", flag)
+	}
+	return t
+}
+
+var auditExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the audit log as JSON lines, oldest entries first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		m := getModel()
+		defer m.Close()
+
+		filter := model.AuditFilter{
+			Action: auditAction,
+			PageID: auditPage,
+			Since:  parseAuditDate("since", auditSince),
+		}
+		if until := parseAuditDate("until", auditUntil); !until.IsZero() {
+			filter.Until = until.AddDate(0, 0, 1)
+		}
+		if auditUser != "" {
+			u := m.RetrieveUserByUsername(auditUser)
+			if u == nil {
+				log.Fatalf("Can't find user %s", auditUser)
+			}
+			filter.UserID = u.ID
+		}
+
+		out := bufio.NewWriter(os.Stdout)
+		enc := json.NewEncoder(out)
+		err := m.EachAuditEntry(filter, func(e *model.AuditEntry) error {
+			return enc.Encode(auditRecord{
+				ID:      e.ID,
+				Time:    e.CreatedAt,
+				Action:  e.Action,
+				ActorID: e.ActorID,
+				Actor:   e.Actor.Username,
+				UserID:  e.UserID,
+				User:    e.User.Username,
+				PageID:  e.PageID,
+				Page:    e.Page.Title,
+				IP:      e.IP,
+				Details: e.Details,
+			})
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := out.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	auditExportCmd.Flags().StringVar(&auditAction, "action", "", "only export this action")
+	auditExportCmd.Flags().StringVar(&auditUser, "user", "", "only export the actions done by or on the user with this username")
+	auditExportCmd.Flags().UintVar(&auditPage, "page", 0, "only export the actions on the page with this ID")
+	auditExportCmd.Flags().StringVar(&auditSince, "since", "", "only export the actions from this date (YYYY-MM-DD)")
+	auditExportCmd.Flags().StringVar(&auditUntil, "until", "", "only export the actions until this date included (YYYY-MM-DD)")
+
+	auditCmd.AddCommand(auditExportCmd)
+	rootCmd.AddCommand(auditCmd)
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"path"
+	"strings"
 
 	"github.com/spf13/viper"
 	"github.com/vigliag/isamuni-go/index"
@@ -25,6 +26,17 @@ func GetMailer() *mail.SmtpServer {
 	}
 }
 
+// configureTokenTTLs reads the validity of each kind of token from the configuration,
+// e.g. TOKEN_TTL_PASSWORD_RESET=1h. Unset values keep the defaults in model.TokenTTL.
+func configureTokenTTLs() {
+	for purpose := range model.TokenTTL {
+		key := "TOKEN_TTL_" + strings.ToUpper(strings.ReplaceAll(purpose, "-", "_"))
+		if ttl := viper.GetDuration(key); ttl > 0 {
+			model.TokenTTL[purpose] = ttl
+		}
+	}
+}
+
 func GetController() *web.Controller {
 	dataPath := viper.GetString("data")
 	dbPath := path.Join(dataPath, "database.db")
@@ -33,6 +45,7 @@ func GetController() *web.Controller {
 	fmt.Println("Using data folder", dataPath)
 	fmt.Println("Using app url", appURL)
 
+	configureTokenTTLs()
 	db := model.Connect(dbPath)
 	m := model.New(db)
 	bleveidx := index.OpenOrNewBleve(indexPath)
@@ -40,5 +53,13 @@ func GetController() *web.Controller {
 	mailer := GetMailer()
 	t := web.LoadTemplates()
 	ctl := web.NewController(appURL, m, idx, mailer, t)
+	for _, p := range web.LoginProvidersFromConfig(appURL) {
+		ctl.AddLoginProvider(p)
+	}
+	// Moderators can review any edit, so they are protected like admins
+	if viper.GetBool("REQUIRE_2FA_ADMINS") {
+		ctl.RequireTwoFactor(model.RoleAdmin)
+		ctl.RequireTwoFactor(model.RoleModerator)
+	}
 	return ctl
 }
@@ -81,10 +81,16 @@ func copyUsers(isamunidb *sql.DB, m *model.Model) {
 		}
 
 		u := model.User{
-			FacebookID: &fbid.String,
-			Username:   name.String,
+			Username: name.String,
 		}
 		err := m.SaveUser(&u)
+		if err == nil && fbid.Valid && fbid.String != "" {
+			_, err = m.LinkIdentity(&u, &model.ExternalAccount{
+				Provider: model.ProviderFacebook,
+				Subject:  fbid.String,
+				Name:     name.String,
+			})
+		}
 
 		p := model.Page{
 			Title:   name.String,
@@ -247,7 +253,7 @@ func importIsamuniRun(cmd *cobra.Command, args []string) {
 		host, port, user, password, dbname)
 
 	dbname := path.Join(viper.GetString("data"), "database.db")
-	m := &model.Model{model.Connect(dbname)}
+	m := model.New(model.Connect(dbname))
 	defer m.Close()
 
 	isamunidb, err := sql.Open("postgres", psqlInfo)
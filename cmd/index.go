@@ -43,8 +43,7 @@ var printindexCmd = &cobra.Command{
 
 func printIndexRun(cmd *cobra.Command, args []string) {
 	dbname := path.Join(viper.GetString("data"), "database.db")
-	db := model.Connect(dbname)
-	m := model.Model{db}
+	m := model.New(model.Connect(dbname))
 
 	pages, err := m.AllPages()
 	if err != nil {
@@ -60,7 +59,7 @@ func printIndexRun(cmd *cobra.Command, args []string) {
 
 func indexRun(cmd *cobra.Command, args []string) {
 	dbname := path.Join(viper.GetString("data"), "database.db")
-	m := &model.Model{model.Connect(dbname)}
+	m := model.New(model.Connect(dbname))
 	defer m.Close()
 
 	//Remove and re-create the index
@@ -78,9 +77,12 @@ func indexRun(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
-	// index some data
+	// index some data, skipping pages with no approved version
 	count := 0
 	for _, p := range pages {
+		if !index.IsListed(p) {
+			continue
+		}
 		err := idx.IndexPage(p)
 		if err != nil {
 			fmt.Println(err)
@@ -96,8 +98,12 @@ func indexRun(cmd *cobra.Command, args []string) {
 	}
 	querystring := args[0]
 
-	searchResults, err := idx.SearchPagesByQueryString(querystring)
-	for _, result := range searchResults {
+	searchResults, err := idx.SearchPagesByQueryString(querystring, 0, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%v results\n", searchResults.Total)
+	for _, result := range searchResults.Hits {
 		fmt.Println(result.Page.Title, result.Page.Type.CatName(), result.Fragments)
 	}
 
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/vigliag/isamuni-go/model"
+	"github.com/vigliag/isamuni-go/web"
+)
+
+var pageCmd = &cobra.Command{
+	Use:   "page",
+	Short: "Manage pages",
+}
+
+var pageDeleteReason string
+
+// pageIDArg parses the page ID passed as first argument
+func pageIDArg(args []string) uint {
+	id, err := strconv.Atoi(args[0])
+	if err != nil || id <= 0 {
+		log.Fatal("the first argument must be a page ID")
+	}
+	return uint(id)
+}
+
+var pageDeleteCmd = &cobra.Command{
+	Use:   "delete [id]",
+	Short: "Move a page to the trash",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctl := GetController()
+		defer ctl.Close()
+
+		var p model.Page
+		if err := ctl.Model().Db.First(&p, "id = ?", pageIDArg(args)).Error; err != nil {
+			fmt.Println("Can't find page with that ID")
+			return
+		}
+
+		if err := ctl.DeletePage(&p, nil, pageDeleteReason); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("done")
+	},
+}
+
+var pageTrashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "List the pages in the trash",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		m := getModel()
+		defer m.Close()
+
+		pages, err := m.DeletedPages()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, p := range pages {
+			fmt.Printf("%d\t%s\t%s\t%s\n", p.ID, p.Type.CatName(), p.Title, p.DeletionReason)
+		}
+	},
+}
+
+// trashedPageCommand returns a command that runs action on a page in the trash
+func trashedPageCommand(use, short string, action func(ctl *web.Controller, p *model.Page) error) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ctl := GetController()
+			defer ctl.Close()
+
+			p := ctl.Model().FindDeletedPage(pageIDArg(args))
+			if p == nil {
+				fmt.Println("Can't find a page with that ID in the trash")
+				return
+			}
+
+			if err := action(ctl, p); err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Println("done")
+		},
+	}
+}
+
+func init() {
+	pageDeleteCmd.Flags().StringVar(&pageDeleteReason, "reason", "", "why the page is being deleted")
+
+	pageCmd.AddCommand(pageDeleteCmd)
+	pageCmd.AddCommand(pageTrashCmd)
+	pageCmd.AddCommand(trashedPageCommand("restore [id]", "Restore a page from the trash", func(ctl *web.Controller, p *model.Page) error {
+		return ctl.RestorePage(p, nil)
+	}))
+	pageCmd.AddCommand(trashedPageCommand("purge [id]", "Permanently delete a page in the trash", func(ctl *web.Controller, p *model.Page) error {
+		return ctl.PurgePage(p, nil)
+	}))
+	rootCmd.AddCommand(pageCmd)
+}
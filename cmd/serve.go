@@ -10,6 +10,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/spf13/cobra"
+	"github.com/vigliag/isamuni-go/model"
 	"github.com/vigliag/isamuni-go/web"
 )
 
@@ -25,9 +26,13 @@ func serveRun(cmd *cobra.Command, args []string) {
 	ctl := GetController()
 	r := web.CreateServer(echo.New(), ctl)
 
+	stopTokenCleanup := ctl.StartTokenCleanup(viper.GetDuration("TOKEN_CLEANUP_INTERVAL"))
+	defer stopTokenCleanup()
+
 	// attach CSRF middleware here, so that we don't have it during testing
 	r.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
 		TokenLookup: "form:csrf",
+		Skipper:     web.HasBearerToken,
 	}))
 
 	//r.Use(middleware.Recover())
@@ -45,5 +50,8 @@ func init() {
 	serveCmd.Flags().String("LISTEN_URL", ":8080", "url isamuni should bind to, in the format [<ip>]:port")
 	viper.BindPFlag("LISTEN_URL", serveCmd.Flags().Lookup("LISTEN_URL"))
 
+	serveCmd.Flags().Duration("TOKEN_CLEANUP_INTERVAL", model.DefaultTokenCleanupInterval, "how often expired tokens are deleted")
+	viper.BindPFlag("TOKEN_CLEANUP_INTERVAL", serveCmd.Flags().Lookup("TOKEN_CLEANUP_INTERVAL"))
+
 	rootCmd.AddCommand(serveCmd)
 }
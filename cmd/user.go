@@ -76,7 +76,7 @@ var userRegisterCmd = &cobra.Command{
 			return
 		}
 
-		_, err = m.RegisterEmail(user, email, string(password), "user")
+		_, err = m.RegisterEmail(user, email, string(password), model.RoleUser)
 		if err != nil {
 			fmt.Println("Unable to register user because of error: ", err)
 		}
@@ -85,8 +85,32 @@ var userRegisterCmd = &cobra.Command{
 	},
 }
 
+var userRoleCmd = &cobra.Command{
+	Use:   "role [email] [role]",
+	Short: "Change the role of a user (" + strings.Join(model.Roles, ", ") + ")",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		m := getModel()
+		defer m.Close()
+
+		var u model.User
+		if err := m.Db.First(&u, "email=?", args[0]).Error; err != nil {
+			fmt.Println("Can't find user with that mail")
+			return
+		}
+
+		if err := m.SetRole(&u, args[1], nil); err != nil {
+			fmt.Println("Unable to change role because of error: ", err)
+			return
+		}
+
+		fmt.Println("done")
+	},
+}
+
 func init() {
 	userCmd.AddCommand(userVerificationMail)
 	userCmd.AddCommand(userRegisterCmd)
+	userCmd.AddCommand(userRoleCmd)
 	rootCmd.AddCommand(userCmd)
 }
@@ -13,6 +13,7 @@ import (
 	"github.com/blevesearch/bleve/mapping"
 	_ "github.com/blevesearch/bleve/search/highlight/format/ansi"
 	_ "github.com/blevesearch/bleve/search/highlight/format/html"
+	"github.com/blevesearch/bleve/search/query"
 	"github.com/vigliag/isamuni-go/model"
 )
 
@@ -23,6 +24,68 @@ type SearchResult struct {
 	Page      *model.Page
 }
 
+// FacetFields are the keyword fields of a page for which facets are computed,
+// and that can be used as filters in a Query
+var FacetFields = []string{"type", "city", "sector"}
+
+// Query is a search on the index
+type Query struct {
+	// A bleve query string. If empty, all pages are matched
+	QueryString string
+	// Restricts the results to the pages having the given value for each field.
+	// Only FacetFields are taken in account.
+	Filters map[string]string
+	From    int
+	Size    int
+}
+
+// FacetTerm is a value of a facet field, with the number of hits having it
+type FacetTerm struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// Facet holds the most frequent values of a FacetField among the hits of a search
+type Facet struct {
+	Field string      `json:"field"`
+	Terms []FacetTerm `json:"terms"`
+}
+
+// DefaultPageSize is the number of hits returned by a search when no size is given
+const DefaultPageSize = 20
+
+// SearchResults is a page of the results of a search
+type SearchResults struct {
+	Hits []SearchResult
+	// Total number of documents matching the query. It can be off, as the index
+	// might contain documents for pages that have been unlisted since.
+	Total uint64
+	From  int
+	Size  int
+	// Facets, in the same order as FacetFields
+	Facets []Facet
+}
+
+// HasPrev tells if there are hits before this page of results
+func (r *SearchResults) HasPrev() bool {
+	return r.From > 0
+}
+
+// HasNext tells if there are hits after this page of results
+func (r *SearchResults) HasNext() bool {
+	return uint64(r.From+r.Size) < r.Total
+}
+
+// Page returns the number of this page of results, starting from 1
+func (r *SearchResults) Page() int {
+	return r.From/r.Size + 1
+}
+
+// Pages returns the number of pages of results
+func (r *SearchResults) Pages() int {
+	return int((r.Total + uint64(r.Size) - 1) / uint64(r.Size))
+}
+
 type ByKindSearchResult struct {
 	ProfessionalsResults []SearchResult
 	CommunitiesResults   []SearchResult
@@ -36,6 +99,13 @@ func (Doc) BleveType() string {
 func PageToDoc(p *model.Page) Doc {
 	d := model.ParseContent(p.Content)
 	d["name"] = p.Title
+	d["type"] = p.Type.CatName()
+	if p.City != "" {
+		d["city"] = p.City
+	}
+	if p.Sector != "" {
+		d["sector"] = p.Sector
+	}
 	return d
 }
 
@@ -84,19 +154,64 @@ func OpenBleve(fname string) (bleve.Index, error) {
 	return idx, err
 }
 
-// IndexPage puts a page in the index
+// IsListed tells if a page can be shown in search results:
+// pages with no approved version and deleted pages are not
+func IsListed(page *model.Page) bool {
+	return page.ApprovedVersionID != 0 && page.DeletedAt == nil
+}
+
+// IndexPage puts a page in the index.
+// Pages that should not be listed are removed from the index instead.
 func (i Index) IndexPage(page *model.Page) error {
+	if !IsListed(page) {
+		return i.RemovePage(page)
+	}
 	d := PageToDoc(page)
 	return i.idx.Index(fmt.Sprintf("%d", page.ID), d)
 }
 
-func (i Index) searchPageByQueryString(querystring string) (*bleve.SearchResult, error) {
-	query := bleve.NewQueryStringQuery(querystring)
-	search := bleve.NewSearchRequest(query)
+// RemovePage removes a page from the index
+func (i Index) RemovePage(page *model.Page) error {
+	return i.idx.Delete(fmt.Sprintf("%d", page.ID))
+}
+
+func (q Query) bleveQuery() query.Query {
+	var main query.Query
+	if q.QueryString == "" {
+		main = bleve.NewMatchAllQuery()
+	} else {
+		main = bleve.NewQueryStringQuery(q.QueryString)
+	}
+
+	conjuncts := []query.Query{main}
+	for _, field := range FacetFields {
+		if value := q.Filters[field]; value != "" {
+			term := bleve.NewTermQuery(value)
+			term.SetField(field)
+			conjuncts = append(conjuncts, term)
+		}
+	}
+	if len(conjuncts) == 1 {
+		return main
+	}
+	return bleve.NewConjunctionQuery(conjuncts...)
+}
+
+// CheckQueryString returns an error if queryString is not a valid bleve query string
+func CheckQueryString(queryString string) error {
+	if queryString == "" {
+		return nil
+	}
+	_, err := bleve.NewQueryStringQuery(queryString).Parse()
+	return err
+}
 
-	search.AddFacet("sector", bleve.NewFacetRequest("sector", 10))
-	search.AddFacet("city", bleve.NewFacetRequest("city", 10))
-	search.AddFacet("type", bleve.NewFacetRequest("type", 10))
+func (i Index) searchPages(q Query) (*bleve.SearchResult, error) {
+	search := bleve.NewSearchRequestOptions(q.bleveQuery(), q.Size, q.From, false)
+
+	for _, field := range FacetFields {
+		search.AddFacet(field, bleve.NewFacetRequest(field, 10))
+	}
 
 	search.Highlight = bleve.NewHighlight()
 	search.Highlight.AddField("sector")
@@ -112,39 +227,75 @@ func (i Index) searchPageByQueryString(querystring string) (*bleve.SearchResult,
 	return searchResults, nil
 }
 
-// SearchPagesByQueryString search a page by a bleve query string
-func (i Index) SearchPagesByQueryString(queryString string) ([]SearchResult, error) {
-	// Create a map pageid -> page
-	pages, err := i.model.AllPages()
+// SearchPagesByQueryString search a page by a bleve query string.
+// Only the hits between from and from+size are returned, together with the total
+// number of matches. A size of zero means DefaultPageSize.
+func (i Index) SearchPagesByQueryString(queryString string, from, size int) (*SearchResults, error) {
+	return i.Search(Query{QueryString: queryString, From: from, Size: size})
+}
+
+// Search runs a query on the index, returning a page of results with their facets
+func (i Index) Search(q Query) (*SearchResults, error) {
+	if q.Size <= 0 {
+		q.Size = DefaultPageSize
+	}
+	if q.From < 0 {
+		q.From = 0
+	}
+
+	matches, err := i.searchPages(q)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load only the pages that were hit, and map them by ID
+	ids := make([]uint, 0, len(matches.Hits))
+	for _, hit := range matches.Hits {
+		id, _ := strconv.Atoi(hit.ID)
+		ids = append(ids, uint(id))
+	}
+	pages, err := i.model.FindPagesByIDs(ids)
 	if err != nil {
 		return nil, err
 	}
 	pagemap := make(map[uint]*model.Page)
 	for _, p := range pages {
-		pagemap[p.ID] = p
+		// The index could still contain pages that have been unlisted since
+		if IsListed(p) {
+			pagemap[p.ID] = p
+		}
 	}
 
-	matches, err := i.searchPageByQueryString(queryString)
-	if err != nil {
-		return nil, err
+	results := &SearchResults{
+		Hits:  make([]SearchResult, 0, len(matches.Hits)),
+		Total: matches.Total,
+		From:  q.From,
+		Size:  q.Size,
 	}
 
-	searchResuls := make([]SearchResult, len(matches.Hits))
+	for _, field := range FacetFields {
+		facet := Facet{Field: field, Terms: []FacetTerm{}}
+		if fr, ok := matches.Facets[field]; ok && fr.Terms != nil {
+			for _, t := range fr.Terms {
+				facet.Terms = append(facet.Terms, FacetTerm{Term: t.Term, Count: t.Count})
+			}
+		}
+		results.Facets = append(results.Facets, facet)
+	}
 
 	for j, hit := range matches.Hits {
-		id, _ := strconv.Atoi(hit.ID)
-		p, _ := pagemap[uint(id)]
+		p, _ := pagemap[ids[j]]
 		if p == nil {
 			log.Println("Error, invalid ID in index")
 			continue
 		}
-		searchResuls[j] = SearchResult{
+		results.Hits = append(results.Hits, SearchResult{
 			Fragments: hit.Fragments,
 			Page:      p,
-		}
+		})
 	}
 
-	return searchResuls, nil
+	return results, nil
 }
 
 func init() {
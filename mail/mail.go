@@ -87,6 +87,42 @@ func ConfirmationEmail(name, email, confirmationURL string) *Mail {
 	}
 }
 
+func EmailChangeConfirmationEmail(name, email, confirmationURL string) *Mail {
+	return &Mail{
+		Sender:  "noreply@isamuni.org",
+		To:      []Recipient{Recipient{name, email}},
+		Subject: "Confirm your new email",
+		Body:    fmt.Sprintf("Hello %s, you're receiving this email because someone (hopefully you) asked to use it for their account on isamuni.org\r\nIf it was you, please use %s to confirm the change.\r\nOtherwise simply ignore this mail.", name, confirmationURL),
+	}
+}
+
+func EmailChangeNoticeEmail(name, email, newEmail string) *Mail {
+	return &Mail{
+		Sender:  "noreply@isamuni.org",
+		To:      []Recipient{Recipient{name, email}},
+		Subject: "Your email is being changed",
+		Body:    fmt.Sprintf("Hello %s, someone asked to change the email of your account on isamuni.org to %s\r\nThe change will be applied once the new address is confirmed.\r\nIf it wasn't you, please change your password and cancel the change from your profile.", name, newEmail),
+	}
+}
+
+func PasswordResetEmail(name, email, resetURL string) *Mail {
+	return &Mail{
+		Sender:  "noreply@isamuni.org",
+		To:      []Recipient{Recipient{name, email}},
+		Subject: "Reset your password",
+		Body:    fmt.Sprintf("Hello %s, you're receiving this email because someone (hopefully you) asked to reset your password on isamuni.org\r\nIf it was you, please use %s to choose a new password. The link can only be used once, and expires shortly.\r\nOtherwise simply ignore this mail.", name, resetURL),
+	}
+}
+
+func PageTransferEmail(name, email, from, title, answerURL string) *Mail {
+	return &Mail{
+		Sender:  "noreply@isamuni.org",
+		To:      []Recipient{Recipient{name, email}},
+		Subject: "A page is being transferred to you",
+		Body:    fmt.Sprintf("Hello %s, %s wants to make you the owner of the page \"%s\" on isamuni.org\r\nYou can accept or decline from %s\r\nIf you don't know them, simply ignore this mail.", name, from, title, answerURL),
+	}
+}
+
 func (s *SmtpServer) SendMail(mail *Mail) error {
 
 	auth := smtp.PlainAuth("", s.User, s.Password, s.Host)
@@ -0,0 +1,153 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Scopes of an AccessToken
+const (
+	// Read unapproved content through the API, when the user can approve it
+	ScopeRead = "read"
+	// Create and edit pages through the API
+	ScopeWrite = "write"
+)
+
+// AccessTokenScopes are all the scopes an AccessToken can have
+var AccessTokenScopes = []string{ScopeRead, ScopeWrite}
+
+// accessTokenPrefix marks the values of access tokens, so that they can be recognized
+const accessTokenPrefix = "isa_"
+
+// ErrInvalidAccessToken is returned when an access token does not exist,
+// has been revoked, or is expired
+var ErrInvalidAccessToken = errors.New("invalid access token")
+
+// AccessToken is a personal access token, used by a user to authenticate to the API.
+// Only a hash of the token is stored: its value is shown once, when it is created.
+type AccessToken struct {
+	gorm.Model
+
+	UserID uint
+	User   User
+
+	// Chosen by the user to recognize the token
+	Name string `gorm:"not null;default:''"`
+
+	HashedValue string `gorm:"unique"`
+
+	// First characters of the token, shown to recognize it
+	Hint string
+
+	// Space separated list of scopes
+	Scopes string
+
+	// If nil, the token never expires
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func isAccessTokenScope(scope string) bool {
+	for _, s := range AccessTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope tells if the token was granted the given scope
+func (t *AccessToken) HasScope(scope string) bool {
+	for _, s := range strings.Fields(t.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid tells if the token can still be used
+func (t *AccessToken) IsValid() bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || t.ExpiresAt.After(time.Now()))
+}
+
+// CreateAccessToken creates a new token for u, with the given scopes.
+// A zero ttl creates a token that never expires.
+// Returns the token together with its value, that can't be retrieved later.
+func (m *Model) CreateAccessToken(u *User, name string, scopes []string, ttl time.Duration) (*AccessToken, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", errors.New("an access token needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !isAccessTokenScope(scope) {
+			return nil, "", errors.New("invalid scope " + scope)
+		}
+	}
+
+	value := accessTokenPrefix + GenRandomString(20)
+	t := AccessToken{
+		UserID:      u.ID,
+		Name:        name,
+		HashedValue: hashToken(value),
+		Hint:        value[:len(accessTokenPrefix)+4],
+		Scopes:      strings.Join(scopes, " "),
+	}
+	if ttl != 0 {
+		expiration := time.Now().Add(ttl)
+		t.ExpiresAt = &expiration
+	}
+	if err := m.Db.Save(&t).Error; err != nil {
+		return nil, "", err
+	}
+	return &t, value, nil
+}
+
+// UserAccessTokens returns the tokens of u that have not been revoked, newest first
+func (m *Model) UserAccessTokens(u *User) ([]AccessToken, error) {
+	var tokens []AccessToken
+	res := m.Db.Order("id desc").Find(&tokens, "user_id = ? and revoked_at is null", u.ID)
+	return tokens, res.Error
+}
+
+// RevokeAccessToken revokes a token of u. Tokens of other users are not found.
+func (m *Model) RevokeAccessToken(u *User, id uint) error {
+	res := m.Db.Model(&AccessToken{}).
+		Where("id = ? and user_id = ? and revoked_at is null", id, u.ID).
+		UpdateColumn("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// AuthenticateAccessToken returns the valid token with the given value, with its user.
+// The time the token was last used is updated.
+func (m *Model) AuthenticateAccessToken(value string) (*AccessToken, error) {
+	if !strings.HasPrefix(value, accessTokenPrefix) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	var t AccessToken
+	res := m.Db.Preload("User").First(&t, "hashed_value = ?", hashToken(value))
+	if res.RecordNotFound() {
+		return nil, ErrInvalidAccessToken
+	} else if res.Error != nil {
+		return nil, res.Error
+	}
+	// The tokens of blocked users stop working, until they are unblocked
+	if !t.IsValid() || t.User.ID == 0 || t.User.Blocked {
+		return nil, ErrInvalidAccessToken
+	}
+
+	now := time.Now()
+	t.LastUsedAt = &now
+	err := m.Db.Model(&AccessToken{}).Where("id = ?", t.ID).UpdateColumn("last_used_at", now).Error
+	return &t, err
+}
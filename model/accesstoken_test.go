@@ -0,0 +1,55 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessTokens(t *testing.T) {
+	m := New(ConnectTestDB())
+	u := m.registerTestAdmin()
+
+	_, _, err := m.CreateAccessToken(u, "none", nil, 0)
+	assert.NotNil(t, err)
+	_, _, err = m.CreateAccessToken(u, "invalid", []string{"admin"}, 0)
+	assert.NotNil(t, err)
+
+	token, value, err := m.CreateAccessToken(u, "cms", []string{ScopeWrite}, 0)
+	assert.Nil(t, err)
+	assert.NotContains(t, token.HashedValue, value)
+	assert.True(t, token.HasScope(ScopeWrite))
+	assert.False(t, token.HasScope(ScopeRead))
+
+	found, err := m.AuthenticateAccessToken(value)
+	assert.Nil(t, err)
+	assert.Equal(t, token.ID, found.ID)
+	assert.Equal(t, u.ID, found.User.ID)
+	assert.NotNil(t, found.LastUsedAt)
+
+	_, err = m.AuthenticateAccessToken(value + "x")
+	assert.Equal(t, ErrInvalidAccessToken, err)
+
+	// Expired tokens are refused
+	_, expired, err := m.CreateAccessToken(u, "expired", []string{ScopeRead}, -time.Minute)
+	assert.Nil(t, err)
+	_, err = m.AuthenticateAccessToken(expired)
+	assert.Equal(t, ErrInvalidAccessToken, err)
+
+	tokens, err := m.UserAccessTokens(u)
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 2)
+
+	// Only the owner of a token can revoke it
+	other, err := m.RegisterEmail("other", "other@example.com", "password", "")
+	assert.Nil(t, err)
+	assert.NotNil(t, m.RevokeAccessToken(other, token.ID))
+	assert.Nil(t, m.RevokeAccessToken(u, token.ID))
+	_, err = m.AuthenticateAccessToken(value)
+	assert.Equal(t, ErrInvalidAccessToken, err)
+
+	tokens, err = m.UserAccessTokens(u)
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 1)
+}
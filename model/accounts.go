@@ -0,0 +1,228 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrSameUser is returned when merging a user with themselves
+var ErrSameUser = errors.New("can't merge a user with themselves")
+
+// SearchUsers returns the users whose username or email contains query, ordered by
+// username, skipping the first offset ones. The total number of matches is also returned.
+func (m *Model) SearchUsers(query string, limit, offset int) ([]User, int, error) {
+	var users []User
+	var total int
+
+	db := m.Db.Model(&User{})
+	if query = strings.ToLower(strings.TrimSpace(query)); query != "" {
+		like := "%" + query + "%"
+		db = db.Where("lower(username) like ? or lower(email) like ?", like, like)
+	}
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	res := db.Order("username").Limit(limit).Offset(offset).Find(&users)
+	return users, total, res.Error
+}
+
+// PagesOwnedBy returns all pages owned by u, including those not approved yet, ordered by title
+func (m *Model) PagesOwnedBy(u *User) ([]Page, error) {
+	var pages []Page
+	res := m.Db.Order("title").Find(&pages, "owner_id = ?", u.ID)
+	return pages, res.Error
+}
+
+// UserContributions returns the last versions submitted by u, newest first
+func (m *Model) UserContributions(u *User, limit int) ([]ContentVersion, error) {
+	var versions []ContentVersion
+	res := m.Db.Preload("Page").Where("user_id = ?", u.ID).Order("id desc").Limit(limit).Find(&versions)
+	return versions, res.Error
+}
+
+// LogoutEverywhere ends all the sessions of u, by rotating their SessionToken
+func (m *Model) LogoutEverywhere(u *User, by *User) error {
+	token := GenRandomString(18)
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("session_token", token).Error; err != nil {
+			return err
+		}
+		return audit(tx, AuditLoggedOut, by, AuditEntry{UserID: u.ID})
+	})
+	if err != nil {
+		return err
+	}
+	u.SessionToken = token
+	return nil
+}
+
+// MarkEmailVerified marks the email of u as verified, without asking them to confirm it
+func (m *Model) MarkEmailVerified(u *User, by *User) error {
+	if u.Email == nil {
+		return ErrInvalidEmail
+	}
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("email_verified", true).Error; err != nil {
+			return err
+		}
+		return audit(tx, AuditEmailVerified, by, AuditEntry{UserID: u.ID, Details: *u.Email})
+	})
+	if err != nil {
+		return err
+	}
+	u.EmailVerified = true
+	return nil
+}
+
+// SetBlocked blocks or unblocks u, without touching their contributions (see BlockUser).
+// Blocked users are logged out of all their sessions.
+func (m *Model) SetBlocked(u *User, blocked bool, by *User) error {
+	columns := map[string]interface{}{"blocked": blocked}
+	action := AuditUserUnblocked
+	if blocked {
+		columns["session_token"] = GenRandomString(18)
+		action = AuditUserBlocked
+	}
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", u.ID).UpdateColumns(columns).Error; err != nil {
+			return err
+		}
+		return audit(tx, action, by, AuditEntry{UserID: u.ID})
+	})
+	if err != nil {
+		return err
+	}
+	u.Blocked = blocked
+	if token, ok := columns["session_token"].(string); ok {
+		u.SessionToken = token
+	}
+	return nil
+}
+
+// userReference is a column of a table referring to a user
+type userReference struct{ table, column string }
+
+// userReferences lists the columns referring to a user, which are moved to
+// the remaining user when merging two
+var userReferences = []userReference{
+	{"identities", "user_id"},
+	{"pages", "owner_id"},
+	{"pages", "deleted_by_id"},
+	{"content_versions", "user_id"},
+	{"content_versions", "reviewer_id"},
+	{"access_tokens", "user_id"},
+	{"ownership_claims", "user_id"},
+	{"ownership_claims", "reviewer_id"},
+	{"ownership_transfers", "from_id"},
+	{"ownership_transfers", "to_id"},
+	{"ownership_changes", "previous_owner_id"},
+	{"ownership_changes", "new_owner_id"},
+	{"ownership_changes", "by_id"},
+	{"failed_logins", "user_id"},
+	{"user_blocks", "user_id"},
+	{"user_blocks", "by_id"},
+	{"user_blocks", "undone_by_id"},
+}
+
+// moreAuthorizedRole returns the role with more permissions between a and b
+func moreAuthorizedRole(a, b string) string {
+	for _, role := range Roles {
+		if a == role || b == role {
+			return role
+		}
+	}
+	return a
+}
+
+// MergeUsers merges dup into keep, e.g. when the same person signed up twice with
+// Facebook and with their email. Login methods, pages and contributions of dup are
+// moved to keep, which also takes the email, password and two-factor authentication
+// of dup if it had none, and the most authorized of their roles. dup is then deleted.
+// The two users can't both have a profile page.
+func (m *Model) MergeUsers(keep, dup *User, by *User) error {
+	if keep.ID == dup.ID {
+		return ErrSameUser
+	}
+	if m.UserPage(keep) != nil && m.UserPage(dup) != nil {
+		return ErrHasUserPage
+	}
+
+	columns := map[string]interface{}{
+		"role":    moreAuthorizedRole(keep.Role, dup.Role),
+		"blocked": keep.Blocked || dup.Blocked,
+	}
+	if keep.Email == nil && dup.Email != nil {
+		columns["email"] = *dup.Email
+		columns["email_verified"] = dup.EmailVerified
+	}
+	if !keep.HasPasswordLogin() && dup.HashedPassword != "" {
+		columns["hashed_password"] = dup.HashedPassword
+		columns["salt"] = dup.Salt
+	}
+	takeTOTP := !keep.TOTPEnabled && dup.TOTPEnabled
+	if takeTOTP {
+		columns["totp_secret"] = dup.TOTPSecret
+		columns["totp_enabled"] = true
+		columns["totp_last_counter"] = dup.TOTPLastCounter
+	}
+
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		// Maintainers of a page both users maintain would be duplicated
+		err := tx.Exec("DELETE FROM page_maintainers WHERE user_id = ? AND page_id IN (SELECT page_id FROM page_maintainers WHERE user_id = ?)",
+			dup.ID, keep.ID).Error
+		if err != nil {
+			return err
+		}
+
+		refs := []userReference{{"page_maintainers", "user_id"}}
+		if takeTOTP {
+			refs = append(refs, userReference{"recovery_codes", "user_id"})
+		}
+		for _, ref := range append(refs, userReferences...) {
+			err := tx.Exec("UPDATE "+ref.table+" SET "+ref.column+" = ? WHERE "+ref.column+" = ?", keep.ID, dup.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// keep can't maintain the pages it now owns, and transfers between the two are pointless now
+		if err := tx.Exec("DELETE FROM page_maintainers WHERE user_id = ? AND page_id IN (SELECT id FROM pages WHERE owner_id = ?)", keep.ID, keep.ID).Error; err != nil {
+			return err
+		}
+		err = tx.Model(&OwnershipTransfer{}).Where("from_id = to_id and status = ?", RequestPending).
+			UpdateColumn("status", RequestCancelled).Error
+		if err != nil {
+			return err
+		}
+
+		// What is left of dup is only valid for dup
+		if err := tx.Unscoped().Where("user_id = ?", dup.ID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", dup.ID).Delete(&LoginThrottle{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("identifier = ?", dup.ID).Delete(&Token{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&User{}, "id = ?", dup.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&User{}).Where("id = ?", keep.ID).UpdateColumns(columns).Error; err != nil {
+			return err
+		}
+		// The audit log is never rewritten, so the entries of dup keep referring to it
+		return audit(tx, AuditUsersMerged, by, AuditEntry{UserID: keep.ID, Details: fmt.Sprintf("merged %s (%d)", dup.Username, dup.ID)})
+	})
+	if err != nil {
+		return err
+	}
+
+	if merged := m.RetrieveUser(keep.ID); merged != nil {
+		*keep = *merged
+	}
+	return nil
+}
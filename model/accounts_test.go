@@ -0,0 +1,113 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchUsers(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	m.registerTestAdmin()
+	_, err := m.RegisterEmail("mario", "mario@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+	_, err = m.RegisterEmail("maria", "rossi@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+
+	users, total, err := m.SearchUsers("MAR", 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, "maria", users[0].Username)
+	}
+	users, _, err = m.SearchUsers("mar", 1, 1)
+	assert.NoError(t, err)
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, "mario", users[0].Username)
+	}
+
+	// Emails are searched too
+	users, total, err = m.SearchUsers("rossi", 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, "maria", users[0].Username)
+
+	_, total, err = m.SearchUsers("", 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, total)
+}
+
+func TestBlockUser(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	u, err := m.RegisterEmail("mario", "mario@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+	assert.NoError(t, m.MarkEmailVerified(u, admin))
+	assert.True(t, m.RetrieveUser(u.ID).EmailVerified)
+	assert.True(t, m.CanEdit(p, u))
+
+	token := u.SessionToken
+	assert.NoError(t, m.SetBlocked(u, true, admin))
+	assert.NotEqual(t, token, u.SessionToken)
+	assert.True(t, m.RetrieveUser(u.ID).Blocked)
+	assert.False(t, m.CanEdit(p, u))
+
+	assert.NoError(t, m.SetBlocked(u, false, admin))
+	assert.True(t, m.CanEdit(p, u))
+
+	token = u.SessionToken
+	assert.NoError(t, m.LogoutEverywhere(u, admin))
+	assert.NotEqual(t, token, u.SessionToken)
+	assert.Equal(t, u.SessionToken, m.RetrieveUser(u.ID).SessionToken)
+}
+
+func TestMergeUsers(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	keep, err := m.LoginOrCreate(nil, &ExternalAccount{Provider: ProviderFacebook, Subject: "fb1", Name: "mario"})
+	assert.NoError(t, err)
+	dup, err := m.RegisterEmail("mario-rossi", "mario@example.com", "password", RoleEditor)
+	assert.NoError(t, err)
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company", OwnerID: dup.ID}
+	assert.NoError(t, m.SavePage(p, admin))
+	shared := &Page{Content: "Ciao", Type: PageCompany, Title: "Shared company", OwnerID: admin.ID}
+	assert.NoError(t, m.SavePage(shared, admin))
+	assert.NoError(t, m.AddMaintainer(shared, keep, admin))
+	assert.NoError(t, m.AddMaintainer(shared, dup, admin))
+	p.Content = "Ciao da mario"
+	assert.NoError(t, m.SavePage(p, dup))
+
+	assert.Equal(t, ErrSameUser, m.MergeUsers(keep, keep, admin))
+	assert.NoError(t, m.MergeUsers(keep, dup, admin))
+
+	// keep takes the login methods, pages and role of dup, which is deleted
+	assert.Nil(t, m.RetrieveUser(dup.ID))
+	assert.Equal(t, "mario@example.com", *keep.Email)
+	assert.Equal(t, RoleEditor, keep.Role)
+	merged := m.LoginEmail("mario@example.com", "password")
+	if assert.NotNil(t, merged) {
+		assert.Equal(t, keep.ID, merged.ID)
+	}
+	identities, err := m.UserIdentities(keep)
+	assert.NoError(t, err)
+	assert.Len(t, identities, 1)
+
+	pages, err := m.PagesOwnedBy(keep)
+	assert.NoError(t, err)
+	assert.Len(t, pages, 1)
+	contributions, err := m.UserContributions(keep, 10)
+	assert.NoError(t, err)
+	assert.Len(t, contributions, 1)
+	maintainers, err := m.PageMaintainers(shared)
+	assert.NoError(t, err)
+	assert.Len(t, maintainers, 1)
+}
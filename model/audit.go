@@ -0,0 +1,154 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditVersionApproved   = "version.approve"
+	AuditVersionRejected   = "version.reject"
+	AuditPageReverted      = "page.revert"
+	AuditPageDeleted       = "page.delete"
+	AuditPageRestored      = "page.restore"
+	AuditPagePurged        = "page.purge"
+	AuditOwnerChanged      = "page.owner"
+	AuditMaintainerAdded   = "page.maintainer_add"
+	AuditMaintainerRemoved = "page.maintainer_remove"
+
+	AuditRoleChanged       = "user.role"
+	AuditEmailVerified     = "user.verify_email"
+	AuditLoggedOut         = "user.logout_everywhere"
+	AuditUserBlocked       = "user.block"
+	AuditUserUnblocked     = "user.unblock"
+	AuditBlockUndone       = "user.undo_block"
+	AuditUsersMerged       = "user.merge"
+	AuditAccountUnlocked   = "user.unlock"
+	AuditLogin             = "auth.login"
+	AuditLoginFailed       = "auth.login_failed"
+	AuditPasswordChanged   = "auth.password"
+	AuditPasswordRemoved   = "auth.password_removed"
+	AuditEmailChanged      = "auth.email"
+	AuditIdentityLinked    = "auth.identity_link"
+	AuditIdentityUnlinked  = "auth.identity_unlink"
+	AuditTwoFactorEnabled  = "auth.2fa_enable"
+	AuditTwoFactorDisabled = "auth.2fa_disable"
+)
+
+// AuditActions lists all the actions recorded in the audit log
+var AuditActions = []string{
+	AuditVersionApproved, AuditVersionRejected, AuditPageReverted, AuditPageDeleted, AuditPageRestored,
+	AuditPagePurged, AuditOwnerChanged, AuditMaintainerAdded, AuditMaintainerRemoved, AuditRoleChanged,
+	AuditEmailVerified, AuditLoggedOut, AuditUserBlocked, AuditUserUnblocked, AuditBlockUndone,
+	AuditUsersMerged, AuditAccountUnlocked, AuditLogin, AuditLoginFailed, AuditPasswordChanged,
+	AuditPasswordRemoved, AuditEmailChanged, AuditIdentityLinked, AuditIdentityUnlinked,
+	AuditTwoFactorEnabled, AuditTwoFactorDisabled,
+}
+
+// AuditEntry records a privileged or security-relevant action. Entries are only ever
+// added: they are kept when the users and pages they refer to are merged or purged.
+type AuditEntry struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+	// One of AuditActions
+	Action string `gorm:"index;not null"`
+	// Who did it, 0 for the command line or the system
+	ActorID uint `gorm:"index;not null;default:0"`
+	Actor   User
+	// The user acted upon, if any
+	UserID uint `gorm:"index;not null;default:0"`
+	User   User
+	// The page acted upon, if any
+	PageID uint `gorm:"index;not null;default:0"`
+	Page   Page
+	// The address the action came from, when known
+	IP string `gorm:"not null;default:''"`
+	// Further details, such as the new role or the reason of a deletion
+	Details string `gorm:"not null;default:''"`
+}
+
+// audit adds an entry for action done by actor, which may be nil, to the audit log
+func audit(db *gorm.DB, action string, actor *User, entry AuditEntry) error {
+	entry.Action = action
+	if actor != nil {
+		entry.ActorID = actor.ID
+	}
+	return db.Create(&entry).Error
+}
+
+// RecordLogin adds the login of u, from the address ip, to the audit log
+func (m *Model) RecordLogin(u *User, ip string) error {
+	return audit(m.Db, AuditLogin, u, AuditEntry{UserID: u.ID, IP: ip})
+}
+
+// AuditFilter selects entries of the audit log. Zero fields select everything.
+type AuditFilter struct {
+	Action string
+	// Entries done by the user, or acting upon them
+	UserID uint
+	PageID uint
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f AuditFilter) apply(db *gorm.DB) *gorm.DB {
+	if f.Action != "" {
+		db = db.Where("action = ?", f.Action)
+	}
+	if f.UserID != 0 {
+		db = db.Where("actor_id = ? or user_id = ?", f.UserID, f.UserID)
+	}
+	if f.PageID != 0 {
+		db = db.Where("page_id = ?", f.PageID)
+	}
+	if !f.Since.IsZero() {
+		db = db.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		db = db.Where("created_at < ?", f.Until)
+	}
+	return db
+}
+
+// AuditLog returns the entries of the audit log selected by f, newest first, skipping
+// the first offset ones. The total number of entries selected is also returned.
+func (m *Model) AuditLog(f AuditFilter, limit, offset int) ([]AuditEntry, int, error) {
+	var entries []AuditEntry
+	var total int
+
+	db := f.apply(m.Db.Model(&AuditEntry{}))
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	res := db.Preload("Actor").Preload("User").Preload("Page").
+		Order("id desc").Limit(limit).Offset(offset).Find(&entries)
+	return entries, total, res.Error
+}
+
+// auditBatchSize is how many entries EachAuditEntry reads at a time
+const auditBatchSize = 500
+
+// EachAuditEntry calls fn with the entries of the audit log selected by f, oldest first,
+// stopping at the first error
+func (m *Model) EachAuditEntry(f AuditFilter, fn func(*AuditEntry) error) error {
+	var last uint
+	for {
+		var entries []AuditEntry
+		res := f.apply(m.Db).Preload("Actor").Preload("User").Preload("Page").
+			Where("id > ?", last).Order("id").Limit(auditBatchSize).Find(&entries)
+		if res.Error != nil {
+			return res.Error
+		}
+		for i := range entries {
+			if err := fn(&entries[i]); err != nil {
+				return err
+			}
+		}
+		if len(entries) < auditBatchSize {
+			return nil
+		}
+		last = entries[len(entries)-1].ID
+	}
+}
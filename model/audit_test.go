@@ -0,0 +1,76 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	u, err := m.RegisterEmail("mario", "mario@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+	assert.NoError(t, m.MarkEmailVerified(u, admin))
+	p.Content = "Ciao da mario"
+	assert.NoError(t, m.SavePage(p, u))
+	pending, err := m.PendingVersions()
+	assert.NoError(t, err)
+	_, err = m.ApproveVersion(&pending[0], admin, "grazie")
+	assert.NoError(t, err)
+	assert.NoError(t, m.SetRole(u, RoleEditor, admin))
+	assert.NoError(t, m.RecordLogin(u, "192.0.2.1"))
+	assert.NoError(t, m.DeletePage(p, admin, "spam"))
+
+	entries, total, err := m.AuditLog(AuditFilter{}, 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, total)
+	if assert.Len(t, entries, 5) {
+		// Newest first
+		assert.Equal(t, AuditPageDeleted, entries[0].Action)
+		assert.Equal(t, "spam", entries[0].Details)
+		assert.Equal(t, AuditLogin, entries[1].Action)
+		assert.Equal(t, "192.0.2.1", entries[1].IP)
+		assert.Equal(t, AuditRoleChanged, entries[2].Action)
+		assert.Equal(t, "user to editor", entries[2].Details)
+		assert.Equal(t, "vigliag", entries[2].Actor.Username)
+		assert.Equal(t, "mario", entries[2].User.Username)
+		assert.Equal(t, AuditVersionApproved, entries[3].Action)
+		assert.Equal(t, p.ID, entries[3].PageID)
+	}
+
+	entries, total, err = m.AuditLog(AuditFilter{Action: AuditRoleChanged}, 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Len(t, entries, 1)
+
+	// Users are matched both as actors and as the target of actions
+	_, total, err = m.AuditLog(AuditFilter{UserID: u.ID}, 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, total)
+
+	_, total, err = m.AuditLog(AuditFilter{Since: time.Now().Add(time.Hour)}, 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, total)
+
+	// The export goes through all the entries, oldest first
+	var actions []string
+	err = m.EachAuditEntry(AuditFilter{PageID: p.ID}, func(e *AuditEntry) error {
+		actions = append(actions, e.Action)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{AuditVersionApproved, AuditPageDeleted}, actions)
+
+	// Entries are kept when what they refer to is gone
+	assert.NoError(t, m.PurgePage(p, admin))
+	_, total, err = m.AuditLog(AuditFilter{PageID: p.ID}, 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, total)
+}
@@ -0,0 +1,261 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrBlockUndone is returned when undoing a block which has been undone already
+var ErrBlockUndone = errors.New("the block has been undone already")
+
+// UserBlock records the blocking of a user by an admin, together with the cleanup of
+// their contributions made at the same time, so that all of it can be undone (see UndoBlock)
+type UserBlock struct {
+	gorm.Model
+	UserID uint `gorm:"index"`
+	User   User
+	ByID   uint
+	By     User
+	Reason string `gorm:"not null;default:''"`
+
+	// Versions of the user which were pending, and were rejected by the block
+	RejectedVersions []BlockedVersion `gorm:"foreignkey:BlockID"`
+	// Pages whose approved version was by the user, rolled back to one by another
+	// author or moved to the trash
+	Rollbacks []BlockRollback `gorm:"foreignkey:BlockID"`
+
+	// Set when the block is undone
+	UndoneAt   *time.Time
+	UndoneByID uint `gorm:"not null;default:0"`
+	UndoneBy   User
+}
+
+// IsActive tells if the block has not been undone
+func (b *UserBlock) IsActive() bool {
+	return b.UndoneAt == nil
+}
+
+// BlockedVersion is a pending version rejected when blocking its author
+type BlockedVersion struct {
+	BlockID   uint `gorm:"primary_key;auto_increment:false"`
+	VersionID uint `gorm:"primary_key;auto_increment:false"`
+}
+
+// BlockRollback is a page rolled back when blocking the author of its approved version,
+// or moved to the trash if no other author ever had a version of it approved
+type BlockRollback struct {
+	ID      uint `gorm:"primary_key"`
+	BlockID uint `gorm:"index"`
+	PageID  uint
+	Page    Page
+	// The approved version before the rollback, by the blocked user
+	FromVersionID uint
+	// The version saved by the rollback, restoring the content of one by another author,
+	// or zero if the page was moved to the trash
+	RevertVersionID uint
+	Trashed         bool `gorm:"not null;default:false"`
+}
+
+// BlockUser blocks u, so that they can no longer log in nor edit pages, and rejects all
+// their pending versions. With rollback, the pages whose approved version is by u are
+// also rolled back to the last approved version by another author or, if there is none,
+// moved to the trash. Everything is recorded in the returned UserBlock, together with
+// the pages rolled back or trashed, which need to be re-indexed.
+func (m *Model) BlockUser(u, by *User, reason string, rollback bool) (*UserBlock, []*Page, error) {
+	block := UserBlock{UserID: u.ID, ByID: by.ID, Reason: reason}
+	var rolledBack []*Page
+
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&block).Error; err != nil {
+			return err
+		}
+
+		var pending []ContentVersion
+		err := tx.Joins("JOIN pages ON pages.id = content_versions.page_id").
+			Where("content_versions.user_id = ? and content_versions.status = ?", u.ID, VersionPending).
+			Where("content_versions.id > pages.approved_version_id").
+			Find(&pending).Error
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for i := range pending {
+			if err := markReviewed(tx, &pending[i], VersionRejected, by, reason, now); err != nil {
+				return err
+			}
+			rejected := BlockedVersion{BlockID: block.ID, VersionID: pending[i].ID}
+			if err := tx.Create(&rejected).Error; err != nil {
+				return err
+			}
+			block.RejectedVersions = append(block.RejectedVersions, rejected)
+		}
+
+		if rollback {
+			var pages []*Page
+			err := tx.Joins("JOIN content_versions ON content_versions.id = pages.approved_version_id").
+				Where("content_versions.user_id = ?", u.ID).
+				Find(&pages).Error
+			if err != nil {
+				return err
+			}
+			for _, p := range pages {
+				var previous ContentVersion
+				res := tx.Where("page_id = ? and user_id <> ? and status = ? and id < ?", p.ID, u.ID, VersionApproved, p.ApprovedVersionID).
+					Order("id desc").First(&previous)
+				rb := BlockRollback{BlockID: block.ID, PageID: p.ID, FromVersionID: p.ApprovedVersionID}
+				if res.RecordNotFound() {
+					// No other author ever had a version of the page approved
+					if err := deletePage(tx, p, by, reason); err != nil {
+						return err
+					}
+					rb.Trashed = true
+				} else if res.Error != nil {
+					return res.Error
+				} else {
+					cv, err := revertPage(tx, p, &previous, by)
+					if err != nil {
+						return err
+					}
+					rb.RevertVersionID = cv.ID
+				}
+				if err := tx.Create(&rb).Error; err != nil {
+					return err
+				}
+				block.Rollbacks = append(block.Rollbacks, rb)
+				rolledBack = append(rolledBack, p)
+			}
+		}
+
+		err = tx.Model(&User{}).Where("id = ?", u.ID).UpdateColumns(map[string]interface{}{
+			"blocked":       true,
+			"session_token": GenRandomString(18),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return audit(tx, AuditUserBlocked, by, AuditEntry{UserID: u.ID, Details: blockDetails(&block)})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if blocked := m.RetrieveUser(u.ID); blocked != nil {
+		*u = *blocked
+	}
+	return &block, rolledBack, nil
+}
+
+// blockDetails describes a block in the audit log
+func blockDetails(b *UserBlock) string {
+	details := fmt.Sprintf("block %d, %d versions rejected, %d pages rolled back or trashed", b.ID, len(b.RejectedVersions), len(b.Rollbacks))
+	if b.Reason != "" {
+		details += ": " + b.Reason
+	}
+	return details
+}
+
+// UndoBlock unblocks the user of b, and puts the versions rejected by the block back
+// in review. Rolled back pages get back the version by the blocked user they had,
+// unless they have been edited since, and trashed pages still in the trash are restored.
+// The pages restored are returned, as they need to be re-indexed.
+func (m *Model) UndoBlock(b *UserBlock, by *User) ([]*Page, error) {
+	now := time.Now()
+	var restored []*Page
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&UserBlock{}).Where("id = ? and undone_at IS NULL", b.ID).UpdateColumns(map[string]interface{}{
+			"undone_at":    now,
+			"undone_by_id": by.ID,
+		})
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			return ErrBlockUndone
+		}
+
+		// Versions reviewed again after the block are left alone
+		err := tx.Model(&ContentVersion{}).
+			Where("id IN (SELECT version_id FROM blocked_versions WHERE block_id = ?) and status = ?", b.ID, VersionRejected).
+			UpdateColumns(map[string]interface{}{
+				"status":      VersionPending,
+				"reviewer_id": 0,
+				"review_note": "",
+				"reviewed_at": nil,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		var rollbacks []BlockRollback
+		if err := tx.Where("block_id = ?", b.ID).Find(&rollbacks).Error; err != nil {
+			return err
+		}
+		for _, rb := range rollbacks {
+			var p Page
+			if rb.Trashed {
+				res := tx.Unscoped().Where("id = ? and deleted_at IS NOT NULL", rb.PageID).First(&p)
+				if res.RecordNotFound() {
+					continue
+				} else if res.Error != nil {
+					return res.Error
+				}
+				if err := restorePage(tx, &p, by); err != nil {
+					return err
+				}
+				restored = append(restored, &p)
+				continue
+			}
+			res := tx.Where("id = ? and approved_version_id = ?", rb.PageID, rb.RevertVersionID).First(&p)
+			if res.RecordNotFound() {
+				continue
+			} else if res.Error != nil {
+				return res.Error
+			}
+			var from ContentVersion
+			if err := tx.First(&from, "id = ?", rb.FromVersionID).Error; err != nil {
+				return err
+			}
+			// The page goes back to the exact version it had, so that the versions
+			// submitted after it are pending again
+			p.Content = from.Content
+			p.ApprovedVersionID = from.ID
+			p.SetFieldsToParsedContent()
+			if err := tx.Save(&p).Error; err != nil {
+				return err
+			}
+			restored = append(restored, &p)
+		}
+
+		if err := tx.Model(&User{}).Where("id = ?", b.UserID).UpdateColumn("blocked", false).Error; err != nil {
+			return err
+		}
+		return audit(tx, AuditBlockUndone, by, AuditEntry{UserID: b.UserID, Details: fmt.Sprintf("block %d", b.ID)})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.UndoneAt = &now
+	b.UndoneByID = by.ID
+	return restored, nil
+}
+
+// FindBlock returns a UserBlock with the user it blocked, or nil
+func (m *Model) FindBlock(id uint) *UserBlock {
+	var b UserBlock
+	if err := m.Db.Preload("User").First(&b, "id = ?", id).Error; err != nil {
+		return nil
+	}
+	return &b
+}
+
+// UserBlocks returns the blocks of u, with what they did, newest first
+func (m *Model) UserBlocks(u *User) ([]UserBlock, error) {
+	var blocks []UserBlock
+	res := m.Db.Preload("By").Preload("UndoneBy").Preload("RejectedVersions").Preload("Rollbacks").
+		Preload("Rollbacks.Page", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+		Where("user_id = ?", u.ID).Order("id desc").Find(&blocks)
+	return blocks, res.Error
+}
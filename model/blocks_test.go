@@ -0,0 +1,110 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockAndUndo(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	spammer, err := m.RegisterEmail("spammer", "spammer@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+	assert.NoError(t, m.MarkEmailVerified(spammer, admin))
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+	// A page with no other author is moved to the trash
+	own := &Page{Content: "Spam", Type: PageCompany, Title: "Spam company", OwnerID: spammer.ID}
+	assert.NoError(t, m.SavePage(own, spammer))
+
+	// One edit of the spammer got approved, another one is waiting for review
+	p.Content = "Spam"
+	assert.NoError(t, m.SavePage(p, spammer))
+	pending, err := m.PendingVersions()
+	assert.NoError(t, err)
+	_, err = m.ApproveVersion(&pending[0], admin, "")
+	assert.NoError(t, err)
+	p.Content = "More spam"
+	assert.NoError(t, m.SavePage(p, spammer))
+
+	block, pages, err := m.BlockUser(spammer, admin, "spam", true)
+	assert.NoError(t, err)
+	assert.True(t, spammer.Blocked)
+	assert.False(t, m.CanEdit(p, spammer))
+	assert.Len(t, block.RejectedVersions, 1)
+	if assert.Len(t, pages, 2) {
+		assert.Equal(t, p.ID, pages[0].ID)
+		assert.Equal(t, own.ID, pages[1].ID)
+		assert.NotNil(t, pages[1].DeletedAt)
+	}
+	assert.Equal(t, "Ciao", m.FindPage(p.ID, PageCompany).Content)
+	assert.Nil(t, m.FindPage(own.ID, PageCompany))
+	assert.NotNil(t, m.FindDeletedPage(own.ID))
+	pending, err = m.PendingVersions()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	blocks, err := m.UserBlocks(spammer)
+	assert.NoError(t, err)
+	if assert.Len(t, blocks, 1) {
+		assert.True(t, blocks[0].IsActive())
+		if assert.Len(t, blocks[0].Rollbacks, 2) {
+			assert.Equal(t, "Example company", blocks[0].Rollbacks[0].Page.Title)
+			assert.True(t, blocks[0].Rollbacks[1].Trashed)
+			assert.Equal(t, "Spam company", blocks[0].Rollbacks[1].Page.Title)
+		}
+	}
+
+	// Undoing the block restores everything
+	pages, err = m.UndoBlock(block, admin)
+	assert.NoError(t, err)
+	assert.Len(t, pages, 2)
+	assert.Equal(t, "Spam", m.FindPage(own.ID, PageCompany).Content)
+	assert.False(t, m.RetrieveUser(spammer.ID).Blocked)
+	assert.Equal(t, "Spam", m.FindPage(p.ID, PageCompany).Content)
+	pending, err = m.PendingVersions()
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "More spam", pending[0].Content)
+	}
+
+	_, err = m.UndoBlock(m.FindBlock(block.ID), admin)
+	assert.Equal(t, ErrBlockUndone, err)
+	// Even when holding a copy loaded before the undo
+	stale := *block
+	stale.UndoneAt = nil
+	_, err = m.UndoBlock(&stale, admin)
+	assert.Equal(t, ErrBlockUndone, err)
+}
+
+func TestUndoBlockAfterEdits(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	spammer, err := m.RegisterEmail("spammer", "spammer@example.com", "password", RoleEditor)
+	assert.NoError(t, err)
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+	p.Content = "Spam"
+	assert.NoError(t, m.SavePage(p, spammer))
+
+	block, _, err := m.BlockUser(spammer, admin, "spam", true)
+	assert.NoError(t, err)
+	assert.Len(t, block.Rollbacks, 1)
+
+	// Pages edited after the rollback keep their content
+	p = m.FindPage(p.ID, PageCompany)
+	p.Content = "Ciao a tutti"
+	assert.NoError(t, m.SavePage(p, admin))
+
+	pages, err := m.UndoBlock(block, admin)
+	assert.NoError(t, err)
+	assert.Empty(t, pages)
+	assert.Equal(t, "Ciao a tutti", m.FindPage(p.ID, PageCompany).Content)
+}
@@ -16,6 +16,7 @@ func normalizeHeaders(sections map[string]string) map[string]string {
 		"in breve":    "short",
 		"città":       "area",
 		"descrizione": "description",
+		"settore":     "sector",
 	}
 	result := make(map[string]string)
 	for k, v := range sections {
@@ -13,7 +13,7 @@ func Connect(dbPath string) *gorm.DB {
 		panic(err)
 	}
 
-	Db.AutoMigrate(&User{}, &Page{}, &ContentVersion{}, &Token{})
+	migrate(Db)
 
 	return Db
 }
@@ -25,6 +25,22 @@ func ConnectTestDB() *gorm.DB {
 		panic(err)
 	}
 
-	Db.AutoMigrate(&User{}, &Page{}, &ContentVersion{}, &Token{})
+	migrate(Db)
 	return Db
 }
+
+// migrate creates or updates the tables of all models
+func migrate(db *gorm.DB) {
+	// Versions saved before they had a review status need one
+	unreviewed := db.HasTable(&ContentVersion{}) && !db.Dialect().HasColumn("content_versions", "status")
+
+	db.AutoMigrate(&User{}, &Page{}, &ContentVersion{}, &Token{}, &PageSlug{}, &AccessToken{}, &Identity{}, &RecoveryCode{}, &LoginThrottle{}, &FailedLogin{}, &PageMaintainer{}, &OwnershipClaim{}, &OwnershipTransfer{}, &OwnershipChange{}, &UserBlock{}, &BlockedVersion{}, &BlockRollback{}, &AuditEntry{})
+	if err := migrateFacebookIDs(db); err != nil {
+		panic(err)
+	}
+	if unreviewed {
+		if err := migrateVersionStatus(db); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package model
+
+import (
+	"sort"
+	"strings"
+)
+
+// DiffOp tells whether a line was kept, added or removed
+type DiffOp int
+
+// Kinds of DiffLine
+const (
+	DiffEqual DiffOp = iota
+	DiffInsert
+	DiffDelete
+)
+
+func (op DiffOp) String() string {
+	switch op {
+	case DiffInsert:
+		return "insert"
+	case DiffDelete:
+		return "delete"
+	}
+	return "equal"
+}
+
+// DiffLine is a line of a diff, along with the operation that produced it
+type DiffLine struct {
+	Op   DiffOp
+	Text string
+}
+
+// SectionStatus tells how a markdown section changed between two versions
+type SectionStatus int
+
+// Kinds of SectionDiff
+const (
+	SectionUnchanged SectionStatus = iota
+	SectionAdded
+	SectionRemoved
+	SectionChanged
+)
+
+func (s SectionStatus) String() string {
+	switch s {
+	case SectionAdded:
+		return "added"
+	case SectionRemoved:
+		return "removed"
+	case SectionChanged:
+		return "changed"
+	}
+	return "unchanged"
+}
+
+// SectionDiff is the diff of a single section, as returned by ParseContent
+type SectionDiff struct {
+	Name   string
+	Status SectionStatus
+	Lines  []DiffLine
+}
+
+func splitLines(s string) []string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// maxDiffCells bounds the table used to diff the lines that changed between two
+// texts, whose size is the product of their numbers of lines
+const maxDiffCells = 1 << 21
+
+// DiffLines computes a line-level diff between a and b, based on their
+// longest common subsequence. If the lines that changed are too many (see
+// DiffTooLarge), they are all returned as removed from a and added in b.
+func DiffLines(a, b string) []DiffLine {
+	return diffLines(splitLines(a), splitLines(b))
+}
+
+// DiffTooLarge tells if too many lines changed between a and b to diff them line by line
+func DiffTooLarge(a, b string) bool {
+	la, lb := splitLines(a), splitLines(b)
+	prefix, suffix := commonLines(la, lb)
+	return tooLargeToDiff(len(la)-prefix-suffix, len(lb)-prefix-suffix)
+}
+
+func tooLargeToDiff(na, nb int) bool {
+	return (na+1)*(nb+1) > maxDiffCells
+}
+
+// commonLines returns the number of lines a and b have in common at their start and end
+func commonLines(a, b []string) (prefix, suffix int) {
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	return prefix, suffix
+}
+
+func diffLines(a, b []string) []DiffLine {
+	var result []DiffLine
+
+	// Common prefix and suffix do not need to go through the LCS table
+	prefix, suffix := commonLines(a, b)
+
+	for _, l := range a[:prefix] {
+		result = append(result, DiffLine{DiffEqual, l})
+	}
+
+	ma := a[prefix : len(a)-suffix]
+	mb := b[prefix : len(b)-suffix]
+	if tooLargeToDiff(len(ma), len(mb)) {
+		for _, l := range ma {
+			result = append(result, DiffLine{DiffDelete, l})
+		}
+		for _, l := range mb {
+			result = append(result, DiffLine{DiffInsert, l})
+		}
+	} else {
+		result = append(result, lcsDiff(ma, mb)...)
+	}
+
+	for _, l := range a[len(a)-suffix:] {
+		result = append(result, DiffLine{DiffEqual, l})
+	}
+	return result
+}
+
+// lcsDiff diffs a and b through the table of their longest common subsequences
+func lcsDiff(a, b []string) []DiffLine {
+	var result []DiffLine
+
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, DiffLine{DiffEqual, a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			result = append(result, DiffLine{DiffDelete, a[i]})
+			i++
+		default:
+			result = append(result, DiffLine{DiffInsert, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		result = append(result, DiffLine{DiffDelete, a[i]})
+	}
+	for ; j < len(b); j++ {
+		result = append(result, DiffLine{DiffInsert, b[j]})
+	}
+	return result
+}
+
+// DiffSections compares the sections of two contents, as returned by ParseContent.
+// Sections are returned sorted by name.
+func DiffSections(a, b string) []SectionDiff {
+	sa := ParseContent(a)
+	sb := ParseContent(b)
+
+	var names []string
+	for name := range sa {
+		names = append(names, name)
+	}
+	for name := range sb {
+		if _, ok := sa[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]SectionDiff, len(names))
+	for i, name := range names {
+		va, inA := sa[name]
+		vb, inB := sb[name]
+
+		status := SectionUnchanged
+		switch {
+		case !inA:
+			status = SectionAdded
+		case !inB:
+			status = SectionRemoved
+		case va != vb:
+			status = SectionChanged
+		}
+
+		result[i] = SectionDiff{Name: name, Status: status, Lines: DiffLines(va, vb)}
+	}
+	return result
+}
+
+// MergeChunk is a part of a three-way merge. Chunks that are not in conflict
+// only have Lines set, while conflicting chunks carry the three versions of the text.
+type MergeChunk struct {
+	Conflict bool
+	Lines    []string
+
+	Base   []string
+	Mine   []string
+	Theirs []string
+}
+
+// alignment returns, for each line of a, the index of the same line in b
+// according to their diff, or -1 if the line was removed
+func alignment(a, b []string) []int {
+	result := make([]int, len(a))
+	i, j := 0, 0
+	for _, l := range diffLines(a, b) {
+		switch l.Op {
+		case DiffEqual:
+			result[i] = j
+			i++
+			j++
+		case DiffDelete:
+			result[i] = -1
+			i++
+		case DiffInsert:
+			j++
+		}
+	}
+	return result
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge3 merges two contents derived from the same base, line by line.
+// Changes made on only one side are applied, while overlapping different
+// changes are returned as conflicting chunks.
+func Merge3(base, mine, theirs string) []MergeChunk {
+	o, a, b := splitLines(base), splitLines(mine), splitLines(theirs)
+	ma, mb := alignment(o, a), alignment(o, b)
+
+	var chunks []MergeChunk
+	addLines := func(lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		if n := len(chunks); n > 0 && !chunks[n-1].Conflict {
+			chunks[n-1].Lines = append(chunks[n-1].Lines, lines...)
+			return
+		}
+		chunks = append(chunks, MergeChunk{Lines: append([]string{}, lines...)})
+	}
+	resolve := func(co, ca, cb []string) {
+		switch {
+		case equalLines(ca, co):
+			addLines(cb)
+		case equalLines(cb, co), equalLines(ca, cb):
+			addLines(ca)
+		default:
+			chunks = append(chunks, MergeChunk{Conflict: true, Base: co, Mine: ca, Theirs: cb})
+		}
+	}
+
+	i, ia, ib := 0, 0, 0
+	for i < len(o) || ia < len(a) || ib < len(b) {
+		// Lines unchanged on both sides
+		k := 0
+		for i+k < len(o) && ma[i+k] == ia+k && mb[i+k] == ib+k {
+			k++
+		}
+		if k > 0 {
+			addLines(o[i : i+k])
+			i, ia, ib = i+k, ia+k, ib+k
+			continue
+		}
+
+		// Find the next base line that both sides kept
+		next := i
+		for next < len(o) && (ma[next] < 0 || mb[next] < 0) {
+			next++
+		}
+		if next == len(o) {
+			resolve(o[i:], a[ia:], b[ib:])
+			break
+		}
+		resolve(o[i:next], a[ia:ma[next]], b[ib:mb[next]])
+		i, ia, ib = next, ma[next], mb[next]
+	}
+	return chunks
+}
+
+// HasConflicts tells if any of the chunks of a merge is in conflict
+func HasConflicts(chunks []MergeChunk) bool {
+	for _, c := range chunks {
+		if c.Conflict {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeText joins the chunks of a merge in a single text, marking the
+// conflicts in the same way as git does
+func MergeText(chunks []MergeChunk, mineLabel, theirsLabel string) string {
+	var b strings.Builder
+	writeLines := func(lines []string) {
+		for _, l := range lines {
+			b.WriteString(l)
+			b.WriteString("\n")
+		}
+	}
+	for _, c := range chunks {
+		if !c.Conflict {
+			writeLines(c.Lines)
+			continue
+		}
+		b.WriteString("<<<<<<< " + mineLabel + "\n")
+		writeLines(c.Mine)
+		b.WriteString("=======\n")
+		writeLines(c.Theirs)
+		b.WriteString(">>>>>>> " + theirsLabel + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffLines(t *testing.T) {
+	a := "uno\ndue\ntre\nquattro"
+	b := "uno\ntre\ntre e mezzo\nquattro\n"
+
+	assert.Equal(t, []DiffLine{
+		{DiffEqual, "uno"},
+		{DiffDelete, "due"},
+		{DiffEqual, "tre"},
+		{DiffInsert, "tre e mezzo"},
+		{DiffEqual, "quattro"},
+	}, DiffLines(a, b))
+
+	assert.Empty(t, DiffLines("", ""))
+	assert.Equal(t, []DiffLine{{DiffInsert, "nuovo"}}, DiffLines("", "nuovo"))
+	assert.Equal(t, []DiffLine{{DiffDelete, "vecchio"}}, DiffLines("vecchio", ""))
+}
+
+func TestDiffTooLarge(t *testing.T) {
+	var a, b strings.Builder
+	for i := 0; i < 30000; i++ {
+		fmt.Fprintf(&a, "riga %d\n", i)
+		fmt.Fprintf(&b, "linea %d\n", i)
+	}
+	assert.True(t, DiffTooLarge(a.String(), b.String()))
+	assert.False(t, DiffTooLarge(a.String(), a.String()+"fine"))
+
+	// Lines are all replaced, instead of building a table of 30000x30000 cells
+	lines := DiffLines("inizio\n"+a.String(), "inizio\n"+b.String())
+	if assert.Len(t, lines, 60001) {
+		assert.Equal(t, DiffLine{DiffEqual, "inizio"}, lines[0])
+		assert.Equal(t, DiffLine{DiffDelete, "riga 0"}, lines[1])
+		assert.Equal(t, DiffLine{DiffInsert, "linea 0"}, lines[30001])
+	}
+
+	// and the merge of such versions is a single conflict
+	chunks := Merge3(a.String(), b.String(), a.String()+"fine")
+	if assert.Len(t, chunks, 1) {
+		assert.True(t, chunks[0].Conflict)
+	}
+}
+
+func TestDiffSections(t *testing.T) {
+	a := "Breve\n\n### Descrizione\n\nVecchia descrizione\n\n### Links\n\n- a"
+	b := "Breve\n\n### Descrizione\n\nNuova descrizione\n\n### Progetti\n\n- p"
+
+	sections := DiffSections(a, b)
+	statuses := make(map[string]SectionStatus)
+	for _, s := range sections {
+		statuses[s.Name] = s.Status
+	}
+
+	assert.Equal(t, map[string]SectionStatus{
+		"short":       SectionUnchanged,
+		"description": SectionChanged,
+		"links":       SectionRemoved,
+		"progetti":    SectionAdded,
+	}, statuses)
+	assert.Equal(t, "description", sections[0].Name)
+}
+
+func TestMerge3(t *testing.T) {
+	base := "uno\ndue\ntre\nquattro"
+
+	// Changes to different lines are merged
+	chunks := Merge3(base, "uno\ndue bis\ntre\nquattro", "uno\ndue\ntre\nquattro\ncinque")
+	assert.False(t, HasConflicts(chunks))
+	assert.Equal(t, "uno\ndue bis\ntre\nquattro\ncinque\n", MergeText(chunks, "mine", "theirs"))
+
+	// The same change on both sides is not a conflict
+	chunks = Merge3(base, "uno\ndue\ntre", "uno\ndue\ntre")
+	assert.False(t, HasConflicts(chunks))
+	assert.Equal(t, "uno\ndue\ntre\n", MergeText(chunks, "mine", "theirs"))
+
+	// Different changes to the same line are
+	chunks = Merge3(base, "uno\nDUE\ntre\nquattro", "uno\ndue!\ntre\nquattro")
+	assert.True(t, HasConflicts(chunks))
+	assert.Equal(t, []MergeChunk{
+		{Lines: []string{"uno"}},
+		{Conflict: true, Base: []string{"due"}, Mine: []string{"DUE"}, Theirs: []string{"due!"}},
+		{Lines: []string{"tre", "quattro"}},
+	}, chunks)
+	assert.Equal(t, "uno\n<<<<<<< mine\nDUE\n=======\ndue!\n>>>>>>> theirs\ntre\nquattro\n", MergeText(chunks, "mine", "theirs"))
+}
@@ -0,0 +1,266 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ProviderFacebook is the name of the Facebook login provider, whose identities
+// used to be stored in the facebook_id column of users
+const ProviderFacebook = "facebook"
+
+// Identity links a user to their account on an external login provider.
+// A user can have many identities, but an account can only be linked to one user.
+type Identity struct {
+	gorm.Model
+
+	UserID uint `gorm:"index"`
+	User   User
+
+	// Name of the provider, e.g. "github"
+	Provider string `gorm:"unique_index:idx_identity_provider_subject"`
+	// ID of the account at the provider
+	Subject string `gorm:"unique_index:idx_identity_provider_subject"`
+
+	// Name and email of the account, as given by the provider the last time it was used
+	Name  string `gorm:"not null;default:''"`
+	Email string `gorm:"not null;default:''"`
+}
+
+// ExternalAccount is an account on a login provider, as returned after the user logs in there
+type ExternalAccount struct {
+	Provider string
+	Subject  string
+	Name     string
+	// nil if the provider did not share the email
+	Email *string
+	// If the provider verified that the email belongs to the user
+	EmailVerified bool
+}
+
+// FindIdentity returns the identity for an account of a provider, or nil
+func (m *Model) FindIdentity(provider, subject string) *Identity {
+	var identity Identity
+	res := m.Db.First(&identity, "provider = ? and subject = ?", provider, subject)
+	if res.Error != nil {
+		return nil
+	}
+	return &identity
+}
+
+// UserIdentities returns the identities linked to u
+func (m *Model) UserIdentities(u *User) ([]Identity, error) {
+	var identities []Identity
+	res := m.Db.Order("provider, id").Find(&identities, "user_id = ?", u.ID)
+	return identities, res.Error
+}
+
+// LinkIdentity links an external account to u
+func (m *Model) LinkIdentity(u *User, account *ExternalAccount) (*Identity, error) {
+	identity := Identity{
+		UserID:   u.ID,
+		Provider: account.Provider,
+		Subject:  account.Subject,
+		Name:     account.Name,
+	}
+	if account.Email != nil {
+		identity.Email = *account.Email
+	}
+	if err := m.Db.Save(&identity).Error; err != nil {
+		return nil, err
+	}
+	return &identity, audit(m.Db, AuditIdentityLinked, u, AuditEntry{UserID: u.ID, Details: identity.Provider})
+}
+
+// ErrLastLoginMethod is returned when removing the only way a user has to log in
+var ErrLastLoginMethod = errors.New("the user must keep at least one login method")
+
+// loginMethods counts the ways u can log in: their password and their identities
+func loginMethods(db *gorm.DB, u *User) (int, error) {
+	var count int
+	if err := db.Model(&Identity{}).Where("user_id = ?", u.ID).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	if u.HasPasswordLogin() {
+		count++
+	}
+	return count, nil
+}
+
+// UnlinkIdentity removes the identity with the given id from u,
+// unless it is the only login method left to them
+func (m *Model) UnlinkIdentity(u *User, id uint) error {
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		var identity Identity
+		if err := tx.First(&identity, "id = ? and user_id = ?", id, u.ID).Error; err != nil {
+			return err
+		}
+
+		count, err := loginMethods(tx, u)
+		if err != nil {
+			return err
+		}
+		if count <= 1 {
+			return ErrLastLoginMethod
+		}
+		// the identity is deleted for good, so that the account can be linked again
+		if err := tx.Unscoped().Delete(&identity).Error; err != nil {
+			return err
+		}
+		return audit(tx, AuditIdentityUnlinked, u, AuditEntry{UserID: u.ID, Details: identity.Provider})
+	})
+}
+
+// RemovePassword disables the login with email and password for u,
+// as long as they can log in with a linked identity
+func (m *Model) RemovePassword(u *User) error {
+	if !u.HasPasswordLogin() {
+		return nil
+	}
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		count, err := loginMethods(tx, u)
+		if err != nil {
+			return err
+		}
+		if count <= 1 {
+			return ErrLastLoginMethod
+		}
+		err = tx.Model(&User{}).Where("id = ?", u.ID).
+			UpdateColumns(map[string]interface{}{"hashed_password": "", "salt": ""}).Error
+		if err != nil {
+			return err
+		}
+		u.HashedPassword = ""
+		u.Salt = ""
+		return audit(tx, AuditPasswordRemoved, u, AuditEntry{UserID: u.ID})
+	})
+}
+
+// IsVerified tells if the identity of the user has been confirmed, either by
+// verifying their email or by logging in with an external provider.
+// Users who are not verified can't edit pages.
+func (m *Model) IsVerified(u *User) bool {
+	if u.EmailVerified {
+		return true
+	}
+	var count int
+	m.Db.Model(&Identity{}).Where("user_id = ?", u.ID).Count(&count)
+	return count > 0
+}
+
+// availableUsername returns name, or name followed by a number if it is already taken
+func (m *Model) availableUsername(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "user"
+	}
+	candidate := name
+	for i := 2; m.UsernameTaken(candidate); i++ {
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+	return candidate
+}
+
+// LoginOrCreate returns the user to log in after they logged in with an external account.
+//
+// If the account is linked to a user, that user is returned. Otherwise the account
+// is linked to currentUser, if not nil, or to the user having the same verified email.
+// If no such user exists, a new one is created.
+func (m *Model) LoginOrCreate(currentUser *User, account *ExternalAccount) (*User, error) {
+	verifiedEmail := account.Email != nil && account.EmailVerified && *account.Email != ""
+
+	// if the account is already in the system, we want to log the user in with that
+	if identity := m.FindIdentity(account.Provider, account.Subject); identity != nil {
+		user := m.RetrieveUser(identity.UserID)
+		if user == nil {
+			return nil, fmt.Errorf("user %d of identity %d not found", identity.UserID, identity.ID)
+		}
+
+		updates := map[string]interface{}{"name": account.Name, "updated_at": time.Now()}
+		if account.Email != nil {
+			updates["email"] = *account.Email
+		}
+		if err := m.Db.Model(&Identity{}).Where("id = ?", identity.ID).UpdateColumns(updates).Error; err != nil {
+			return nil, err
+		}
+
+		// Mark the user's email as verified if the provider confirmed it
+		if verifiedEmail && !user.EmailVerified && user.Email != nil && strings.EqualFold(*user.Email, *account.Email) {
+			user.EmailVerified = true
+			if err := m.SaveUser(user); err != nil {
+				return nil, err
+			}
+		}
+		return user, nil
+	}
+
+	// If the account is new for us, but we are already logged in
+	// then we want to link it to the existing profile
+	if currentUser != nil {
+		if _, err := m.LinkIdentity(currentUser, account); err != nil {
+			return nil, err
+		}
+		return currentUser, nil
+	}
+
+	// If we are not logged in, and the account is new, then we want to
+	// check if the user is already registered with the same verified email
+	if verifiedEmail {
+		var existingEmailUser User
+		err := m.Db.First(&existingEmailUser, "lower(email) = lower(?) and email_verified = ?", *account.Email, true).Error
+		if err == nil {
+			if _, err := m.LinkIdentity(&existingEmailUser, account); err != nil {
+				return nil, err
+			}
+			return &existingEmailUser, nil
+		}
+	}
+
+	// We are not logged in, and both the account and the mail are not
+	// in our system, we create a new User
+	newUser := &User{
+		Username: m.availableUsername(account.Name),
+		Role:     RoleUser,
+	}
+	if account.Email != nil && *account.Email != "" && !m.EmailTaken(*account.Email) {
+		newUser.Email = account.Email
+		newUser.EmailVerified = account.EmailVerified
+	}
+
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		txm := New(tx)
+		if err := txm.SaveUser(newUser); err != nil {
+			return err
+		}
+		_, err := txm.LinkIdentity(newUser, account)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newUser, nil
+}
+
+// migrateFacebookIDs moves the ids in the old facebook_id column of users to identities
+func migrateFacebookIDs(db *gorm.DB) error {
+	if !db.Dialect().HasColumn("users", "facebook_id") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Exec(`INSERT INTO identities (created_at, updated_at, user_id, provider, subject, name, email)
+			SELECT ?, ?, id, ?, facebook_id, username, '' FROM users
+			WHERE facebook_id IS NOT NULL AND facebook_id <> ''
+			AND NOT EXISTS (SELECT 1 FROM identities i WHERE i.provider = ? AND i.subject = users.facebook_id)`,
+			now, now, ProviderFacebook, ProviderFacebook).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec("UPDATE users SET facebook_id = NULL WHERE facebook_id IS NOT NULL").Error
+	})
+}
@@ -0,0 +1,137 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func strptr(s string) *string {
+	return &s
+}
+
+func TestLoginOrCreate(t *testing.T) {
+	m := Model{ConnectTestDB()}
+	admin := m.registerTestAdmin()
+
+	// A new account creates a new user, with the email verified by the provider
+	gh := &ExternalAccount{Provider: "github", Subject: "42", Name: "mario", Email: strptr("mario@example.com"), EmailVerified: true}
+	u, err := m.LoginOrCreate(nil, gh)
+	assert.NoError(t, err)
+	assert.Equal(t, "mario", u.Username)
+	assert.Equal(t, "mario@example.com", *u.Email)
+	assert.True(t, u.EmailVerified)
+	assert.True(t, m.IsVerified(u))
+
+	// Logging in again returns the same user
+	again, err := m.LoginOrCreate(nil, gh)
+	assert.NoError(t, err)
+	assert.Equal(t, u.ID, again.ID)
+
+	// The same account on another provider is a different user, and the username is made unique
+	other, err := m.LoginOrCreate(nil, &ExternalAccount{Provider: "gitlab", Subject: "42", Name: "mario"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, u.ID, other.ID)
+	assert.Equal(t, "mario-2", other.Username)
+	assert.Nil(t, other.Email)
+	// Users logging in with a provider can edit even without an email
+	assert.True(t, m.IsVerified(other))
+
+	// An account whose verified email belongs to a user is linked to them
+	google, err := m.LoginOrCreate(nil, &ExternalAccount{Provider: "google", Subject: "g1", Name: "Luca",
+		Email: strptr("VIGLIAG@gmail.com"), EmailVerified: true})
+	assert.NoError(t, err)
+	assert.Equal(t, admin.ID, google.ID)
+
+	// Unverified emails are not trusted, and not given to the new user
+	oidc, err := m.LoginOrCreate(nil, &ExternalAccount{Provider: "oidc", Subject: "o1", Name: "Luca",
+		Email: strptr("vigliag@gmail.com"), EmailVerified: false})
+	assert.NoError(t, err)
+	assert.NotEqual(t, admin.ID, oidc.ID)
+	assert.Nil(t, oidc.Email)
+
+	// A logged in user links new accounts to themselves
+	linked, err := m.LoginOrCreate(u, &ExternalAccount{Provider: ProviderFacebook, Subject: "fb1", Name: "Mario"})
+	assert.NoError(t, err)
+	assert.Equal(t, u.ID, linked.ID)
+
+	identities, err := m.UserIdentities(u)
+	assert.NoError(t, err)
+	assert.Len(t, identities, 2)
+	assert.Equal(t, ProviderFacebook, identities[0].Provider)
+	assert.Equal(t, "github", identities[1].Provider)
+	assert.Equal(t, "mario@example.com", identities[1].Email)
+
+	// An account can't be linked to two users
+	_, err = m.LinkIdentity(admin, gh)
+	assert.Error(t, err)
+}
+
+func TestMigrateFacebookIDs(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+
+	// Users used to store the id of their Facebook account
+	assert.NoError(t, db.Exec(`CREATE TABLE users (id integer primary key autoincrement,
+		created_at datetime, updated_at datetime, deleted_at datetime,
+		username varchar(255) UNIQUE, hashed_password varchar(255), salt varchar(255),
+		email varchar(255) UNIQUE, email_verified bool, role varchar(255), session_token varchar(255),
+		facebook_id varchar(255))`).Error)
+	assert.NoError(t, db.Exec("INSERT INTO users (username, facebook_id) VALUES ('fbuser', '1234'), ('emailuser', NULL)").Error)
+
+	migrate(db)
+	m := Model{db}
+
+	identity := m.FindIdentity(ProviderFacebook, "1234")
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, uint(1), identity.UserID)
+	}
+
+	var count int
+	db.Model(&Identity{}).Count(&count)
+	assert.Equal(t, 1, count)
+
+	// Migrating again does nothing
+	migrate(db)
+	db.Model(&Identity{}).Count(&count)
+	assert.Equal(t, 1, count)
+
+	u, err := m.LoginOrCreate(nil, &ExternalAccount{Provider: ProviderFacebook, Subject: "1234", Name: "fbuser"})
+	assert.NoError(t, err)
+	assert.Equal(t, "fbuser", u.Username)
+}
+
+func TestUnlinkLoginMethods(t *testing.T) {
+	m := Model{ConnectTestDB()}
+	u := m.registerTestAdmin()
+
+	// The password can't be removed while it is the only login method
+	assert.Equal(t, ErrLastLoginMethod, m.RemovePassword(u))
+	assert.True(t, m.RetrieveUser(u.ID).HasPasswordLogin())
+
+	gh, err := m.LinkIdentity(u, &ExternalAccount{Provider: "github", Subject: "1"})
+	assert.NoError(t, err)
+	fb, err := m.LinkIdentity(u, &ExternalAccount{Provider: ProviderFacebook, Subject: "2"})
+	assert.NoError(t, err)
+
+	// Identities can only be unlinked by their user
+	other, err := m.RegisterEmail("other", "other@example.com", "password", "")
+	assert.NoError(t, err)
+	assert.Error(t, m.UnlinkIdentity(other, gh.ID))
+
+	assert.NoError(t, m.UnlinkIdentity(u, gh.ID))
+	assert.Nil(t, m.FindIdentity("github", "1"))
+
+	assert.NoError(t, m.RemovePassword(u))
+	assert.False(t, m.RetrieveUser(u.ID).HasPasswordLogin())
+	assert.Nil(t, m.LoginEmail("vigliag@gmail.com", "password"))
+
+	// The last identity is kept
+	assert.Equal(t, ErrLastLoginMethod, m.UnlinkIdentity(u, fb.ID))
+	assert.NotNil(t, m.FindIdentity(ProviderFacebook, "2"))
+
+	// Unlinked accounts can be linked again
+	_, err = m.LinkIdentity(u, &ExternalAccount{Provider: "github", Subject: "1"})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,417 @@
+package model
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// RequestStatus tells if an OwnershipClaim or an OwnershipTransfer is waiting
+// for an answer, or how it was answered
+type RequestStatus int64
+
+// Scan reads a RequestStatus from the database
+func (s *RequestStatus) Scan(value interface{}) error { *s = RequestStatus(value.(int64)); return nil }
+
+// Value serializes a RequestStatus from the database
+func (s RequestStatus) Value() (driver.Value, error) { return int64(s), nil }
+
+// State of an OwnershipClaim or an OwnershipTransfer
+const (
+	RequestPending   RequestStatus = 0
+	RequestAccepted  RequestStatus = 1
+	RequestRejected  RequestStatus = 2
+	RequestCancelled RequestStatus = 3
+)
+
+func (s RequestStatus) String() string {
+	switch s {
+	case RequestAccepted:
+		return "accepted"
+	case RequestRejected:
+		return "rejected"
+	case RequestCancelled:
+		return "cancelled"
+	}
+	return "pending"
+}
+
+// Reasons of an OwnershipChange
+const (
+	OwnershipClaimed     = "claim"
+	OwnershipTransferred = "transfer"
+	// The owner was set by an admin
+	OwnershipAssigned = "admin"
+)
+
+var (
+	// ErrPageOwned is returned when claiming a page which has an owner already
+	ErrPageOwned = errors.New("the page has an owner already")
+	// ErrJustificationRequired is returned when claiming a page without saying why
+	ErrJustificationRequired = errors.New("a justification is required to claim a page")
+	// ErrClaimPending is returned when claiming a page a second time, while the first claim is pending
+	ErrClaimPending = errors.New("a claim for this page is pending already")
+	// ErrRequestNotPending is returned when answering a claim or transfer that was answered or cancelled already
+	ErrRequestNotPending = errors.New("the request is not pending")
+	// ErrNotOwner is returned when someone other than the owner of a page tries to transfer it
+	ErrNotOwner = errors.New("only the owner can transfer a page")
+	// ErrNotRecipient is returned when someone other than the recipient of a transfer answers it
+	ErrNotRecipient = errors.New("only the recipient can answer a transfer")
+	// ErrSelfTransfer is returned when transferring a page to its owner
+	ErrSelfTransfer = errors.New("the page is owned by the recipient already")
+	// ErrHasUserPage is returned when giving a profile page to a user who has one already
+	ErrHasUserPage = errors.New("the user has a profile page already")
+)
+
+// OwnershipClaim is the request of a user to become the owner of a page with no owner,
+// e.g. a company they work for. Claims are reviewed by admins.
+type OwnershipClaim struct {
+	gorm.Model
+	PageID        uint `gorm:"index"`
+	Page          Page
+	UserID        uint `gorm:"index"`
+	User          User
+	Justification string
+	Status        RequestStatus `gorm:"type:int;not null;default:0"`
+
+	ReviewerID uint
+	Reviewer   User
+	ReviewedAt *time.Time
+	ReviewNote string
+}
+
+// OwnershipTransfer is the offer of the owner of a page to give it to another user,
+// who becomes the owner once they accept it
+type OwnershipTransfer struct {
+	gorm.Model
+	PageID  uint `gorm:"index"`
+	Page    Page
+	FromID  uint
+	From    User
+	ToID    uint `gorm:"index"`
+	To      User
+	Message string
+	Status  RequestStatus `gorm:"type:int;not null;default:0"`
+
+	AnsweredAt *time.Time
+}
+
+// OwnershipChange records a change of the owner of a page. Changes are never
+// modified, and make the ownership history of the page until it is purged.
+type OwnershipChange struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	PageID    uint `gorm:"index"`
+	// 0 if the page had no owner
+	PreviousOwnerID uint
+	PreviousOwner   User
+	// 0 if the page was left with no owner
+	NewOwnerID uint
+	NewOwner   User
+	// Who made the change: the reviewer of a claim, the recipient of a transfer, or an admin
+	ByID uint
+	By   User
+	// One of OwnershipClaimed, OwnershipTransferred and OwnershipAssigned
+	Reason string
+	Note   string
+}
+
+// setOwner makes newOwnerID the owner of p, recording the change in its history.
+// The new owner stops being a co-maintainer of the page, as owners can do more.
+func setOwner(tx *gorm.DB, p *Page, newOwnerID, byID uint, reason, note string) error {
+	if p.Type == PageUser && newOwnerID != 0 {
+		var count int
+		if err := tx.Model(&Page{}).Where("owner_id = ? and type = ? and id <> ?", newOwnerID, PageUser, p.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrHasUserPage
+		}
+	}
+
+	change := OwnershipChange{
+		PageID:          p.ID,
+		PreviousOwnerID: p.OwnerID,
+		NewOwnerID:      newOwnerID,
+		ByID:            byID,
+		Reason:          reason,
+		Note:            note,
+	}
+	if err := tx.Create(&change).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&Page{}).Where("id = ?", p.ID).UpdateColumn("owner_id", newOwnerID).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("page_id = ? and user_id = ?", p.ID, newOwnerID).Delete(&PageMaintainer{}).Error; err != nil {
+		return err
+	}
+	p.OwnerID = newOwnerID
+	return audit(tx, AuditOwnerChanged, nil, AuditEntry{ActorID: byID, UserID: newOwnerID, PageID: p.ID,
+		Details: ownerChangeDetails(change)})
+}
+
+// ownerChangeDetails describes an ownership change in the audit log
+func ownerChangeDetails(change OwnershipChange) string {
+	details := fmt.Sprintf("%s, previous owner %d", change.Reason, change.PreviousOwnerID)
+	if change.Note != "" {
+		details += ": " + change.Note
+	}
+	return details
+}
+
+// ClaimPage asks for u to become the owner of p, which must have no owner
+func (m *Model) ClaimPage(p *Page, u *User, justification string) (*OwnershipClaim, error) {
+	justification = strings.TrimSpace(justification)
+	if p.OwnerID != 0 {
+		return nil, ErrPageOwned
+	}
+	if justification == "" {
+		return nil, ErrJustificationRequired
+	}
+
+	claim := OwnershipClaim{PageID: p.ID, UserID: u.ID, Justification: justification}
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		var count int
+		err := tx.Model(&OwnershipClaim{}).Where("page_id = ? and user_id = ? and status = ?", p.ID, u.ID, RequestPending).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrClaimPending
+		}
+		return tx.Create(&claim).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+// FindClaim returns an OwnershipClaim, together with its page and claimant, or nil
+func (m *Model) FindClaim(id uint) *OwnershipClaim {
+	var claim OwnershipClaim
+	if err := m.Db.Preload("Page").Preload("User").First(&claim, "id = ?", id).Error; err != nil {
+		return nil
+	}
+	return &claim
+}
+
+// PendingClaims returns the claims waiting for review, oldest first
+func (m *Model) PendingClaims() ([]OwnershipClaim, error) {
+	var claims []OwnershipClaim
+	res := m.Db.Preload("Page").Preload("User").
+		Joins("JOIN pages ON pages.id = ownership_claims.page_id").
+		Where("ownership_claims.status = ? and pages.deleted_at IS NULL", RequestPending).
+		Order("ownership_claims.id").
+		Find(&claims)
+	return claims, res.Error
+}
+
+// PendingClaim returns the pending claim of u for p, or nil
+func (m *Model) PendingClaim(p *Page, u *User) *OwnershipClaim {
+	var claim OwnershipClaim
+	if err := m.Db.First(&claim, "page_id = ? and user_id = ? and status = ?", p.ID, u.ID, RequestPending).Error; err != nil {
+		return nil
+	}
+	return &claim
+}
+
+func reviewClaim(tx *gorm.DB, claim *OwnershipClaim, status RequestStatus, reviewer *User, note string) error {
+	now := time.Now()
+	res := tx.Model(&OwnershipClaim{}).Where("id = ? and status = ?", claim.ID, RequestPending).UpdateColumns(map[string]interface{}{
+		"status":      status,
+		"reviewer_id": reviewer.ID,
+		"reviewed_at": now,
+		"review_note": note,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRequestNotPending
+	}
+	claim.Status = status
+	claim.ReviewerID = reviewer.ID
+	claim.ReviewedAt = &now
+	claim.ReviewNote = note
+	return nil
+}
+
+// ApproveClaim makes the claimant the owner of the page. The other pending claims
+// for the page are rejected.
+func (m *Model) ApproveClaim(claim *OwnershipClaim, reviewer *User, note string) error {
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		var page Page
+		if err := tx.First(&page, "id = ?", claim.PageID).Error; err != nil {
+			return err
+		}
+		if page.OwnerID != 0 {
+			return ErrPageOwned
+		}
+
+		if err := reviewClaim(tx, claim, RequestAccepted, reviewer, note); err != nil {
+			return err
+		}
+		if err := setOwner(tx, &page, claim.UserID, reviewer.ID, OwnershipClaimed, note); err != nil {
+			return err
+		}
+
+		var others []OwnershipClaim
+		if err := tx.Find(&others, "page_id = ? and status = ?", page.ID, RequestPending).Error; err != nil {
+			return err
+		}
+		for i := range others {
+			if err := reviewClaim(tx, &others[i], RequestRejected, reviewer, "La pagina è stata assegnata a un altro utente"); err != nil {
+				return err
+			}
+		}
+		claim.Page = page
+		return nil
+	})
+}
+
+// RejectClaim refuses a claim, leaving the page with no owner
+func (m *Model) RejectClaim(claim *OwnershipClaim, reviewer *User, note string) error {
+	return reviewClaim(m.Db, claim, RequestRejected, reviewer, note)
+}
+
+// OfferTransfer offers p to the user to. The page is transferred once they accept
+// with AcceptTransfer. A previous pending offer for the page is cancelled.
+func (m *Model) OfferTransfer(p *Page, from, to *User, message string) (*OwnershipTransfer, error) {
+	if p.OwnerID == 0 || p.OwnerID != from.ID {
+		return nil, ErrNotOwner
+	}
+	if to.ID == from.ID {
+		return nil, ErrSelfTransfer
+	}
+
+	transfer := OwnershipTransfer{PageID: p.ID, FromID: from.ID, ToID: to.ID, Message: strings.TrimSpace(message)}
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&OwnershipTransfer{}).Where("page_id = ? and status = ?", p.ID, RequestPending).
+			UpdateColumns(map[string]interface{}{"status": RequestCancelled, "answered_at": time.Now()}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&transfer).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// FindTransfer returns an OwnershipTransfer, together with its page and users, or nil
+func (m *Model) FindTransfer(id uint) *OwnershipTransfer {
+	var transfer OwnershipTransfer
+	if err := m.Db.Preload("Page").Preload("From").Preload("To").First(&transfer, "id = ?", id).Error; err != nil {
+		return nil
+	}
+	return &transfer
+}
+
+// PendingTransferOf returns the pending transfer of p, or nil
+func (m *Model) PendingTransferOf(p *Page) *OwnershipTransfer {
+	var transfer OwnershipTransfer
+	if err := m.Db.Preload("To").First(&transfer, "page_id = ? and status = ?", p.ID, RequestPending).Error; err != nil {
+		return nil
+	}
+	return &transfer
+}
+
+// PendingTransfersTo returns the transfers waiting for u to answer
+func (m *Model) PendingTransfersTo(u *User) ([]OwnershipTransfer, error) {
+	var transfers []OwnershipTransfer
+	res := m.Db.Preload("Page").Preload("From").
+		Joins("JOIN pages ON pages.id = ownership_transfers.page_id").
+		Where("ownership_transfers.to_id = ? and ownership_transfers.status = ? and pages.deleted_at IS NULL", u.ID, RequestPending).
+		Order("ownership_transfers.id").
+		Find(&transfers)
+	return transfers, res.Error
+}
+
+func answerTransfer(tx *gorm.DB, transfer *OwnershipTransfer, status RequestStatus) error {
+	now := time.Now()
+	res := tx.Model(&OwnershipTransfer{}).Where("id = ? and status = ?", transfer.ID, RequestPending).
+		UpdateColumns(map[string]interface{}{"status": status, "answered_at": now})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRequestNotPending
+	}
+	transfer.Status = status
+	transfer.AnsweredAt = &now
+	return nil
+}
+
+// AcceptTransfer makes u, the recipient of the transfer, the owner of the page.
+// If the page changed owner since the offer, the transfer is cancelled instead.
+func (m *Model) AcceptTransfer(transfer *OwnershipTransfer, u *User) error {
+	if transfer.ToID != u.ID {
+		return ErrNotRecipient
+	}
+	stale := false
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		var page Page
+		if err := tx.First(&page, "id = ?", transfer.PageID).Error; err != nil {
+			return err
+		}
+		if page.OwnerID != transfer.FromID {
+			stale = true
+			return answerTransfer(tx, transfer, RequestCancelled)
+		}
+
+		if err := answerTransfer(tx, transfer, RequestAccepted); err != nil {
+			return err
+		}
+		return setOwner(tx, &page, u.ID, u.ID, OwnershipTransferred, transfer.Message)
+	})
+	if err == nil && stale {
+		return ErrRequestNotPending
+	}
+	return err
+}
+
+// DeclineTransfer refuses a transfer on behalf of its recipient u
+func (m *Model) DeclineTransfer(transfer *OwnershipTransfer, u *User) error {
+	if transfer.ToID != u.ID {
+		return ErrNotRecipient
+	}
+	return answerTransfer(m.Db, transfer, RequestRejected)
+}
+
+// CancelTransfer withdraws a transfer on behalf of the owner u who offered it
+func (m *Model) CancelTransfer(transfer *OwnershipTransfer, u *User) error {
+	if transfer.FromID != u.ID {
+		return ErrNotOwner
+	}
+	return answerTransfer(m.Db, transfer, RequestCancelled)
+}
+
+// SetPageOwner makes owner the owner of p, on behalf of the admin by.
+// A nil owner leaves the page with no owner.
+func (m *Model) SetPageOwner(p *Page, owner *User, by *User, note string) error {
+	var ownerID uint
+	if owner != nil {
+		ownerID = owner.ID
+	}
+	if ownerID == p.OwnerID {
+		return nil
+	}
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		return setOwner(tx, p, ownerID, by.ID, OwnershipAssigned, note)
+	})
+}
+
+// OwnershipHistory returns the changes of the owner of p, oldest first
+func (m *Model) OwnershipHistory(p *Page) ([]OwnershipChange, error) {
+	var changes []OwnershipChange
+	res := m.Db.Preload("PreviousOwner").Preload("NewOwner").Preload("By").
+		Where("page_id = ?", p.ID).Order("id").Find(&changes)
+	return changes, res.Error
+}
@@ -0,0 +1,131 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwnershipClaims(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	employee, err := m.RegisterEmail("employee", "employee@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+	other, err := m.RegisterEmail("other", "other@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+
+	_, err = m.ClaimPage(p, employee, " ")
+	assert.Equal(t, ErrJustificationRequired, err)
+	claim, err := m.ClaimPage(p, employee, "Ci lavoro")
+	assert.NoError(t, err)
+	_, err = m.ClaimPage(p, employee, "Ci lavoro davvero")
+	assert.Equal(t, ErrClaimPending, err)
+	otherClaim, err := m.ClaimPage(p, other, "Anche io")
+	assert.NoError(t, err)
+
+	pending, err := m.PendingClaims()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+
+	// Approving a claim rejects the others for the same page
+	assert.NoError(t, m.ApproveClaim(claim, admin, "ok"))
+	assert.Equal(t, employee.ID, m.FindPage(p.ID, PageCompany).OwnerID)
+	assert.Equal(t, RequestRejected, m.FindClaim(otherClaim.ID).Status)
+	assert.Equal(t, ErrRequestNotPending, m.RejectClaim(claim, admin, ""))
+
+	pending, err = m.PendingClaims()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	p = m.FindPage(p.ID, PageCompany)
+	_, err = m.ClaimPage(p, other, "Ci lavoro")
+	assert.Equal(t, ErrPageOwned, err)
+
+	history, err := m.OwnershipHistory(p)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, OwnershipClaimed, history[0].Reason)
+	assert.Zero(t, history[0].PreviousOwnerID)
+	assert.Equal(t, "employee", history[0].NewOwner.Username)
+	assert.Equal(t, "vigliag", history[0].By.Username)
+}
+
+func TestOwnershipTransfers(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	owner, err := m.RegisterEmail("owner", "owner@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+	colleague, err := m.RegisterEmail("colleague", "colleague@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company", OwnerID: owner.ID}
+	assert.NoError(t, m.SavePage(p, owner))
+	assert.NoError(t, m.AddMaintainer(p, colleague, owner))
+
+	_, err = m.OfferTransfer(p, colleague, owner, "")
+	assert.Equal(t, ErrNotOwner, err)
+	_, err = m.OfferTransfer(p, owner, owner, "")
+	assert.Equal(t, ErrSelfTransfer, err)
+
+	// A new offer replaces the pending one
+	first, err := m.OfferTransfer(p, owner, colleague, "")
+	assert.NoError(t, err)
+	transfer, err := m.OfferTransfer(p, owner, colleague, "Cambio lavoro")
+	assert.NoError(t, err)
+	assert.Equal(t, RequestCancelled, m.FindTransfer(first.ID).Status)
+
+	pending, err := m.PendingTransfersTo(colleague)
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	// Only the recipient can accept, and becomes the owner
+	assert.Equal(t, ErrNotRecipient, m.AcceptTransfer(transfer, owner))
+	assert.NoError(t, m.AcceptTransfer(transfer, colleague))
+	p = m.FindPage(p.ID, PageCompany)
+	assert.Equal(t, colleague.ID, p.OwnerID)
+	assert.False(t, m.IsMaintainer(p, colleague))
+	assert.False(t, m.CanEdit(p, owner))
+
+	history, err := m.OwnershipHistory(p)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, OwnershipTransferred, history[0].Reason)
+	assert.Equal(t, owner.ID, history[0].PreviousOwnerID)
+	assert.Equal(t, "Cambio lavoro", history[0].Note)
+
+	// A transfer offered by a previous owner can't be accepted anymore
+	stale, err := m.OfferTransfer(p, colleague, owner, "")
+	assert.NoError(t, err)
+	assert.NoError(t, m.SetPageOwner(p, nil, colleague, "reset"))
+	assert.Equal(t, ErrRequestNotPending, m.AcceptTransfer(stale, owner))
+	assert.Equal(t, RequestCancelled, m.FindTransfer(stale.ID).Status)
+	assert.Zero(t, m.FindPage(p.ID, PageCompany).OwnerID)
+}
+
+func TestTransferProfilePage(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	owner, err := m.RegisterEmail("owner", "owner@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+	other, err := m.RegisterEmail("other", "other@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+
+	p := &Page{Content: "Ciao", Type: PageUser, Title: "Owner", OwnerID: owner.ID}
+	assert.NoError(t, m.SavePage(p, owner))
+	assert.NoError(t, m.SavePage(&Page{Content: "Ciao", Type: PageUser, Title: "Other", OwnerID: other.ID}, other))
+
+	// Users can have a single profile page
+	transfer, err := m.OfferTransfer(p, owner, other, "")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrHasUserPage, m.AcceptTransfer(transfer, other))
+	assert.Equal(t, RequestPending, m.FindTransfer(transfer.ID).Status)
+	assert.NoError(t, m.DeclineTransfer(transfer, other))
+	assert.Equal(t, owner.ID, m.FindPage(p.ID, PageUser).OwnerID)
+}
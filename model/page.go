@@ -2,8 +2,8 @@ package model
 
 import (
 	"database/sql/driver"
-
-	"github.com/gosimple/slug"
+	"fmt"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
@@ -38,7 +38,7 @@ type Page struct {
 
 	Type PageType `gorm:"type:int"`
 
-	// If not null, the owner is the only one who can edit the page
+	// If not null, only the owner and the maintainers of the page can edit it (see CanEdit)
 	OwnerID uint
 	Owner   User
 
@@ -59,10 +59,22 @@ type Page struct {
 
 	ContentVersion []ContentVersion
 
+	// The version an edit started from, used to detect concurrent edits in SavePage.
+	// Zero skips the check.
+	BaseVersionID uint `gorm:"-"`
+
+	// The version created by the last call to SavePage
+	SavedVersionID uint `gorm:"-"`
+
 	// If there is no approved version, then the page should not be publicly listed
 	// It doesn't need to be a foreign key, it is only useful to find if there are
 	// unapproved versions of the page
 	ApprovedVersionID uint
+
+	// Set when the page is moved to the trash (see DeletePage)
+	DeletionReason string `gorm:"not null;default:''"`
+	DeletedByID    uint   `gorm:"not null;default:0"`
+	DeletedBy      User
 }
 
 func (p *Page) assignDataItem(name, content string) {
@@ -74,6 +86,11 @@ func (p *Page) SetFieldsToParsedContent() {
 
 	p.Short = parsed["short"]
 	p.City = parsed["city"]
+	if p.City == "" {
+		// "Città" in the data section is normalized to "area"
+		p.City = parsed["area"]
+	}
+	p.Sector = parsed["sector"]
 	p.Website = parsed["website"]
 }
 
@@ -87,17 +104,50 @@ type ContentVersion struct {
 	User   User
 
 	Content string
+
+	// Review state of the version, and who reviewed it
+	Status     VersionStatus `gorm:"type:int;not null;default:0"`
+	ReviewerID uint          `gorm:"not null;default:0"`
+	Reviewer   User
+	ReviewNote string `gorm:"not null;default:''"`
+	ReviewedAt *time.Time
+
+	// If not zero, this version restored the content of an earlier version
+	RevertOfID uint `gorm:"not null;default:0"`
 }
 
+// FindPageVersions returns every version of a page, newest first
+func (m *Model) FindPageVersions(page *Page) ([]ContentVersion, error) {
+	var versions []ContentVersion
+	res := m.Db.
+		Preload("User").
+		Preload("Reviewer").
+		Order("id desc").
+		Find(&versions, "page_id = ?", page.ID)
+	return versions, res.Error
+}
+
+// FindNewerPageVersions returns the versions of a page that are newer than the
+// approved one, and that have not been rejected
 func (m *Model) FindNewerPageVersions(page *Page) ([]ContentVersion, error) {
 	var versions []ContentVersion
 	res := m.Db.
 		Preload("User").
 		Order("id desc").
-		Find(&versions, "page_id = ? and id > ?", page.ID, page.ApprovedVersionID)
+		Find(&versions, "page_id = ? and id > ? and status <> ?", page.ID, page.ApprovedVersionID, VersionRejected)
 	return versions, res.Error
 }
 
+// FindPageVersion returns a version of the given page, with its author and reviewer, or nil
+func (m *Model) FindPageVersion(page *Page, id uint) *ContentVersion {
+	var cv ContentVersion
+	res := m.Db.Preload("User").Preload("Reviewer").First(&cv, "id = ? and page_id = ?", id, page.ID)
+	if res.Error != nil {
+		return nil
+	}
+	return &cv
+}
+
 //FindPage returns a page of a given type by ID or null
 func (m *Model) FindPage(id uint, ptype PageType) *Page {
 	var page Page
@@ -108,52 +158,104 @@ func (m *Model) FindPage(id uint, ptype PageType) *Page {
 	return &page
 }
 
-func (m *Model) CanApproveEdits(p *Page, u *User) bool {
-	return u != nil && (u.Role == "admin" || u.ID == p.OwnerID)
+// ConflictError is returned by SavePage when the page received a new version
+// after the one the edit was based on
+type ConflictError struct {
+	// The version the edit started from, nil if it could not be found
+	Base *ContentVersion
+	// The newest version of the page
+	Theirs *ContentVersion
+	// The content that was being saved
+	Mine string
 }
 
-func (m *Model) CanEdit(p *Page, u *User) bool {
-	return u != nil && (u.Role == "admin" || p.OwnerID == 0 || u.ID == p.OwnerID)
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("page %d has a version (%d) newer than the edited one", e.Theirs.PageID, e.Theirs.ID)
 }
 
-func (m *Model) SavePage(p *Page, u *User) error {
-	//TODO this could be in a transaction, although it doesn't really matter,
-	//we do not enforce consistency, as the ContentVersion could be deleted eventually
-	if p.Slug == "" {
-		p.Slug = slug.Make(p.Title)
+// checkConflict returns a ConflictError if there is a version of the page newer
+// than p.BaseVersionID, that has not been rejected
+func checkConflict(tx *gorm.DB, p *Page) error {
+	var latest ContentVersion
+	res := tx.Preload("User").Order("id desc").
+		First(&latest, "page_id = ? and id > ? and status <> ?", p.ID, p.BaseVersionID, VersionRejected)
+	if res.RecordNotFound() {
+		return nil
+	} else if res.Error != nil {
+		return res.Error
 	}
 
-	// If the page is new, we save it to the database first
-	// It will have no ApprovedVersionID at this stage, and will be unlisted
-	if p.ID == 0 {
-		if err := m.Db.Save(p).Error; err != nil {
-			return err
-		}
+	conflict := &ConflictError{Theirs: &latest, Mine: p.Content}
+	var base ContentVersion
+	res = tx.Preload("User").Preload("Reviewer").First(&base, "id = ? and page_id = ?", p.BaseVersionID, p.ID)
+	if res.Error == nil {
+		conflict.Base = &base
+	} else if !res.RecordNotFound() {
+		return res.Error
 	}
+	return conflict
+}
 
-	// Create and save a new ContentVersion for the page
-	cv := ContentVersion{
-		Content: p.Content,
-		PageID:  p.ID,
-		UserID:  u.ID,
-	}
-	if err := m.Db.Save(&cv).Error; err != nil {
-		return err
-	}
+// SavePage saves a new version of the page, which is approved right away if
+// AutoApproves(p, u). If p.BaseVersionID is set and the page was changed
+// meanwhile, a *ConflictError is returned and nothing is saved.
+func (m *Model) SavePage(p *Page, u *User) error {
+	canApprove := m.AutoApproves(p, u)
+
+	// The check for newer versions and the save are in the same transaction,
+	// so that concurrent edits can't overwrite each other
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		if p.ID != 0 && p.BaseVersionID != 0 {
+			if err := checkConflict(tx, p); err != nil {
+				return err
+			}
+		}
 
-	// If an admin or owner is submitting this version, approve it
-	// Assign the contentVersion to the page and parse the page's contents
-	if m.CanApproveEdits(p, u) {
-		p.Content = cv.Content
-		p.ApprovedVersionID = cv.ID
-		p.SetFieldsToParsedContent()
-		err := m.Db.Save(p).Error
-		if err != nil {
-			return err
+		// The page itself is only saved when it is new or when the edit is approved,
+		// and only then its slug (and slug history) need to be updated
+		if p.ID == 0 || canApprove {
+			if err := updateSlug(tx, p); err != nil {
+				return err
+			}
+		}
+
+		// If the page is new, we save it to the database first
+		// It will have no ApprovedVersionID at this stage, and will be unlisted
+		if p.ID == 0 {
+			if err := tx.Save(p).Error; err != nil {
+				return err
+			}
 		}
-	}
 
-	return nil
+		// Create and save a new ContentVersion for the page
+		// It is approved right away if AutoApproves(p, u)
+		cv := ContentVersion{
+			Content: p.Content,
+			PageID:  p.ID,
+			UserID:  u.ID,
+		}
+		if canApprove {
+			now := time.Now()
+			cv.Status = VersionApproved
+			cv.ReviewerID = u.ID
+			cv.ReviewedAt = &now
+		}
+		if err := tx.Save(&cv).Error; err != nil {
+			return err
+		}
+		p.SavedVersionID = cv.ID
+
+		// Assign the contentVersion to the page and parse the page's contents
+		if canApprove {
+			p.Content = cv.Content
+			p.ApprovedVersionID = cv.ID
+			p.SetFieldsToParsedContent()
+			if err := tx.Save(p).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (p PageType) Int() int {
@@ -179,6 +281,15 @@ func (m *Model) AllPages() ([]*Page, error) {
 	return pages, m.Db.Find(&pages).Error
 }
 
+// FindPagesByIDs returns the pages with the given IDs, in no particular order
+func (m *Model) FindPagesByIDs(ids []uint) ([]*Page, error) {
+	var pages []*Page
+	if len(ids) == 0 {
+		return pages, nil
+	}
+	return pages, m.Db.Where("id IN (?)", ids).Find(&pages).Error
+}
+
 type SiteStats struct {
 	NCompanies     int
 	NCommunities   int
@@ -188,7 +299,7 @@ type SiteStats struct {
 
 func (m *Model) GetSiteStats() (SiteStats, error) {
 	var stats SiteStats
-	rows, err := m.Db.Table("pages").Select("type, count(*)").Group("type").Rows()
+	rows, err := m.Db.Table("pages").Select("type, count(*)").Where("deleted_at IS NULL").Group("type").Rows()
 	if err != nil {
 		return stats, err
 	}
@@ -3,6 +3,7 @@ package model
 import (
 	"testing"
 
+	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,3 +29,163 @@ func TestFindPage(t *testing.T) {
 
 	m.Db.Close()
 }
+
+func TestReviewVersions(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	user, err := m.RegisterEmail("user", "user@example.com", "password", "user")
+	assert.NoError(t, err)
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+	approvedID := p.ApprovedVersionID
+	assert.NotZero(t, approvedID)
+	assert.Equal(t, approvedID, p.SavedVersionID)
+
+	// Edits by a normal user are left pending
+	p.Content = "Ciao\n\n### Sito web\n\nhttps://example.com"
+	assert.NoError(t, m.SavePage(p, user))
+	p.Content = "Spam"
+	assert.NoError(t, m.SavePage(p, user))
+
+	pending, err := m.PendingVersions()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+	good, spam := pending[0], pending[1]
+	assert.Equal(t, spam.ID, p.SavedVersionID)
+
+	// Rejected versions are not pending anymore
+	assert.NoError(t, m.RejectVersion(&spam, admin, "spam"))
+	assert.Equal(t, VersionRejected, spam.Status)
+	assert.Equal(t, ErrVersionNotPending, m.RejectVersion(&spam, admin, ""))
+
+	pending, err = m.PendingVersions()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	// Approving a version updates the page
+	page, err := m.ApproveVersion(&good, admin, "ok")
+	assert.NoError(t, err)
+	assert.Equal(t, good.ID, page.ApprovedVersionID)
+	assert.Equal(t, "https://example.com", page.Website)
+
+	cv := m.FindVersion(good.ID)
+	assert.Equal(t, VersionApproved, cv.Status)
+	assert.Equal(t, admin.ID, cv.ReviewerID)
+	assert.Equal(t, "ok", cv.ReviewNote)
+
+	pending, err = m.PendingVersions()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestMigrateVersionStatus(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+
+	// Versions used to have no review status: the approved one was the latest
+	// saved by an editor
+	db.AutoMigrate(&Page{})
+	assert.NoError(t, db.Exec(`CREATE TABLE content_versions (id integer primary key autoincrement,
+		created_at datetime, updated_at datetime, deleted_at datetime,
+		page_id integer, user_id integer, content varchar(255))`).Error)
+	assert.NoError(t, db.Exec("INSERT INTO pages (title, approved_version_id) VALUES ('Example company', 2)").Error)
+	assert.NoError(t, db.Exec("INSERT INTO content_versions (page_id, content) VALUES (1, 'a'), (1, 'b'), (1, 'c')").Error)
+
+	migrate(db)
+	m := Model{db}
+	defer m.Close()
+
+	var versions []ContentVersion
+	assert.NoError(t, db.Order("id").Find(&versions).Error)
+	if assert.Len(t, versions, 3) {
+		assert.Equal(t, VersionApproved, versions[0].Status)
+		assert.Equal(t, VersionApproved, versions[1].Status)
+		assert.Equal(t, VersionPending, versions[2].Status)
+	}
+
+	// Migrating again leaves the review status alone
+	assert.NoError(t, db.Model(&versions[0]).UpdateColumn("status", VersionRejected).Error)
+	migrate(db)
+	assert.NoError(t, db.First(&versions[0], versions[0].ID).Error)
+	assert.Equal(t, VersionRejected, versions[0].Status)
+}
+
+func TestRevertPage(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+
+	p := &Page{Content: "Prima versione", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+	first := p.ApprovedVersionID
+	p.Content = "Seconda versione"
+	assert.NoError(t, m.SavePage(p, admin))
+
+	old := m.FindPageVersion(p, first)
+	assert.NotNil(t, old)
+
+	cv, err := m.RevertPage(p, old, admin)
+	assert.NoError(t, err)
+	assert.Equal(t, first, cv.RevertOfID)
+	assert.Equal(t, VersionApproved, cv.Status)
+	assert.Equal(t, cv.ID, p.ApprovedVersionID)
+	assert.Equal(t, "Prima versione", p.Content)
+
+	// The revert is added on top of the history
+	versions, err := m.FindPageVersions(p)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 3)
+	assert.Equal(t, cv.ID, versions[0].ID)
+
+	// Only earlier approved versions can be restored
+	_, err = m.RevertPage(p, cv, admin)
+	assert.Equal(t, ErrVersionNotRevertible, err)
+	user, err := m.RegisterEmail("mario", "mario@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+	assert.NoError(t, m.MarkEmailVerified(user, admin))
+	p.Content = "Proposta"
+	assert.NoError(t, m.SavePage(p, user))
+	versions, err = m.FindPageVersions(p)
+	assert.NoError(t, err)
+	_, err = m.RevertPage(p, &versions[0], admin)
+	assert.Equal(t, ErrVersionNotRevertible, err)
+}
+
+func TestSavePageConflict(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	user, err := m.RegisterEmail("user", "user@example.com", "password", "user")
+	assert.NoError(t, err)
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+	base := p.ApprovedVersionID
+
+	// Someone else proposes a new version
+	theirs := *p
+	theirs.Content = "Ciao da loro"
+	assert.NoError(t, m.SavePage(&theirs, user))
+
+	// Saving on top of the old version is refused
+	p.Content = "Ciao da me"
+	p.BaseVersionID = base
+	err = m.SavePage(p, admin)
+	conflict, ok := err.(*ConflictError)
+	assert.True(t, ok)
+	assert.Equal(t, base, conflict.Base.ID)
+	assert.Equal(t, "Ciao da loro", conflict.Theirs.Content)
+	assert.Equal(t, "Ciao da me", conflict.Mine)
+
+	versions, _ := m.FindPageVersions(p)
+	assert.Len(t, versions, 2)
+
+	// Saving on top of the newest version works
+	p.BaseVersionID = conflict.Theirs.ID
+	assert.NoError(t, m.SavePage(p, admin))
+}
@@ -0,0 +1,249 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Roles of the users, giving them permissions on all pages
+const (
+	// RoleAdmin can do anything, including managing other users
+	RoleAdmin = "admin"
+	// RoleModerator can edit any page and review the edits of others, but can't manage users
+	RoleModerator = "moderator"
+	// RoleEditor is a trusted editor, whose edits are approved right away
+	RoleEditor = "editor"
+	// RoleUser is a normal user, whose edits have to be approved
+	RoleUser = "user"
+)
+
+// Roles lists the valid roles, from the most to the least powerful
+var Roles = []string{RoleAdmin, RoleModerator, RoleEditor, RoleUser}
+
+var (
+	// ErrInvalidRole is returned when assigning a role not in Roles
+	ErrInvalidRole = errors.New("invalid role")
+	// ErrOwnerMaintainer is returned when adding the owner of a page to its maintainers
+	ErrOwnerMaintainer = errors.New("the owner of a page can't be one of its maintainers")
+)
+
+// PageMaintainer makes a user a co-maintainer of a page: like its owner,
+// they can edit the page and review the edits of others to it
+type PageMaintainer struct {
+	PageID    uint `gorm:"primary_key;auto_increment:false"`
+	UserID    uint `gorm:"primary_key;auto_increment:false;index"`
+	User      User
+	CreatedAt time.Time
+}
+
+// HasRole tells if u has the given role. Users with no role are normal users.
+func (u *User) HasRole(role string) bool {
+	if u.Role == "" {
+		return role == RoleUser
+	}
+	return u.Role == role
+}
+
+// ValidRole tells if role is one of Roles
+func ValidRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRole changes the role of u. by, who changes it, is nil from the command line.
+func (m *Model) SetRole(u *User, role string, by *User) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+	previous := u.Role
+	if previous == "" {
+		previous = RoleUser
+	}
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("role", role).Error; err != nil {
+			return err
+		}
+		return audit(tx, AuditRoleChanged, by, AuditEntry{UserID: u.ID, Details: fmt.Sprintf("%s to %s", previous, role)})
+	})
+	if err != nil {
+		return err
+	}
+	u.Role = role
+	return nil
+}
+
+// active tells if u is logged in and not blocked. Blocked users can't do anything.
+func active(u *User) bool {
+	return u != nil && !u.Blocked
+}
+
+// isStaff tells if u can review the edits to any page
+func isStaff(u *User) bool {
+	return u.HasRole(RoleAdmin) || u.HasRole(RoleModerator)
+}
+
+// IsMaintainer tells if u is one of the co-maintainers of p
+func (m *Model) IsMaintainer(p *Page, u *User) bool {
+	if u == nil || p.ID == 0 {
+		return false
+	}
+	var count int
+	m.Db.Model(&PageMaintainer{}).Where("page_id = ? and user_id = ?", p.ID, u.ID).Count(&count)
+	return count > 0
+}
+
+// maintains tells if u is the owner or a co-maintainer of p
+func (m *Model) maintains(p *Page, u *User) bool {
+	return (p.OwnerID != 0 && u.ID == p.OwnerID) || m.IsMaintainer(p, u)
+}
+
+// CanEdit tells if u can edit p. Pages with an owner can only be edited by staff,
+// their owner and their maintainers. Users need to be verified to edit any page.
+func (m *Model) CanEdit(p *Page, u *User) bool {
+	return active(u) && (isStaff(u) || p.OwnerID == 0 || m.maintains(p, u)) && m.IsVerified(u)
+}
+
+// CanApproveEdits tells if u can review the edits of others to p
+func (m *Model) CanApproveEdits(p *Page, u *User) bool {
+	return active(u) && (isStaff(u) || m.maintains(p, u))
+}
+
+// AutoApproves tells if the edits of u to p are approved right away,
+// because u can approve edits to p, or is a trusted editor
+func (m *Model) AutoApproves(p *Page, u *User) bool {
+	return m.CanApproveEdits(p, u) || (active(u) && u.HasRole(RoleEditor))
+}
+
+// CanReviewAllEdits tells if u can review the edits to any page
+func (m *Model) CanReviewAllEdits(u *User) bool {
+	return active(u) && isStaff(u)
+}
+
+// CanDeletePages tells if u can move pages to the trash, and restore them
+func (m *Model) CanDeletePages(u *User) bool {
+	return active(u) && isStaff(u)
+}
+
+// CanPurgePages tells if u can permanently delete the pages in the trash
+func (m *Model) CanPurgePages(u *User) bool {
+	return active(u) && u.HasRole(RoleAdmin)
+}
+
+// CanManageUsers tells if u can manage the accounts of other users, e.g. unlocking them or changing their role
+func (m *Model) CanManageUsers(u *User) bool {
+	return active(u) && u.HasRole(RoleAdmin)
+}
+
+// CanManageMaintainers tells if u can add and remove the co-maintainers of p
+func (m *Model) CanManageMaintainers(p *Page, u *User) bool {
+	return active(u) && (isStaff(u) || (p.OwnerID != 0 && u.ID == p.OwnerID))
+}
+
+// CanClaim tells if u can ask to become the owner of p
+func (m *Model) CanClaim(p *Page, u *User) bool {
+	return active(u) && p.ID != 0 && p.OwnerID == 0 && m.IsVerified(u)
+}
+
+// CanReviewClaims tells if u can approve or reject the claims of pages
+func (m *Model) CanReviewClaims(u *User) bool {
+	return active(u) && u.HasRole(RoleAdmin)
+}
+
+// CanTransfer tells if u can offer p to another user
+func (m *Model) CanTransfer(p *Page, u *User) bool {
+	return active(u) && p.OwnerID != 0 && u.ID == p.OwnerID
+}
+
+// PageMaintainers returns the co-maintainers of p, in the order they were added
+func (m *Model) PageMaintainers(p *Page) ([]PageMaintainer, error) {
+	var maintainers []PageMaintainer
+	res := m.Db.Preload("User").Where("page_id = ?", p.ID).Order("created_at, user_id").Find(&maintainers)
+	return maintainers, res.Error
+}
+
+// AddMaintainer makes u a co-maintainer of p on behalf of by, and records it in the
+// audit log. Adding a maintainer twice does nothing.
+func (m *Model) AddMaintainer(p *Page, u *User, by *User) error {
+	if p.OwnerID == u.ID {
+		return ErrOwnerMaintainer
+	}
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		var count int
+		if err := tx.Model(&PageMaintainer{}).Where("page_id = ? and user_id = ?", p.ID, u.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+		if err := tx.Create(&PageMaintainer{PageID: p.ID, UserID: u.ID}).Error; err != nil {
+			return err
+		}
+		return audit(tx, AuditMaintainerAdded, by, AuditEntry{UserID: u.ID, PageID: p.ID})
+	})
+}
+
+// RemoveMaintainer removes u from the co-maintainers of p on behalf of by, and records
+// it in the audit log
+func (m *Model) RemoveMaintainer(p *Page, u *User, by *User) error {
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("page_id = ? and user_id = ?", p.ID, u.ID).Delete(&PageMaintainer{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		return audit(tx, AuditMaintainerRemoved, by, AuditEntry{UserID: u.ID, PageID: p.ID})
+	})
+}
+
+// Permissions tells what a user can do. It is the same set of checks as the
+// Can* methods of Model, bound to a user, so that templates can use it.
+type Permissions struct {
+	m    *Model
+	user *User
+}
+
+// Permissions returns the permissions of u, who is nil for anonymous users
+func (m *Model) Permissions(u *User) *Permissions {
+	return &Permissions{m: m, user: u}
+}
+
+// Edit tells if the user can edit p
+func (perm *Permissions) Edit(p *Page) bool { return perm.m.CanEdit(p, perm.user) }
+
+// ApproveEdits tells if the user can review the edits of others to p
+func (perm *Permissions) ApproveEdits(p *Page) bool { return perm.m.CanApproveEdits(p, perm.user) }
+
+// AutoApproved tells if the edits of the user to p are approved right away
+func (perm *Permissions) AutoApproved(p *Page) bool { return perm.m.AutoApproves(p, perm.user) }
+
+// ReviewAllEdits tells if the user can review the edits to any page
+func (perm *Permissions) ReviewAllEdits() bool { return perm.m.CanReviewAllEdits(perm.user) }
+
+// DeletePages tells if the user can move pages to the trash
+func (perm *Permissions) DeletePages() bool { return perm.m.CanDeletePages(perm.user) }
+
+// PurgePages tells if the user can permanently delete the pages in the trash
+func (perm *Permissions) PurgePages() bool { return perm.m.CanPurgePages(perm.user) }
+
+// ManageUsers tells if the user can manage the accounts of others
+func (perm *Permissions) ManageUsers() bool { return perm.m.CanManageUsers(perm.user) }
+
+// ManageMaintainers tells if the user can add and remove the co-maintainers of p
+func (perm *Permissions) ManageMaintainers(p *Page) bool {
+	return perm.m.CanManageMaintainers(p, perm.user)
+}
+
+// Claim tells if the user can ask to become the owner of p
+func (perm *Permissions) Claim(p *Page) bool { return perm.m.CanClaim(p, perm.user) }
+
+// ReviewClaims tells if the user can approve or reject the claims of pages
+func (perm *Permissions) ReviewClaims() bool { return perm.m.CanReviewClaims(perm.user) }
+
+// Transfer tells if the user can offer p to another user
+func (perm *Permissions) Transfer(p *Page) bool { return perm.m.CanTransfer(p, perm.user) }
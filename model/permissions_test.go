@@ -0,0 +1,99 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoles(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	moderator, err := m.RegisterEmail("moderator", "moderator@example.com", "password", RoleModerator)
+	assert.NoError(t, err)
+	editor, err := m.RegisterEmail("editor", "editor@example.com", "password", RoleEditor)
+	assert.NoError(t, err)
+	user, err := m.RegisterEmail("user", "user@example.com", "password", "")
+	assert.NoError(t, err)
+	assert.True(t, user.HasRole(RoleUser))
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+
+	assert.True(t, m.CanApproveEdits(p, moderator))
+	assert.True(t, m.CanDeletePages(moderator))
+	assert.False(t, m.CanManageUsers(moderator))
+	assert.True(t, m.CanManageUsers(admin))
+
+	// The edits of trusted editors are approved right away, but they can't review those of others
+	assert.False(t, m.CanApproveEdits(p, editor))
+	p.Content = "Ciao dall'editor"
+	assert.NoError(t, m.SavePage(p, editor))
+	assert.Equal(t, "Ciao dall'editor", m.FindPage(p.ID, PageCompany).Content)
+
+	p.Content = "Ciao dall'utente"
+	assert.NoError(t, m.SavePage(p, user))
+	assert.Equal(t, "Ciao dall'editor", m.FindPage(p.ID, PageCompany).Content)
+
+	// Nobody can do anything when not logged in
+	perm := m.Permissions(nil)
+	assert.False(t, perm.Edit(p))
+	assert.False(t, perm.ReviewAllEdits())
+
+	assert.Equal(t, ErrInvalidRole, m.SetRole(user, "superuser", admin))
+	assert.NoError(t, m.SetRole(user, RoleEditor, admin))
+	assert.True(t, m.RetrieveUser(user.ID).HasRole(RoleEditor))
+}
+
+func TestPageMaintainers(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	owner, err := m.RegisterEmail("owner", "owner@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+	maintainer, err := m.RegisterEmail("maintainer", "maintainer@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+	other, err := m.RegisterEmail("other", "other@example.com", "password", RoleUser)
+	assert.NoError(t, err)
+
+	p := &Page{Content: "Ciao", Type: PageUser, Title: "Owner", OwnerID: owner.ID}
+	assert.NoError(t, m.SavePage(p, owner))
+
+	assert.False(t, m.CanEdit(p, maintainer))
+	assert.True(t, m.CanManageMaintainers(p, owner))
+	assert.False(t, m.CanManageMaintainers(p, maintainer))
+
+	assert.Equal(t, ErrOwnerMaintainer, m.AddMaintainer(p, owner, owner))
+	assert.NoError(t, m.AddMaintainer(p, maintainer, owner))
+	assert.NoError(t, m.AddMaintainer(p, maintainer, owner))
+	maintainers, err := m.PageMaintainers(p)
+	assert.NoError(t, err)
+	assert.Len(t, maintainers, 1)
+	assert.Equal(t, "maintainer", maintainers[0].User.Username)
+
+	// Maintainers can edit the page and approve edits to it, but not manage other maintainers
+	assert.True(t, m.CanEdit(p, maintainer))
+	assert.True(t, m.CanApproveEdits(p, maintainer))
+	assert.False(t, m.CanManageMaintainers(p, maintainer))
+	assert.False(t, m.CanEdit(p, other))
+
+	p.Content = "Ciao dal co-curatore"
+	assert.NoError(t, m.SavePage(p, maintainer))
+	assert.Equal(t, "Ciao dal co-curatore", m.FindPage(p.ID, PageUser).Content)
+
+	assert.NoError(t, m.RemoveMaintainer(p, maintainer, owner))
+	assert.NoError(t, m.RemoveMaintainer(p, maintainer, owner))
+	assert.False(t, m.CanEdit(p, maintainer))
+
+	// Changes to the maintainers are audited once, on behalf of who made them
+	entries, total, err := m.AuditLog(AuditFilter{PageID: p.ID}, 10, 0)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, total) {
+		assert.Equal(t, AuditMaintainerRemoved, entries[0].Action)
+		assert.Equal(t, AuditMaintainerAdded, entries[1].Action)
+		assert.Equal(t, owner.ID, entries[1].ActorID)
+		assert.Equal(t, maintainer.ID, entries[1].UserID)
+	}
+}
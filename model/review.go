@@ -0,0 +1,220 @@
+package model
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// VersionStatus tells if a ContentVersion is waiting for review, or has been approved or rejected
+type VersionStatus int64
+
+// Scan reads a VersionStatus from the database
+func (s *VersionStatus) Scan(value interface{}) error { *s = VersionStatus(value.(int64)); return nil }
+
+// Value serializes a VersionStatus from the database
+func (s VersionStatus) Value() (driver.Value, error) { return int64(s), nil }
+
+// Review state of a ContentVersion
+const (
+	VersionPending  VersionStatus = 0
+	VersionApproved VersionStatus = 1
+	VersionRejected VersionStatus = 2
+)
+
+func (s VersionStatus) String() string {
+	switch s {
+	case VersionApproved:
+		return "approved"
+	case VersionRejected:
+		return "rejected"
+	}
+	return "pending"
+}
+
+// ErrVersionNotPending is returned when reviewing a version that has already
+// been reviewed, or that is older than the approved version of its page
+var ErrVersionNotPending = errors.New("version is not pending review")
+
+// ErrVersionNotRevertible is returned when reverting a page to a version which was
+// never approved, or which is not older than its approved version
+var ErrVersionNotRevertible = errors.New("only earlier approved versions can be restored")
+
+// IsRevertible tells if the page p can be reverted to the version: it must have been
+// approved, and be older than the approved version of p
+func (cv *ContentVersion) IsRevertible(p *Page) bool {
+	return cv.Status == VersionApproved && cv.ID < p.ApprovedVersionID
+}
+
+// IsPending tells if the version is still waiting for a review
+func (cv *ContentVersion) IsPending(p *Page) bool {
+	return cv.Status == VersionPending && cv.ID > p.ApprovedVersionID
+}
+
+// migrateVersionStatus marks as approved the versions saved before versions were
+// reviewed: the approved version of each page and all the ones before it
+func migrateVersionStatus(db *gorm.DB) error {
+	return db.Exec(`UPDATE content_versions SET status = ?
+		WHERE id <= (SELECT approved_version_id FROM pages WHERE pages.id = content_versions.page_id)`,
+		VersionApproved).Error
+}
+
+// FindVersion returns a ContentVersion, together with its page and author, or nil
+func (m *Model) FindVersion(id uint) *ContentVersion {
+	var cv ContentVersion
+	res := m.Db.Preload("Page").Preload("User").First(&cv, "id = ?", id)
+	if res.Error != nil {
+		return nil
+	}
+	return &cv
+}
+
+// PendingVersions returns all versions newer than the approved version of their page,
+// which have not been rejected
+func (m *Model) PendingVersions() ([]ContentVersion, error) {
+	var versions []ContentVersion
+	res := m.Db.
+		Preload("Page").
+		Preload("User").
+		Joins("JOIN pages ON pages.id = content_versions.page_id").
+		Where("content_versions.id > pages.approved_version_id and content_versions.status = ?", VersionPending).
+		Where("pages.deleted_at IS NULL").
+		Order("content_versions.id").
+		Find(&versions)
+	return versions, res.Error
+}
+
+// ApproveVersion makes a pending version the current content of its page.
+// The updated page is returned, so that it can be re-indexed.
+func (m *Model) ApproveVersion(cv *ContentVersion, reviewer *User, note string) (*Page, error) {
+	var page Page
+	if err := m.Db.First(&page, "id = ?", cv.PageID).Error; err != nil {
+		return nil, err
+	}
+	if !cv.IsPending(&page) {
+		return nil, ErrVersionNotPending
+	}
+
+	now := time.Now()
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		if err := markReviewed(tx, cv, VersionApproved, reviewer, note, now); err != nil {
+			return err
+		}
+		page.Content = cv.Content
+		page.ApprovedVersionID = cv.ID
+		page.SetFieldsToParsedContent()
+		if err := tx.Save(&page).Error; err != nil {
+			return err
+		}
+		return audit(tx, AuditVersionApproved, reviewer, AuditEntry{UserID: cv.UserID, PageID: cv.PageID, Details: reviewDetails(cv, note)})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	setReviewed(cv, VersionApproved, reviewer, note, now)
+	return &page, nil
+}
+
+// RejectVersion marks a pending version as rejected, so that it is no longer
+// proposed for review
+func (m *Model) RejectVersion(cv *ContentVersion, reviewer *User, note string) error {
+	var page Page
+	if err := m.Db.First(&page, "id = ?", cv.PageID).Error; err != nil {
+		return err
+	}
+	if !cv.IsPending(&page) {
+		return ErrVersionNotPending
+	}
+
+	now := time.Now()
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		if err := markReviewed(tx, cv, VersionRejected, reviewer, note, now); err != nil {
+			return err
+		}
+		return audit(tx, AuditVersionRejected, reviewer, AuditEntry{UserID: cv.UserID, PageID: cv.PageID, Details: reviewDetails(cv, note)})
+	})
+	if err != nil {
+		return err
+	}
+	setReviewed(cv, VersionRejected, reviewer, note, now)
+	return nil
+}
+
+// RevertPage restores the content of an earlier approved version of a page.
+// History is never rewritten: the restored content is saved as a new approved
+// version, which keeps track of the version it was copied from.
+func (m *Model) RevertPage(page *Page, old *ContentVersion, u *User) (*ContentVersion, error) {
+	if old.PageID != page.ID {
+		return nil, fmt.Errorf("version %d does not belong to page %d", old.ID, page.ID)
+	}
+	if !old.IsRevertible(page) {
+		return nil, ErrVersionNotRevertible
+	}
+
+	var cv *ContentVersion
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if cv, err = revertPage(tx, page, old, u); err != nil {
+			return err
+		}
+		return audit(tx, AuditPageReverted, u, AuditEntry{PageID: page.ID, Details: fmt.Sprintf("restored version %d", old.ID)})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cv, nil
+}
+
+// revertPage saves the content of old as the new approved version of page
+func revertPage(tx *gorm.DB, page *Page, old *ContentVersion, u *User) (*ContentVersion, error) {
+	now := time.Now()
+	cv := ContentVersion{
+		PageID:     page.ID,
+		UserID:     u.ID,
+		Content:    old.Content,
+		Status:     VersionApproved,
+		ReviewerID: u.ID,
+		ReviewedAt: &now,
+		RevertOfID: old.ID,
+	}
+	if err := tx.Save(&cv).Error; err != nil {
+		return nil, err
+	}
+	page.Content = cv.Content
+	page.ApprovedVersionID = cv.ID
+	page.SetFieldsToParsedContent()
+	if err := tx.Save(page).Error; err != nil {
+		return nil, err
+	}
+	return &cv, nil
+}
+
+// reviewDetails describes the review of cv in the audit log
+func reviewDetails(cv *ContentVersion, note string) string {
+	if note == "" {
+		return fmt.Sprintf("version %d", cv.ID)
+	}
+	return fmt.Sprintf("version %d: %s", cv.ID, note)
+}
+
+// markReviewed only updates the review columns, so that the version's
+// associations are never saved back
+func markReviewed(db *gorm.DB, cv *ContentVersion, status VersionStatus, reviewer *User, note string, when time.Time) error {
+	return db.Model(&ContentVersion{}).Where("id = ?", cv.ID).UpdateColumns(map[string]interface{}{
+		"status":      status,
+		"reviewer_id": reviewer.ID,
+		"review_note": note,
+		"reviewed_at": when,
+	}).Error
+}
+
+func setReviewed(cv *ContentVersion, status VersionStatus, reviewer *User, note string, when time.Time) {
+	cv.Status = status
+	cv.ReviewerID = reviewer.ID
+	cv.ReviewNote = note
+	cv.ReviewedAt = &when
+}
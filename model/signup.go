@@ -0,0 +1,117 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Errors returned by Signup when the registration data is not valid.
+// They are meant to be shown to the user.
+var (
+	ErrInvalidUsername = errors.New("the username must be 3 to 30 letters, digits, dots, dashes or underscores")
+	ErrInvalidEmail    = errors.New("invalid email address")
+	ErrUsernameTaken   = errors.New("the username is already taken")
+	ErrEmailTaken      = errors.New("the email is already registered")
+	ErrWeakPassword    = errors.New("the password must be at least 8 characters long, and contain letters and either digits or symbols")
+)
+
+// MinPasswordLength is the minimum length of the passwords chosen by users
+const MinPasswordLength = 8
+
+var usernameRegexp = regexp.MustCompile(`^[\pL\pN._-]{3,30}$`)
+
+// commonPasswords are refused even if they satisfy CheckPasswordStrength
+var commonPasswords = map[string]bool{
+	"password1": true, "password123": true, "passw0rd": true, "qwerty123": true,
+	"abc12345": true, "abcd1234": true, "iloveyou1": true, "isamuni1": true,
+}
+
+// CheckPasswordStrength returns ErrWeakPassword if password is too easy to guess.
+// Passwords containing the username or the email are refused too.
+func CheckPasswordStrength(password, username, email string) error {
+	if len([]rune(password)) < MinPasswordLength {
+		return ErrWeakPassword
+	}
+
+	var letters, others bool
+	for _, r := range password {
+		if unicode.IsLetter(r) {
+			letters = true
+		} else if !unicode.IsSpace(r) {
+			others = true
+		}
+	}
+	if !letters || !others {
+		return ErrWeakPassword
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return ErrWeakPassword
+	}
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return ErrWeakPassword
+	}
+	if local := strings.SplitN(email, "@", 2)[0]; len(local) >= 3 && strings.Contains(lower, strings.ToLower(local)) {
+		return ErrWeakPassword
+	}
+	return nil
+}
+
+// ValidEmail does a basic syntactic check of an email address
+func ValidEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	return at > 0 && at < len(email)-3 && strings.Contains(email[at:], ".") &&
+		!strings.ContainsAny(email, " \t\r\n<>,;")
+}
+
+// UsernameTaken tells if a user with the same username exists, ignoring case
+func (m *Model) UsernameTaken(username string) bool {
+	var count int
+	m.Db.Model(&User{}).Where("lower(username) = lower(?)", username).Count(&count)
+	return count > 0
+}
+
+// EmailTaken tells if a user with the same email exists, ignoring case
+func (m *Model) EmailTaken(email string) bool {
+	var count int
+	m.Db.Model(&User{}).Where("lower(email) = lower(?)", email).Count(&count)
+	return count > 0
+}
+
+// Signup registers a new user with an email and a password.
+// Unlike RegisterEmail, the data is validated, and the email is not verified:
+// the user can't edit pages until the email is confirmed (see IsVerified).
+func (m *Model) Signup(username, email, password string) (*User, error) {
+	username = strings.TrimSpace(username)
+	email = strings.TrimSpace(email)
+
+	if !usernameRegexp.MatchString(username) {
+		return nil, ErrInvalidUsername
+	}
+	if !ValidEmail(email) {
+		return nil, ErrInvalidEmail
+	}
+	if err := CheckPasswordStrength(password, username, email); err != nil {
+		return nil, err
+	}
+	if m.UsernameTaken(username) {
+		return nil, ErrUsernameTaken
+	}
+	if m.EmailTaken(email) {
+		return nil, ErrEmailTaken
+	}
+
+	u := User{
+		Username: username,
+		Email:    &email,
+		Role:     RoleUser,
+	}
+	u.SetPassword(password)
+	if err := m.SaveUser(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
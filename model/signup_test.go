@@ -0,0 +1,46 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPasswordStrength(t *testing.T) {
+	assert.Equal(t, ErrWeakPassword, CheckPasswordStrength("a1b2", "", ""))
+	assert.Equal(t, ErrWeakPassword, CheckPasswordStrength("onlyletters", "", ""))
+	assert.Equal(t, ErrWeakPassword, CheckPasswordStrength("1234567890", "", ""))
+	assert.Equal(t, ErrWeakPassword, CheckPasswordStrength("Password123", "", ""))
+	assert.Equal(t, ErrWeakPassword, CheckPasswordStrength("mario.rossi!", "mario.rossi", ""))
+	assert.Equal(t, ErrWeakPassword, CheckPasswordStrength("rossi2020!", "mario", "rossi@example.com"))
+	assert.Nil(t, CheckPasswordStrength("cavallo batteria 7", "mario", "mario@example.com"))
+}
+
+func TestSignup(t *testing.T) {
+	m := New(ConnectTestDB())
+	m.registerTestAdmin()
+
+	_, err := m.Signup("a", "mario@example.com", "correct horse 7")
+	assert.Equal(t, ErrInvalidUsername, err)
+	_, err = m.Signup("mario", "mario.example.com", "correct horse 7")
+	assert.Equal(t, ErrInvalidEmail, err)
+	_, err = m.Signup("mario", "mario@example.com", "short")
+	assert.Equal(t, ErrWeakPassword, err)
+	_, err = m.Signup("Vigliag", "mario@example.com", "correct horse 7")
+	assert.Equal(t, ErrUsernameTaken, err)
+	_, err = m.Signup("mario", "VIGLIAG@gmail.com", "correct horse 7")
+	assert.Equal(t, ErrEmailTaken, err)
+
+	u, err := m.Signup("mario", "Mario@Example.com", "correct horse 7")
+	assert.Nil(t, err)
+	assert.False(t, u.EmailVerified)
+	// Emails are matched regardless of case
+	assert.Equal(t, u.ID, m.LoginEmail("mario@example.com", "correct horse 7").ID)
+	assert.Equal(t, u.ID, m.LoginEmail("MARIO@EXAMPLE.COM", "correct horse 7").ID)
+
+	// Users can't edit until they verify their email
+	assert.False(t, m.IsVerified(u))
+	assert.False(t, m.CanEdit(&Page{}, u))
+	u.EmailVerified = true
+	assert.True(t, m.CanEdit(&Page{}, u))
+}
@@ -0,0 +1,109 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gosimple/slug"
+	"github.com/jinzhu/gorm"
+)
+
+// PageSlug is a slug that a page used in the past.
+// It is kept so that old urls can be redirected to the current one.
+type PageSlug struct {
+	gorm.Model
+
+	PageID uint     `gorm:"index"`
+	Type   PageType `gorm:"type:int"`
+	Slug   string   `gorm:"index"`
+}
+
+// reservedSlugs would clash with the routes that come after a page category
+var reservedSlugs = map[string]bool{
+	"new": true,
+}
+
+// isUsableSlug tells if a slug can't be mistaken for a route or for a page ID
+func isUsableSlug(s string) bool {
+	if s == "" || reservedSlugs[s] {
+		return false
+	}
+	_, err := strconv.Atoi(s)
+	return err != nil
+}
+
+// availableSlug returns the given slug, or the first free variant of it
+// (eg. "name-2"), which is not used by a page other than pageID
+func availableSlug(tx *gorm.DB, base string, pageID uint) (string, error) {
+	if base == "" {
+		base = "page"
+	}
+
+	candidate := base
+	for i := 2; ; i++ {
+		if isUsableSlug(candidate) {
+			var count int
+			// Deleted pages still hold their slug, as it is a unique column
+			err := tx.Unscoped().Model(&Page{}).
+				Where("slug = ? and id <> ?", candidate, pageID).
+				Count(&count).Error
+			if err != nil {
+				return "", err
+			}
+			if count == 0 {
+				return candidate, nil
+			}
+		}
+		candidate = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// updateSlug assigns an unique slug to the page, normalizing the one given by users,
+// or generating it from the title if missing. If the page already existed, and its
+// slug changed, the old slug is saved in the page's slug history.
+func updateSlug(tx *gorm.DB, p *Page) error {
+	base := slug.Make(p.Slug)
+	if base == "" {
+		base = slug.Make(p.Title)
+	}
+
+	newSlug, err := availableSlug(tx, base, p.ID)
+	if err != nil {
+		return err
+	}
+	p.Slug = newSlug
+
+	if p.ID == 0 {
+		return nil
+	}
+
+	var stored Page
+	if err := tx.Select("slug").First(&stored, "id = ?", p.ID).Error; err != nil {
+		return err
+	}
+	if stored.Slug == "" || stored.Slug == p.Slug {
+		return nil
+	}
+	return tx.Save(&PageSlug{PageID: p.ID, Type: p.Type, Slug: stored.Slug}).Error
+}
+
+// FindPageBySlug returns a page of a given type by its current slug or nil
+func (m *Model) FindPageBySlug(s string, ptype PageType) *Page {
+	var page Page
+	res := m.Db.First(&page, "slug = ? and type = ?", s, ptype)
+	if res.Error != nil {
+		return nil
+	}
+	return &page
+}
+
+// FindPageByOldSlug returns the page of the given type that most recently used
+// the slug, or nil
+func (m *Model) FindPageByOldSlug(s string, ptype PageType) *Page {
+	var old PageSlug
+	res := m.Db.Order("id desc").First(&old, "slug = ? and type = ?", s, ptype)
+	if res.Error != nil {
+		return nil
+	}
+	return m.FindPage(old.PageID, ptype)
+}
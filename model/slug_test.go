@@ -0,0 +1,47 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlugHistory(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+	assert.Equal(t, "example-company", p.Slug)
+
+	// Changing the title changes the slug, and keeps the old one
+	p.Title = "Renamed company"
+	p.Slug = ""
+	assert.NoError(t, m.SavePage(p, admin))
+	assert.Equal(t, "renamed-company", p.Slug)
+
+	assert.Equal(t, p.ID, m.FindPageBySlug("renamed-company", PageCompany).ID)
+	assert.Nil(t, m.FindPageBySlug("example-company", PageCompany))
+	assert.Equal(t, p.ID, m.FindPageByOldSlug("example-company", PageCompany).ID)
+	assert.Nil(t, m.FindPageByOldSlug("example-company", PageCommunity))
+
+	// Slugs are unique, and never clash with IDs or routes
+	p2 := &Page{Content: "Ciao", Type: PageCommunity, Title: "Renamed company"}
+	assert.NoError(t, m.SavePage(p2, admin))
+	assert.Equal(t, "renamed-company-2", p2.Slug)
+
+	p3 := &Page{Content: "Ciao", Type: PageWiki, Title: "New"}
+	assert.NoError(t, m.SavePage(p3, admin))
+	assert.Equal(t, "new-2", p3.Slug)
+
+	p4 := &Page{Content: "Ciao", Type: PageWiki, Title: "2018"}
+	assert.NoError(t, m.SavePage(p4, admin))
+	assert.Equal(t, "2018-2", p4.Slug)
+
+	// Slugs chosen by users are normalized too
+	p4.Slug = "Anno 2018/../Archivio?"
+	assert.NoError(t, m.SavePage(p4, admin))
+	assert.Equal(t, "anno-2018-archivio", p4.Slug)
+}
@@ -0,0 +1,234 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ThrottlePolicy describes how failed logins slow down further attempts.
+// After FreeAttempts failures, each attempt has to wait BaseDelay, doubled at
+// every new failure up to MaxDelay. After LockoutAttempts failures, no attempt
+// is allowed for LockoutDuration. Failures older than ForgetAfter are forgotten.
+type ThrottlePolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAttempts int
+	LockoutDuration time.Duration
+	ForgetAfter     time.Duration
+}
+
+// AccountThrottle applies to the attempts to log in to an account, from any address
+var AccountThrottle = ThrottlePolicy{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        5 * time.Minute,
+	LockoutAttempts: 10,
+	LockoutDuration: 30 * time.Minute,
+	ForgetAfter:     24 * time.Hour,
+}
+
+// IPThrottle applies to the attempts to log in from an address, to any account.
+// It allows more failures, as many users can share an address.
+var IPThrottle = ThrottlePolicy{
+	FreeAttempts:    10,
+	BaseDelay:       time.Second,
+	MaxDelay:        5 * time.Minute,
+	LockoutAttempts: 50,
+	LockoutDuration: time.Hour,
+	ForgetAfter:     24 * time.Hour,
+}
+
+// delay returns how long to wait after the given number of failures
+func (p ThrottlePolicy) delay(failures int) time.Duration {
+	if failures >= p.LockoutAttempts {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// LoginThrottle counts the recent failed logins for an account or an address
+type LoginThrottle struct {
+	// Target is "account:" followed by the email, or "ip:" followed by the address
+	Target      string `gorm:"primary_key"`
+	Failures    int
+	LastFailure time.Time
+	// Until when no attempts are allowed
+	BlockedUntil time.Time
+	// UserID is the user owning the account, 0 if no user has that email or the target is an address
+	UserID uint `gorm:"index"`
+}
+
+// FailedLogin is an entry of the log of the failed attempts to log in
+type FailedLogin struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	// Account is the email the attempt was made for
+	Account string `gorm:"index"`
+	// UserID is the user owning the account, 0 if no user has that email
+	UserID uint
+	IP     string `gorm:"index"`
+	// Reason is why the attempt failed, e.g. "password" or "throttled"
+	Reason string
+}
+
+// LoginThrottledError is returned when an attempt to log in is refused
+// because of too many failures
+type LoginThrottledError struct {
+	RetryAt time.Time
+	// Locked is true when the lockout threshold was reached
+	Locked bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("login locked until %s", e.RetryAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("too many failed logins, retry at %s", e.RetryAt.Format(time.RFC3339))
+}
+
+const (
+	accountTarget = "account:"
+	ipTarget      = "ip:"
+)
+
+func (t *LoginThrottle) policy() ThrottlePolicy {
+	if strings.HasPrefix(t.Target, ipTarget) {
+		return IPThrottle
+	}
+	return AccountThrottle
+}
+
+// Locked tells if the failures reached the lockout threshold
+func (t *LoginThrottle) Locked() bool {
+	return t.Failures >= t.policy().LockoutAttempts
+}
+
+// Account returns the email a LoginThrottle refers to, if it is the throttling of an account
+func (t *LoginThrottle) Account() string {
+	return strings.TrimPrefix(t.Target, accountTarget)
+}
+
+func normalizeAccount(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
+
+func (m *Model) findThrottle(target string) *LoginThrottle {
+	var t LoginThrottle
+	if err := m.Db.First(&t, "target = ?", target).Error; err != nil {
+		return nil
+	}
+	return &t
+}
+
+// LoginAllowed tells if an attempt to log in to account from ip can be made at time now.
+// It returns a *LoginThrottledError if either had too many recent failures.
+func (m *Model) LoginAllowed(ip, account string, now time.Time) error {
+	var refused *LoginThrottledError
+	for _, target := range []string{accountTarget + normalizeAccount(account), ipTarget + ip} {
+		t := m.findThrottle(target)
+		if t == nil || !now.Before(t.BlockedUntil) {
+			continue
+		}
+		if refused == nil || t.BlockedUntil.After(refused.RetryAt) {
+			refused = &LoginThrottledError{RetryAt: t.BlockedUntil, Locked: t.Locked()}
+		}
+	}
+	if refused != nil {
+		return refused
+	}
+	return nil
+}
+
+func recordFailure(tx *gorm.DB, target string, userID uint, now time.Time) error {
+	var t LoginThrottle
+	if err := tx.First(&t, "target = ?", target).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	if t.Target == "" || now.Sub(t.LastFailure) > t.policy().ForgetAfter {
+		t = LoginThrottle{Target: target}
+	}
+
+	t.Failures++
+	t.LastFailure = now
+	t.BlockedUntil = now.Add(t.policy().delay(t.Failures))
+	t.UserID = userID
+	return tx.Save(&t).Error
+}
+
+// RecordLoginFailure logs a failed attempt to log in to account from ip,
+// and slows down the next attempts for both
+func (m *Model) RecordLoginFailure(ip, account, reason string, now time.Time) error {
+	account = normalizeAccount(account)
+
+	var userID uint
+	var u User
+	if account != "" && m.Db.Select("id").First(&u, "lower(email) = ?", account).Error == nil {
+		userID = u.ID
+	}
+
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		entry := FailedLogin{CreatedAt: now, Account: account, UserID: userID, IP: ip, Reason: reason}
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+		err := audit(tx, AuditLoginFailed, nil, AuditEntry{CreatedAt: now, UserID: userID, IP: ip, Details: reason + " for " + account})
+		if err != nil {
+			return err
+		}
+		if err := recordFailure(tx, accountTarget+account, userID, now); err != nil {
+			return err
+		}
+		return recordFailure(tx, ipTarget+ip, 0, now)
+	})
+}
+
+// RecordLoginSuccess forgets the failed attempts to log in to account.
+// The failures of the address are kept, so that logging in to one's own
+// account does not help guessing the password of others.
+func (m *Model) RecordLoginSuccess(account string) error {
+	return m.Db.Delete(&LoginThrottle{}, "target = ?", accountTarget+normalizeAccount(account)).Error
+}
+
+// LockedAccounts returns the throttling of the accounts locked at time now
+func (m *Model) LockedAccounts(now time.Time) ([]LoginThrottle, error) {
+	var locked []LoginThrottle
+	res := m.Db.Where("target like ? and failures >= ? and blocked_until > ?",
+		accountTarget+"%", AccountThrottle.LockoutAttempts, now).
+		Order("blocked_until desc").Find(&locked)
+	return locked, res.Error
+}
+
+// UnlockAccount allows u to log in again, forgetting the failed attempts to log in to their account
+func (m *Model) UnlockAccount(u *User, by *User) error {
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("target like ? and user_id = ?", accountTarget+"%", u.ID)
+		if u.Email != nil {
+			query = query.Or("target = ?", accountTarget+normalizeAccount(*u.Email))
+		}
+		if err := query.Delete(&LoginThrottle{}).Error; err != nil {
+			return err
+		}
+		return audit(tx, AuditAccountUnlocked, by, AuditEntry{UserID: u.ID})
+	})
+}
+
+// RecentFailedLogins returns the last failed attempts to log in, newest first
+func (m *Model) RecentFailedLogins(limit int) ([]FailedLogin, error) {
+	var entries []FailedLogin
+	res := m.Db.Order("created_at desc, id desc").Limit(limit).Find(&entries)
+	return entries, res.Error
+}
@@ -0,0 +1,106 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottleDelay(t *testing.T) {
+	p := ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second,
+		LockoutAttempts: 9, LockoutDuration: time.Hour}
+
+	expected := []time.Duration{0, 0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, time.Hour, time.Hour}
+	for failures, delay := range expected {
+		assert.Equal(t, delay, p.delay(failures), "after %d failures", failures)
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	m := Model{ConnectTestDB()}
+	u := m.registerTestAdmin()
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	const ip = "192.0.2.1"
+
+	// The first failures don't slow down the user
+	for i := 0; i < AccountThrottle.FreeAttempts; i++ {
+		assert.NoError(t, m.LoginAllowed(ip, "vigliag@gmail.com", now))
+		assert.NoError(t, m.RecordLoginFailure(ip, "vigliag@gmail.com", "password", now))
+	}
+
+	// then each attempt has to wait, twice as much as the previous one
+	assert.NoError(t, m.LoginAllowed(ip, "vigliag@gmail.com", now))
+	assert.NoError(t, m.RecordLoginFailure(ip, "VIGLIAG@gmail.com", "password", now))
+	err := m.LoginAllowed(ip, "vigliag@gmail.com", now)
+	if assert.IsType(t, &LoginThrottledError{}, err) {
+		assert.Equal(t, now.Add(time.Second), err.(*LoginThrottledError).RetryAt)
+		assert.False(t, err.(*LoginThrottledError).Locked)
+	}
+
+	now = now.Add(time.Second)
+	assert.NoError(t, m.LoginAllowed(ip, "vigliag@gmail.com", now))
+	assert.NoError(t, m.RecordLoginFailure(ip, "vigliag@gmail.com", "password", now))
+	assert.Error(t, m.LoginAllowed(ip, "vigliag@gmail.com", now.Add(time.Second)))
+	assert.NoError(t, m.LoginAllowed(ip, "vigliag@gmail.com", now.Add(2*time.Second)))
+
+	// Other accounts are not affected, as the address has fewer failures
+	assert.NoError(t, m.LoginAllowed(ip, "other@example.com", now))
+
+	// Until the account is locked
+	for i := AccountThrottle.FreeAttempts + 2; i < AccountThrottle.LockoutAttempts; i++ {
+		now = now.Add(AccountThrottle.MaxDelay)
+		assert.NoError(t, m.RecordLoginFailure("198.51.100.1", "vigliag@gmail.com", "password", now))
+	}
+	err = m.LoginAllowed("203.0.113.1", "vigliag@gmail.com", now.Add(AccountThrottle.MaxDelay))
+	if assert.IsType(t, &LoginThrottledError{}, err) {
+		assert.True(t, err.(*LoginThrottledError).Locked)
+		assert.Equal(t, now.Add(AccountThrottle.LockoutDuration), err.(*LoginThrottledError).RetryAt)
+	}
+
+	locked, err := m.LockedAccounts(now)
+	assert.NoError(t, err)
+	if assert.Len(t, locked, 1) {
+		assert.Equal(t, "vigliag@gmail.com", locked[0].Account())
+		assert.Equal(t, u.ID, locked[0].UserID)
+	}
+
+	// The lock expires
+	assert.NoError(t, m.LoginAllowed(ip, "vigliag@gmail.com", now.Add(AccountThrottle.LockoutDuration)))
+	// or can be removed by an admin
+	assert.NoError(t, m.UnlockAccount(u, nil))
+	assert.NoError(t, m.LoginAllowed(ip, "vigliag@gmail.com", now))
+	locked, _ = m.LockedAccounts(now)
+	assert.Empty(t, locked)
+
+	// Failed attempts are logged
+	entries, err := m.RecentFailedLogins(100)
+	assert.NoError(t, err)
+	assert.Len(t, entries, AccountThrottle.LockoutAttempts)
+	assert.Equal(t, "198.51.100.1", entries[0].IP)
+	assert.Equal(t, u.ID, entries[0].UserID)
+	assert.Equal(t, "vigliag@gmail.com", entries[0].Account)
+}
+
+func TestIPThrottling(t *testing.T) {
+	m := Model{ConnectTestDB()}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	const ip = "192.0.2.1"
+
+	// Trying many accounts from the same address is throttled too
+	for i := 0; i < IPThrottle.FreeAttempts+1; i++ {
+		assert.NoError(t, m.RecordLoginFailure(ip, "nobody@example.com"+string(rune('a'+i)), "password", now))
+	}
+	assert.Error(t, m.LoginAllowed(ip, "someone@example.com", now))
+	assert.NoError(t, m.LoginAllowed("192.0.2.2", "someone@example.com", now))
+
+	// A success does not reset the failures of the address
+	assert.NoError(t, m.RecordLoginSuccess("someone@example.com"))
+	assert.Error(t, m.LoginAllowed(ip, "someone@example.com", now))
+
+	// Old failures are forgotten
+	now = now.Add(IPThrottle.ForgetAfter + time.Second)
+	assert.NoError(t, m.LoginAllowed(ip, "someone@example.com", now))
+	assert.NoError(t, m.RecordLoginFailure(ip, "someone@example.com", "password", now))
+	assert.NoError(t, m.LoginAllowed(ip, "someone@example.com", now))
+}
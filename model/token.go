@@ -1,11 +1,41 @@
 package model
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
 	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
+// Purposes of a Token. A token can only be used for the purpose it was created for.
+const (
+	TokenEmailConfirmation = "email-confirm"
+	// Confirms the pending email of a user (see RequestEmailChange)
+	TokenEmailChange   = "email-change"
+	TokenPasswordReset = "password-reset"
+	TokenOAuthState    = "oauth-state"
+	// Short lived credentials for the API. Personal access tokens, which are
+	// long lived and revocable, are stored as AccessToken instead.
+	TokenAPI = "api"
+)
+
+// TokenTTL is how long a token is valid after its creation, by purpose.
+// It can be changed in the configuration (see cmd/config.go).
+var TokenTTL = map[string]time.Duration{
+	TokenEmailConfirmation: 48 * time.Hour,
+	TokenEmailChange:       48 * time.Hour,
+	TokenPasswordReset:     30 * time.Minute,
+	TokenOAuthState:        10 * time.Minute,
+	TokenAPI:               time.Hour,
+}
+
+// ErrInvalidToken is returned when a token does not exist, is expired, or has
+// been created for another purpose
+var ErrInvalidToken = errors.New("invalid or expired token")
+
 //Token is a token, used in oauth, or for email confirmation
 type Token struct {
 	gorm.Model
@@ -13,43 +43,124 @@ type Token struct {
 	// Specifies what this token is about (eg. a userid)
 	Identifier uint
 
+	// What the token can be used for
+	Purpose string `gorm:"not null;default:''"`
+
 	// After this time, the token is no more valid
 	Expiration time.Time
 
-	// Autogenerated random value
-	Value string
+	// Hash of the autogenerated random value. The value itself is only known to who created the token.
+	HashedValue string `gorm:"unique_index"`
+}
+
+// hashToken returns the hash under which a token value is stored
+func hashToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
 }
 
+// DeleteExpiredTokens deletes the tokens that can't be used anymore
 func (m *Model) DeleteExpiredTokens() error {
-	return m.Db.Where("expiration < ?", time.Now()).Delete(Token{}).Error
+	return m.Db.Unscoped().Where("expiration < ?", time.Now()).Delete(Token{}).Error
 }
 
-func (m *Model) CreateToken(identifier uint, length int) (string, error) {
-	state := GenRandomString(length)
-	t := Token{
-		Expiration: time.Now().Add(time.Minute * 30),
-		Value:      state,
-		Identifier: identifier,
+// DefaultTokenCleanupInterval is how often StartTokenCleanup deletes expired tokens,
+// when not given a valid interval
+const DefaultTokenCleanupInterval = time.Hour
+
+// StartTokenCleanup calls DeleteExpiredTokens every interval, in the background,
+// until the returned function is called. Intervals that are not positive are
+// replaced by DefaultTokenCleanupInterval.
+func (m *Model) StartTokenCleanup(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		log.Printf("Invalid token cleanup interval %s, using %s", interval, DefaultTokenCleanupInterval)
+		interval = DefaultTokenCleanupInterval
 	}
-	return state, m.Db.Save(&t).Error
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.DeleteExpiredTokens(); err != nil {
+					log.Println("Could not delete expired tokens:", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
 }
 
-func (m *Model) GetToken(value string) (*Token, error) {
-	err := m.DeleteExpiredTokens()
-	if err != nil {
-		return nil, err
+// CreateToken creates a token for the given purpose, valid for TokenTTL[purpose].
+// Returns the value of the token, which is not stored.
+func (m *Model) CreateToken(identifier uint, purpose string) (string, error) {
+	ttl, ok := TokenTTL[purpose]
+	if !ok {
+		return "", errors.New("unknown token purpose " + purpose)
 	}
 
-	t := new(Token)
+	value := GenRandomString(20)
+	t := Token{
+		Expiration:  time.Now().Add(ttl),
+		HashedValue: hashToken(value),
+		Identifier:  identifier,
+		Purpose:     purpose,
+	}
+	return value, m.Db.Save(&t).Error
+}
 
-	res := m.Db.First(&t, "value=?", value)
-	if res.Error != nil {
+func findToken(db *gorm.DB, value string, purpose string) (*Token, error) {
+	t := new(Token)
+	res := db.First(t, "hashed_value = ? and purpose = ? and expiration >= ?", hashToken(value), purpose, time.Now())
+	if res.RecordNotFound() {
+		return nil, ErrInvalidToken
+	} else if res.Error != nil {
 		return nil, res.Error
 	}
+	return t, nil
+}
+
+// GetToken returns the valid token with the given value, if it was created for purpose.
+// The token is not consumed: use ConsumeToken to use it.
+func (m *Model) GetToken(value string, purpose string) (*Token, error) {
+	return findToken(m.Db, value, purpose)
+}
 
+// ConsumeToken returns the valid token with the given value and purpose, and deletes it,
+// so that it can only be used once. Looking up and deleting the token happen in
+// a single transaction: if two requests consume the same token, only one succeeds.
+func (m *Model) ConsumeToken(value string, purpose string) (*Token, error) {
+	var t *Token
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		t, err = findToken(tx, value, purpose)
+		if err != nil {
+			return err
+		}
+
+		res := tx.Unscoped().Delete(t)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return ErrInvalidToken
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return t, nil
 }
 
 func (m *Model) DeleteToken(value string) error {
-	return m.Db.Where("value=?", value).Delete(Token{}).Error
+	return m.Db.Unscoped().Where("hashed_value = ?", hashToken(value)).Delete(Token{}).Error
+}
+
+// DeleteUserTokens deletes the tokens with the given identifier and purpose
+func (m *Model) DeleteUserTokens(identifier uint, purpose string) error {
+	return m.Db.Unscoped().Where("identifier = ? and purpose = ?", identifier, purpose).Delete(Token{}).Error
 }
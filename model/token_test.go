@@ -2,23 +2,91 @@ package model
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestTokenUsage(t *testing.T) {
 	m := Model{ConnectTestDB()}
-	tval, err := m.CreateToken(1, 18)
+	tval, err := m.CreateToken(1, TokenEmailConfirmation)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, tval)
 
-	tok, err := m.GetToken(tval)
+	tok, err := m.GetToken(tval, TokenEmailConfirmation)
 	assert.NoError(t, err)
-	assert.Equal(t, tval, tok.Value)
+	assert.Equal(t, uint(1), tok.Identifier)
+	// Only the hash of the value is stored
+	assert.NotEqual(t, tval, tok.HashedValue)
+
+	// Tokens can't be used for another purpose
+	_, err = m.GetToken(tval, TokenPasswordReset)
+	assert.Equal(t, ErrInvalidToken, err)
 
 	err = m.DeleteToken(tval)
 	assert.NoError(t, err)
 
-	_, err = m.GetToken(tval)
+	_, err = m.GetToken(tval, TokenEmailConfirmation)
 	assert.Error(t, err)
+
+	// Delete all the tokens of a user with a purpose
+	reset, err := m.CreateToken(1, TokenPasswordReset)
+	assert.NoError(t, err)
+	confirm, err := m.CreateToken(1, TokenEmailConfirmation)
+	assert.NoError(t, err)
+	assert.NoError(t, m.DeleteUserTokens(1, TokenPasswordReset))
+	_, err = m.GetToken(reset, TokenPasswordReset)
+	assert.Error(t, err)
+	_, err = m.GetToken(confirm, TokenEmailConfirmation)
+	assert.NoError(t, err)
+
+	_, err = m.CreateToken(1, "unknown")
+	assert.Error(t, err)
+}
+
+func TestConsumeToken(t *testing.T) {
+	m := Model{ConnectTestDB()}
+	tval, err := m.CreateToken(2, TokenPasswordReset)
+	assert.NoError(t, err)
+
+	_, err = m.ConsumeToken(tval, TokenEmailConfirmation)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	tok, err := m.ConsumeToken(tval, TokenPasswordReset)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(2), tok.Identifier)
+
+	// Tokens can only be consumed once
+	_, err = m.ConsumeToken(tval, TokenPasswordReset)
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestExpiredTokens(t *testing.T) {
+	m := Model{ConnectTestDB()}
+	expired, err := m.CreateToken(1, TokenOAuthState)
+	assert.NoError(t, err)
+	valid, err := m.CreateToken(1, TokenOAuthState)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Db.Model(&Token{}).Where("hashed_value = ?", hashToken(expired)).
+		UpdateColumn("expiration", time.Now().Add(-time.Minute)).Error)
+
+	_, err = m.GetToken(expired, TokenOAuthState)
+	assert.Equal(t, ErrInvalidToken, err)
+	_, err = m.ConsumeToken(expired, TokenOAuthState)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// Expired tokens are deleted by the cleanup in the background
+	stop := m.StartTokenCleanup(10 * time.Millisecond)
+	defer stop()
+	assert.Eventually(t, func() bool {
+		var count int
+		m.Db.Unscoped().Model(&Token{}).Count(&count)
+		return count == 1
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = m.GetToken(valid, TokenOAuthState)
+	assert.NoError(t, err)
+
+	// Invalid intervals fall back to the default one
+	m.StartTokenCleanup(0)()
 }
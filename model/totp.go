@@ -0,0 +1,267 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Parameters of the TOTP codes (RFC 6238), the defaults understood by authenticator apps
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// number of periods before and after the current one whose codes are accepted,
+	// to tolerate clock drift and slow typing
+	totpSkew = 1
+)
+
+// RecoveryCodesCount is how many recovery codes are generated when enabling two-factor authentication
+const RecoveryCodesCount = 10
+
+var (
+	// ErrInvalidSecondFactor is returned when a TOTP or recovery code is wrong, expired or already used
+	ErrInvalidSecondFactor = errors.New("invalid authentication code")
+	// ErrTOTPNotEnabled is returned when using two-factor authentication for a user who did not enable it
+	ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrTOTPEnabled is returned when enrolling a user who already enabled two-factor authentication
+	ErrTOTPEnabled = errors.New("two-factor authentication is already enabled")
+)
+
+// RecoveryCode lets a user log in once without their authenticator app.
+// Like tokens, only a hash of the code is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserID      uint   `gorm:"index"`
+	HashedValue string `gorm:"unique_index"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random secret, encoded in base32 as expected by authenticator apps
+func GenerateTOTPSecret() string {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(secret)
+}
+
+// TOTPURL returns the otpauth:// url to enroll the secret in an authenticator app, usually shown as a QR code
+func TOTPURL(secret, issuer, account string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	params := url.Values{"secret": {secret}, "issuer": {issuer}}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// hotp computes the code for a counter as described in RFC 4226
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+// TOTPCode returns the code generated at time t for the secret
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, totpCounter(t)), nil
+}
+
+// ValidateTOTP checks a code against the secret at time t. On success, it returns the
+// counter of the matched period, which should be stored to refuse the code if used again.
+func ValidateTOTP(secret, code string, t time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	counter := totpCounter(t)
+	for c := counter - totpSkew; c <= counter+totpSkew; c++ {
+		if hmac.Equal([]byte(hotp(key, c)), []byte(code)) {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeRecoveryCode makes recovery codes case insensitive, ignoring spaces and dashes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// newRecoveryCodes replaces the recovery codes of u, returning the new ones
+func newRecoveryCodes(tx *gorm.DB, u *User) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodesCount)
+	for i := range codes {
+		value := strings.ToLower(GenRandomString(8))
+		codes[i] = value[:4] + "-" + value[4:8]
+		rc := RecoveryCode{UserID: u.ID, HashedValue: hashToken(normalizeRecoveryCode(codes[i]))}
+		if err := tx.Create(&rc).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// TOTPEnrollmentSecret returns the secret u has to add to their authenticator app
+// to enable two-factor authentication. The secret is generated the first time, and
+// kept until the enrollment is completed by EnableTOTP.
+func (m *Model) TOTPEnrollmentSecret(u *User) (string, error) {
+	if u.TOTPEnabled {
+		return "", ErrTOTPEnabled
+	}
+	if u.TOTPSecret != "" {
+		return u.TOTPSecret, nil
+	}
+
+	secret := GenerateTOTPSecret()
+	err := m.Db.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("totp_secret", secret).Error
+	if err != nil {
+		return "", err
+	}
+	u.TOTPSecret = secret
+	return secret, nil
+}
+
+// EnableTOTP turns on two-factor authentication for u, once they proved to have
+// enrolled the secret given by TOTPEnrollmentSecret by giving a valid code.
+// It returns the new recovery codes.
+func (m *Model) EnableTOTP(u *User, code string) ([]string, error) {
+	if u.TOTPEnabled {
+		return nil, ErrTOTPEnabled
+	}
+	counter, ok := ValidateTOTP(u.TOTPSecret, code, time.Now())
+	if !ok || u.TOTPSecret == "" {
+		return nil, ErrInvalidSecondFactor
+	}
+
+	var codes []string
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", u.ID).UpdateColumns(map[string]interface{}{
+			"totp_enabled": true, "totp_last_counter": counter,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if codes, err = newRecoveryCodes(tx, u); err != nil {
+			return err
+		}
+		return audit(tx, AuditTwoFactorEnabled, u, AuditEntry{UserID: u.ID})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u.TOTPEnabled = true
+	u.TOTPLastCounter = counter
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication for u, deleting their recovery codes
+func (m *Model) DisableTOTP(u *User) error {
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", u.ID).UpdateColumns(map[string]interface{}{
+			"totp_secret": "", "totp_enabled": false, "totp_last_counter": 0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return audit(tx, AuditTwoFactorDisabled, u, AuditEntry{UserID: u.ID})
+	})
+	if err != nil {
+		return err
+	}
+
+	u.TOTPSecret = ""
+	u.TOTPEnabled = false
+	u.TOTPLastCounter = 0
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of u, invalidating the old ones
+func (m *Model) RegenerateRecoveryCodes(u *User) ([]string, error) {
+	if !u.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+	var codes []string
+	err := m.Db.Transaction(func(tx *gorm.DB) (err error) {
+		codes, err = newRecoveryCodes(tx, u)
+		return err
+	})
+	return codes, err
+}
+
+// RemainingRecoveryCodes returns how many recovery codes u has not used yet
+func (m *Model) RemainingRecoveryCodes(u *User) int {
+	var count int
+	m.Db.Model(&RecoveryCode{}).Where("user_id = ?", u.ID).Count(&count)
+	return count
+}
+
+// CheckSecondFactor verifies the code given by u in the second step of the login.
+// The code is either generated by their authenticator app, and can't be used twice,
+// or one of their recovery codes, which is consumed.
+func (m *Model) CheckSecondFactor(u *User, code string) error {
+	if !u.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+
+	if counter, ok := ValidateTOTP(u.TOTPSecret, code, time.Now()); ok {
+		// Only a code newer than the last one used is accepted
+		res := m.Db.Model(&User{}).Where("id = ? and totp_last_counter < ?", u.ID, counter).
+			UpdateColumn("totp_last_counter", counter)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidSecondFactor
+		}
+		u.TOTPLastCounter = counter
+		return nil
+	}
+
+	res := m.Db.Unscoped().
+		Where("user_id = ? and hashed_value = ?", u.ID, hashToken(normalizeRecoveryCode(code))).
+		Delete(&RecoveryCode{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidSecondFactor
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := TOTPCode(secret, time.Unix(unix, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, code)
+	}
+
+	now := time.Unix(1234567890, 0)
+	_, ok := ValidateTOTP(secret, "005924", now)
+	assert.True(t, ok)
+	// codes of the previous and next periods are accepted too
+	_, ok = ValidateTOTP(secret, "005924", now.Add(30*time.Second))
+	assert.True(t, ok)
+	_, ok = ValidateTOTP(secret, "005924", now.Add(-30*time.Second))
+	assert.True(t, ok)
+	_, ok = ValidateTOTP(secret, "005924", now.Add(90*time.Second))
+	assert.False(t, ok)
+	_, ok = ValidateTOTP(secret, "", now)
+	assert.False(t, ok)
+
+	assert.Equal(t, "otpauth://totp/Isamuni:vigliag?issuer=Isamuni&secret="+secret, TOTPURL(secret, "Isamuni", "vigliag"))
+}
+
+func TestTwoFactor(t *testing.T) {
+	m := Model{ConnectTestDB()}
+	u := m.registerTestAdmin()
+
+	assert.Equal(t, ErrTOTPNotEnabled, m.CheckSecondFactor(u, "123456"))
+	_, err := m.EnableTOTP(u, "")
+	assert.Equal(t, ErrInvalidSecondFactor, err)
+
+	// The secret is kept until the enrollment is completed
+	secret, err := m.TOTPEnrollmentSecret(u)
+	assert.NoError(t, err)
+	again, err := m.TOTPEnrollmentSecret(m.RetrieveUser(u.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, secret, again)
+	assert.False(t, m.RetrieveUser(u.ID).TOTPEnabled)
+
+	// The secret is only enabled with a valid code
+	_, err = m.EnableTOTP(u, "000000")
+	assert.Equal(t, ErrInvalidSecondFactor, err)
+
+	code, err := TOTPCode(secret, time.Now())
+	assert.NoError(t, err)
+	codes, err := m.EnableTOTP(u, code)
+	assert.NoError(t, err)
+	assert.Len(t, codes, RecoveryCodesCount)
+	assert.True(t, m.RetrieveUser(u.ID).TOTPEnabled)
+	_, err = m.TOTPEnrollmentSecret(u)
+	assert.Equal(t, ErrTOTPEnabled, err)
+
+	// The code used for enrolling can't be used again
+	u = m.RetrieveUser(u.ID)
+	assert.Equal(t, ErrInvalidSecondFactor, m.CheckSecondFactor(u, code))
+
+	// Recovery codes work once, and are stored hashed
+	var stored RecoveryCode
+	m.Db.First(&stored)
+	assert.NotContains(t, stored.HashedValue, codes[0][:4])
+	assert.NoError(t, m.CheckSecondFactor(u, " "+codes[0]+" "))
+	assert.Equal(t, ErrInvalidSecondFactor, m.CheckSecondFactor(u, codes[0]))
+	assert.NoError(t, m.CheckSecondFactor(u, "  "+codes[1][:4]+codes[1][5:]))
+	assert.Equal(t, RecoveryCodesCount-2, m.RemainingRecoveryCodes(u))
+
+	// Regenerating the codes invalidates the old ones
+	newCodes, err := m.RegenerateRecoveryCodes(u)
+	assert.NoError(t, err)
+	assert.Equal(t, RecoveryCodesCount, m.RemainingRecoveryCodes(u))
+	assert.Equal(t, ErrInvalidSecondFactor, m.CheckSecondFactor(u, codes[2]))
+	assert.NoError(t, m.CheckSecondFactor(u, newCodes[2]))
+
+	assert.NoError(t, m.DisableTOTP(u))
+	u = m.RetrieveUser(u.ID)
+	assert.False(t, u.TOTPEnabled)
+	assert.Empty(t, u.TOTPSecret)
+	assert.Equal(t, 0, m.RemainingRecoveryCodes(u))
+}
@@ -0,0 +1,109 @@
+package model
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// DeletePage moves a page to the trash. The page is soft-deleted, so it is
+// hidden everywhere but can still be restored.
+func (m *Model) DeletePage(p *Page, u *User, reason string) error {
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		return deletePage(tx, p, u, reason)
+	})
+}
+
+// deletePage moves a page to the trash within the transaction tx
+func deletePage(tx *gorm.DB, p *Page, u *User, reason string) error {
+	var userID uint
+	if u != nil {
+		userID = u.ID
+	}
+
+	now := gorm.NowFunc()
+	err := tx.Model(&Page{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
+		"deleted_at":      now,
+		"deletion_reason": reason,
+		"deleted_by_id":   userID,
+	}).Error
+	if err != nil {
+		return err
+	}
+	if err := audit(tx, AuditPageDeleted, u, AuditEntry{PageID: p.ID, Details: reason}); err != nil {
+		return err
+	}
+	p.DeletedAt = &now
+	p.DeletionReason = reason
+	p.DeletedByID = userID
+	return nil
+}
+
+// DeletedPages returns the pages in the trash, most recently deleted first
+func (m *Model) DeletedPages() ([]Page, error) {
+	var pages []Page
+	res := m.Db.Unscoped().
+		Preload("DeletedBy").
+		Where("deleted_at IS NOT NULL").
+		Order("deleted_at desc").
+		Find(&pages)
+	return pages, res.Error
+}
+
+// FindDeletedPage returns a page in the trash by ID or nil
+func (m *Model) FindDeletedPage(id uint) *Page {
+	var page Page
+	res := m.Db.Unscoped().First(&page, "id = ? and deleted_at IS NOT NULL", id)
+	if res.Error != nil {
+		return nil
+	}
+	return &page
+}
+
+// RestorePage takes a page out of the trash. u, who restores it, may be nil.
+func (m *Model) RestorePage(p *Page, u *User) error {
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		return restorePage(tx, p, u)
+	})
+}
+
+// restorePage takes a page out of the trash within the transaction tx
+func restorePage(tx *gorm.DB, p *Page, u *User) error {
+	err := tx.Unscoped().Model(&Page{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
+		"deleted_at":      nil,
+		"deletion_reason": "",
+		"deleted_by_id":   0,
+	}).Error
+	if err != nil {
+		return err
+	}
+	if err := audit(tx, AuditPageRestored, u, AuditEntry{PageID: p.ID}); err != nil {
+		return err
+	}
+	p.DeletedAt = nil
+	p.DeletionReason = ""
+	p.DeletedByID = 0
+	return nil
+}
+
+// PurgePage permanently removes a page, along with its versions, old slugs,
+// maintainers, ownership requests and history, and block rollbacks.
+// u, who purges it, may be nil.
+func (m *Model) PurgePage(p *Page, u *User) error {
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("page_id = ?", p.ID).Delete(ContentVersion{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("page_id = ?", p.ID).Delete(PageSlug{}).Error; err != nil {
+			return err
+		}
+		for _, related := range []interface{}{PageMaintainer{}, OwnershipClaim{}, OwnershipTransfer{}, OwnershipChange{}, BlockRollback{}} {
+			if err := tx.Unscoped().Where("page_id = ?", p.ID).Delete(related).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Delete(p).Error; err != nil {
+			return err
+		}
+		// The page is gone, so its title is kept in the log
+		return audit(tx, AuditPagePurged, u, AuditEntry{PageID: p.ID, Details: p.Title})
+	})
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteRestorePurge(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+
+	admin := m.registerTestAdmin()
+	p := &Page{Content: "Ciao", Type: PageCompany, Title: "Example company"}
+	assert.NoError(t, m.SavePage(p, admin))
+
+	stats, err := m.GetSiteStats()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.NCompanies)
+
+	// Deleted pages disappear from listings and stats
+	assert.NoError(t, m.DeletePage(p, admin, "duplicate"))
+	assert.Nil(t, m.FindPage(p.ID, PageCompany))
+
+	pages, err := m.GetPagesOfType(PageCompany)
+	assert.NoError(t, err)
+	assert.Empty(t, pages)
+
+	stats, err = m.GetSiteStats()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.NCompanies)
+
+	trash, err := m.DeletedPages()
+	assert.NoError(t, err)
+	assert.Len(t, trash, 1)
+	assert.Equal(t, "duplicate", trash[0].DeletionReason)
+	assert.Equal(t, admin.ID, trash[0].DeletedBy.ID)
+
+	// Restored pages are back
+	deleted := m.FindDeletedPage(p.ID)
+	assert.NotNil(t, deleted)
+	assert.NoError(t, m.RestorePage(deleted, nil))
+	assert.NotNil(t, m.FindPage(p.ID, PageCompany))
+	assert.Nil(t, m.FindDeletedPage(p.ID))
+
+	// Purged pages are gone with their versions
+	assert.NoError(t, m.DeletePage(p, admin, ""))
+	assert.NoError(t, m.PurgePage(p, nil))
+	assert.Nil(t, m.FindDeletedPage(p.ID))
+
+	var count int
+	m.Db.Unscoped().Model(&ContentVersion{}).Where("page_id = ?", p.ID).Count(&count)
+	assert.Zero(t, count)
+}
@@ -3,6 +3,8 @@ package model
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"strings"
 
 	"github.com/jinzhu/gorm"
 	"golang.org/x/crypto/scrypt"
@@ -15,18 +17,19 @@ type User struct {
 	Salt           string
 	Email          *string `gorm:"unique"`
 	EmailVerified  bool
-	FacebookID     *string `gorm:"unique"`
-	Role           string
+	Role           string // one of Roles, empty for RoleUser
 	SessionToken   string //set when the password is changed, used to log a user out of all sessions
-}
 
-func (m *Model) RetrieveUserFB(facebookid string) *User {
-	var u User
-	res := m.Db.First(&u, "facebook_id = ?", facebookid)
-	if res.Error != nil {
-		return nil
-	}
-	return &u
+	// New email chosen by the user, replacing Email once confirmed (see RequestEmailChange)
+	PendingEmail *string
+
+	// Two-factor authentication, see EnableTOTP
+	TOTPSecret      string `gorm:"column:totp_secret;not null;default:''"`
+	TOTPEnabled     bool   `gorm:"column:totp_enabled;not null;default:false"`
+	TOTPLastCounter int64  `gorm:"column:totp_last_counter;not null;default:0"` // counter of the last code used, to refuse replays
+
+	// Blocked users can't log in, nor do anything on the site (see SetBlocked)
+	Blocked bool `gorm:"not null;default:false"`
 }
 
 func (m *Model) SaveUser(user *User) error {
@@ -36,69 +39,81 @@ func (m *Model) SaveUser(user *User) error {
 	return m.Db.Save(user).Error
 }
 
-func (m *Model) LoginOrCreateFB(currentUser *User, facebookID string, name string, maybeEmail *string) (*User, error) {
-	// if that facebookID is already in the system, we want to log the user in with that
-	existingFacebookUser := m.RetrieveUserFB(facebookID)
-	if existingFacebookUser != nil {
-		// Update user email if needed. Mark it as verified
-		if maybeEmail != nil {
-			if existingFacebookUser.Email != maybeEmail {
-				existingFacebookUser.Email = maybeEmail
-			}
-			existingFacebookUser.EmailVerified = true
-			err := m.SaveUser(existingFacebookUser)
-			if err != nil {
-				return nil, err
-			}
+// ChangePassword sets a new password for u, who is logged out of their other sessions
+func (m *Model) ChangePassword(u *User, password string) error {
+	u.SetPassword(password)
+	return m.Db.Transaction(func(tx *gorm.DB) error {
+		if err := New(tx).SaveUser(u); err != nil {
+			return err
 		}
-		return existingFacebookUser, nil
-	}
+		return audit(tx, AuditPasswordChanged, u, AuditEntry{UserID: u.ID})
+	})
+}
 
-	// If the facebookID is new for us, but we are already logged in
-	// then we want to add the facebook data to the existing profile
-	if currentUser != nil {
-		currentUser.FacebookID = &facebookID
-		err := m.SaveUser(currentUser)
-		if err != nil {
-			return nil, err
-		}
-		return currentUser, nil
-	}
-
-	// If we are not logged in, and the facebookID is new, then we want to
-	// check if the user is already registered by his facebook mail
-	if maybeEmail != nil {
-		var existingEmailUser User
-		err := m.Db.First(&existingEmailUser, "email = ? and email_verified = 1", maybeEmail).Error
-		if err == nil {
-			existingEmailUser.FacebookID = &facebookID
-			existingEmailUser.EmailVerified = true
-
-			err = m.SaveUser(&existingEmailUser)
-			if err != nil {
-				return nil, err
-			}
-		}
-	}
+// ErrSameEmail is returned by RequestEmailChange when the email is already the user's one
+var ErrSameEmail = errors.New("the email is not changed")
 
-	// We are not logged in, and both the facebookID and the mail are not
-	// in our system, we create a new User
-	newUser := &User{
-		Username:   name,
-		FacebookID: &facebookID,
-		Role:       "user",
+// emailTakenByOthers tells if a user other than u has the given email
+func emailTakenByOthers(db *gorm.DB, u *User, email string) bool {
+	var count int
+	db.Model(&User{}).Where("lower(email) = lower(?) and id <> ?", email, u.ID).Count(&count)
+	return count > 0
+}
+
+// RequestEmailChange sets the pending email of u. The current email is kept
+// until the new one is confirmed with ConfirmEmailChange.
+func (m *Model) RequestEmailChange(u *User, email string) error {
+	email = strings.TrimSpace(email)
+	if !ValidEmail(email) {
+		return ErrInvalidEmail
+	}
+	if u.Email != nil && strings.EqualFold(*u.Email, email) {
+		return ErrSameEmail
 	}
+	if emailTakenByOthers(m.Db, u, email) {
+		return ErrEmailTaken
+	}
+
+	u.PendingEmail = &email
+	return m.Db.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("pending_email", email).Error
+}
+
+// CancelEmailChange forgets the pending email of u
+func (m *Model) CancelEmailChange(u *User) error {
+	u.PendingEmail = nil
+	return m.Db.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("pending_email", gorm.Expr("NULL")).Error
+}
 
-	if maybeEmail != nil {
-		newUser.Email = maybeEmail
-		newUser.EmailVerified = true
+// ConfirmEmailChange replaces the email of u with the pending one, which is now verified.
+// ErrEmailTaken is returned if someone else registered the email meanwhile.
+func (m *Model) ConfirmEmailChange(u *User) error {
+	if u.PendingEmail == nil {
+		return errors.New("no pending email to confirm")
 	}
+	email := *u.PendingEmail
 
-	err := m.SaveUser(newUser)
+	err := m.Db.Transaction(func(tx *gorm.DB) error {
+		if emailTakenByOthers(tx, u, email) {
+			return ErrEmailTaken
+		}
+		err := tx.Model(&User{}).Where("id = ?", u.ID).UpdateColumns(map[string]interface{}{
+			"email":          email,
+			"email_verified": true,
+			"pending_email":  gorm.Expr("NULL"),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return audit(tx, AuditEmailChanged, u, AuditEntry{UserID: u.ID, Details: email})
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return newUser, nil
+
+	u.Email = &email
+	u.EmailVerified = true
+	u.PendingEmail = nil
+	return nil
 }
 
 func (m *Model) UserPage(u *User) *Page {
@@ -110,6 +125,13 @@ func (m *Model) UserPage(u *User) *Page {
 	return &page
 }
 
+// OwnedPages returns the approved pages owned by u, ordered by title
+func (m *Model) OwnedPages(u *User) ([]Page, error) {
+	var pages []Page
+	res := m.Db.Order("title").Find(&pages, "owner_id = ? and approved_version_id <> 0", u.ID)
+	return pages, res.Error
+}
+
 func (m *Model) RetrieveUser(id uint) *User {
 	var u User
 	res := m.Db.First(&u, "id = ?", id)
@@ -119,9 +141,19 @@ func (m *Model) RetrieveUser(id uint) *User {
 	return &u
 }
 
+// RetrieveUserByUsername returns the user with the given username, or nil
+func (m *Model) RetrieveUserByUsername(username string) *User {
+	var u User
+	res := m.Db.First(&u, "username = ?", username)
+	if res.Error != nil {
+		return nil
+	}
+	return &u
+}
+
 func (m *Model) LoginEmail(email string, password string) *User {
 	var u User
-	res := m.Db.First(&u, "email=?", email)
+	res := m.Db.First(&u, "lower(email) = lower(?)", email)
 	if res.Error != nil {
 		return nil
 	}
@@ -166,6 +198,11 @@ func (u *User) CheckPassword(password string) bool {
 	return HashPassword(password, []byte(u.Salt)) == u.HashedPassword
 }
 
+// HasPasswordLogin tells if the user can log in with their email and password
+func (u *User) HasPasswordLogin() bool {
+	return u.HashedPassword != "" && u.Email != nil
+}
+
 func HashPassword(password string, salt []byte) string {
 	dk, err := scrypt.Key([]byte(password), salt, 32768, 8, 1, 32)
 	if err != nil {
@@ -173,9 +210,3 @@ func HashPassword(password string, salt []byte) string {
 	}
 	return hex.EncodeToString(dk)
 }
-
-/* For future use
-func (m *Model) MakeAdminByMail(email string, role string) (int64, error) {
-	res := m.Db.Exec("UPDATE users SET role=? WHERE email=?", role, email)
-	return res.RowsAffected, res.Error
-} */
@@ -44,3 +44,57 @@ func TestDB_Login(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, u5)
 }
+
+func TestOwnedPages(t *testing.T) {
+	m := New(ConnectTestDB())
+	defer m.Close()
+	admin := m.registerTestAdmin()
+	other, err := m.RegisterEmail("other", "other@example.com", "password", "")
+	assert.Nil(t, err)
+
+	owned := &Page{Title: "Owned", Type: PageCompany, OwnerID: admin.ID}
+	assert.Nil(t, m.SavePage(owned, admin))
+	// Not approved, as other can't approve edits to it
+	pending := &Page{Title: "Pending", Type: PageCompany, OwnerID: admin.ID}
+	assert.Nil(t, m.SavePage(pending, other))
+	assert.Nil(t, m.SavePage(&Page{Title: "Unowned", Type: PageCompany}, admin))
+
+	pages, err := m.OwnedPages(admin)
+	assert.Nil(t, err)
+	if assert.Len(t, pages, 1) {
+		assert.Equal(t, owned.ID, pages[0].ID)
+	}
+}
+
+func TestEmailChange(t *testing.T) {
+	m := New(ConnectTestDB())
+	admin := m.registerTestAdmin()
+	u, err := m.RegisterEmail("other", "other@example.com", "password", "")
+	assert.Nil(t, err)
+
+	assert.Equal(t, ErrInvalidEmail, m.RequestEmailChange(u, "invalid"))
+	assert.Equal(t, ErrSameEmail, m.RequestEmailChange(u, "Other@example.com"))
+	assert.Equal(t, ErrEmailTaken, m.RequestEmailChange(u, *admin.Email))
+
+	// The old email is kept until the new one is confirmed
+	assert.Nil(t, m.RequestEmailChange(u, "new@example.com"))
+	u = m.RetrieveUser(u.ID)
+	assert.Equal(t, "other@example.com", *u.Email)
+	assert.Equal(t, "new@example.com", *u.PendingEmail)
+	assert.NotNil(t, m.LoginEmail("other@example.com", "password"))
+
+	assert.Nil(t, m.ConfirmEmailChange(u))
+	u = m.RetrieveUser(u.ID)
+	assert.Equal(t, "new@example.com", *u.Email)
+	assert.True(t, u.EmailVerified)
+	assert.Nil(t, u.PendingEmail)
+
+	// Emails registered by someone else meanwhile can't be confirmed
+	assert.Nil(t, m.RequestEmailChange(u, "taken@example.com"))
+	_, err = m.RegisterEmail("third", "taken@example.com", "password", "")
+	assert.Nil(t, err)
+	assert.Equal(t, ErrEmailTaken, m.ConfirmEmailChange(u))
+
+	assert.Nil(t, m.CancelEmailChange(u))
+	assert.Nil(t, m.RetrieveUser(u.ID).PendingEmail)
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/labstack/echo-contrib/session"
 
@@ -16,13 +17,13 @@ func (ctl *Controller) SendEmailVerification(u *model.User) error {
 		return fmt.Errorf("Can't verify mail, no mail set for user")
 	}
 
-	token, err := ctl.model.CreateToken(u.ID, 18)
+	token, err := ctl.model.CreateToken(u.ID, model.TokenEmailConfirmation)
 	if err != nil {
 		fmt.Println("Could not create token")
 		return err
 	}
 
-	confirmationurl := ctl.appURL + "/confirmMail?token=" + token
+	confirmationurl := ctl.appURL + "/confirmMail?token=" + url.QueryEscape(token)
 
 	err = ctl.mailer.SendMail(mail.ConfirmationEmail(u.Username, *u.Email, confirmationurl))
 	if err != nil {
@@ -39,8 +40,11 @@ func (ctl *Controller) mailVerificationH(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
 	}
 
-	t, err := ctl.model.GetToken(tokenValue)
-	if err != nil {
+	// The token is deleted as it is retrieved, so that it can't be used again
+	t, err := ctl.model.ConsumeToken(tokenValue, model.TokenEmailConfirmation)
+	if err == model.ErrInvalidToken {
+		return echo.NewHTTPError(http.StatusNotFound, "The link is invalid or has expired")
+	} else if err != nil {
 		c.Logger().Error("Could not find valid token")
 		return err
 	}
@@ -58,12 +62,6 @@ func (ctl *Controller) mailVerificationH(c echo.Context) error {
 		return err
 	}
 
-	err = ctl.model.DeleteToken(tokenValue)
-	if err != nil {
-		c.Logger().Error("Could not delete the token after use")
-		return err
-	}
-
 	s, err := session.Get("session", c)
 	if err != nil {
 		return err
@@ -73,3 +71,75 @@ func (ctl *Controller) mailVerificationH(c echo.Context) error {
 
 	return c.Redirect(http.StatusFound, "/")
 }
+
+// SendEmailChangeConfirmation sends a confirmation link to the pending email of u,
+// and tells the current email, if any, about the change
+func (ctl *Controller) SendEmailChangeConfirmation(u *model.User) error {
+	if u.PendingEmail == nil {
+		return fmt.Errorf("Can't confirm email change, no pending email for user")
+	}
+
+	// Only the link sent to the latest pending email is valid
+	if err := ctl.model.DeleteUserTokens(u.ID, model.TokenEmailChange); err != nil {
+		return err
+	}
+	token, err := ctl.model.CreateToken(u.ID, model.TokenEmailChange)
+	if err != nil {
+		return err
+	}
+
+	confirmationurl := ctl.appURL + "/confirmEmailChange?token=" + url.QueryEscape(token)
+	err = ctl.mailer.SendMail(mail.EmailChangeConfirmationEmail(u.Username, *u.PendingEmail, confirmationurl))
+	if err != nil {
+		return err
+	}
+
+	if u.Email != nil {
+		return ctl.mailer.SendMail(mail.EmailChangeNoticeEmail(u.Username, *u.Email, *u.PendingEmail))
+	}
+	return nil
+}
+
+// emailChangeConfirmationH replaces the email of a user with their pending one
+func (ctl *Controller) emailChangeConfirmationH(c echo.Context) error {
+	t, err := ctl.model.ConsumeToken(c.QueryParam("token"), model.TokenEmailChange)
+	if err == model.ErrInvalidToken {
+		return echo.NewHTTPError(http.StatusNotFound, "The link is invalid or has expired")
+	} else if err != nil {
+		return err
+	}
+
+	u := ctl.model.RetrieveUser(t.Identifier)
+	if u == nil || u.PendingEmail == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "No email change to confirm")
+	}
+
+	err = ctl.model.ConfirmEmailChange(u)
+	if err == model.ErrEmailTaken {
+		setFlash(c, signupErrors[err])
+		return c.Redirect(http.StatusSeeOther, "/me")
+	} else if err != nil {
+		return err
+	}
+
+	setFlash(c, "Nuovo indirizzo email confermato!")
+	return c.Redirect(http.StatusSeeOther, "/me")
+}
+
+// cancelEmailChangeH forgets the pending email of the current user
+func (ctl *Controller) cancelEmailChangeH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	if err := ctl.model.CancelEmailChange(u); err != nil {
+		return err
+	}
+	if err := ctl.model.DeleteUserTokens(u.ID, model.TokenEmailChange); err != nil {
+		return err
+	}
+
+	setFlash(c, "Cambio di indirizzo email annullato")
+	return c.Redirect(http.StatusSeeOther, "/me")
+}
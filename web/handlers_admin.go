@@ -1,26 +1,138 @@
 package web
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/vigliag/isamuni-go/model"
 
 	"github.com/labstack/echo/v4"
 )
 
-func (ctl *Controller) adminH(c echo.Context) error {
+// requirePermission returns a middleware refusing the requests of the users for whom allowed is false
+func (ctl *Controller) requirePermission(allowed func(u *model.User) bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			u := currentUser(c)
+			if u == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+			}
+			if !allowed(u) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Not allowed")
+			}
+			return next(c)
+		}
+	}
+}
+
+// reviewsH lists the edits waiting for review which the current user can approve:
+// all of them for staff, and those to the pages they maintain for owners and co-maintainers
+func (ctl *Controller) reviewsH(c echo.Context) error {
 	u := currentUser(c)
 	if u == nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
 	}
 
-	var unapprovedVersions []model.ContentVersion
-	ctl.model.Db.
-		Preload("Page").
-		Preload("User").
-		Joins("JOIN pages ON pages.id = content_versions.page_id").
-		Where("content_versions.id > pages.approved_version_id").
-		Find(&unapprovedVersions)
+	pending, err := ctl.model.PendingVersions()
+	if err != nil {
+		return err
+	}
+
+	unapprovedVersions := pending
+	if !ctl.model.CanReviewAllEdits(u) {
+		unapprovedVersions = nil
+		for _, cv := range pending {
+			if ctl.model.CanApproveEdits(&cv.Page, u) {
+				unapprovedVersions = append(unapprovedVersions, cv)
+			}
+		}
+	}
+	return c.Render(http.StatusOK, "reviews.html", H{"unapproved": unapprovedVersions})
+}
 
-	return c.Render(http.StatusFound, "admin.html", H{"unapproved": unapprovedVersions})
+// adminH shows the claims of pages waiting for review, and the failed logins
+func (ctl *Controller) adminH(c echo.Context) error {
+	var err error
+	data := H{}
+	if data["claims"], err = ctl.model.PendingClaims(); err != nil {
+		return err
+	}
+	if data["locked"], err = ctl.model.LockedAccounts(time.Now()); err != nil {
+		return err
+	}
+	if data["failedLogins"], err = ctl.model.RecentFailedLogins(50); err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "admin.html", data)
+}
+
+// unlockUserH lets a user locked out by too many failed logins log in again
+func (ctl *Controller) unlockUserH(c echo.Context) error {
+	u := currentUser(c)
+	if !ctl.model.CanManageUsers(u) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Only admins can unlock users")
+	}
+
+	target := ctl.model.RetrieveUser(uint(intParameter(c, "id")))
+	if target == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	if err := ctl.model.UnlockAccount(target, currentUser(c)); err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("Utente %s sbloccato", target.Username))
+	return c.Redirect(http.StatusSeeOther, "/admin")
+}
+
+// reviewVersionH returns a handler that approves or rejects a pending ContentVersion.
+// The reviewer can leave a note, which is saved together with the version.
+func (ctl *Controller) reviewVersionH(approve bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := currentUser(c)
+		if u == nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+		}
+
+		cv := ctl.model.FindVersion(uint(intParameter(c, "id")))
+		if cv == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Version not found")
+		}
+
+		if !ctl.model.CanApproveEdits(&cv.Page, u) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Can't approve edits to this page")
+		}
+
+		note := strings.TrimSpace(c.FormValue("note"))
+
+		if approve {
+			page, err := ctl.model.ApproveVersion(cv, u, note)
+			if err == model.ErrVersionNotPending {
+				return echo.NewHTTPError(http.StatusBadRequest, "Version is not pending review")
+			} else if err != nil {
+				return err
+			}
+
+			if err := ctl.index.IndexPage(page); err != nil {
+				return err
+			}
+			setFlash(c, "Modifica approvata")
+		} else {
+			err := ctl.model.RejectVersion(cv, u, note)
+			if err == model.ErrVersionNotPending {
+				return echo.NewHTTPError(http.StatusBadRequest, "Version is not pending review")
+			} else if err != nil {
+				return err
+			}
+			setFlash(c, "Modifica rifiutata")
+		}
+
+		redirect := c.FormValue("redir")
+		if redirect == "" {
+			redirect = "/reviews"
+		}
+		return c.Redirect(http.StatusSeeOther, localRedirect(redirect))
+	}
 }
@@ -0,0 +1,201 @@
+package web
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/index"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// apiError is the body of the responses of the API in case of errors
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiUser returns the user making a request to the API, if any. Requests
+// authenticated by an access token only act as its user if the token has scope.
+func apiUser(c echo.Context, scope string) *model.User {
+	if t, ok := c.Get("accessToken").(*model.AccessToken); ok && !t.HasScope(scope) {
+		return nil
+	}
+	return currentUser(c)
+}
+
+func isAPIRequest(c echo.Context) bool {
+	path := c.Request().URL.Path
+	return path == "/api" || strings.HasPrefix(path, "/api/")
+}
+
+// apiErrorHandler reports errors of the API as JSON, instead of rendering error.html
+func apiErrorHandler(err error, c echo.Context) {
+	res := apiError{Code: http.StatusInternalServerError}
+	if he, ok := err.(*echo.HTTPError); ok {
+		res.Code = he.Code
+		res.Message = fmt.Sprint(he.Message)
+	}
+	// Internal errors are logged, but their details are not shown
+	if res.Message == "" || res.Code == http.StatusInternalServerError {
+		res.Message = http.StatusText(res.Code)
+	}
+
+	c.Logger().Error(err)
+	if c.Response().Committed {
+		return
+	}
+	if err := c.JSON(res.Code, H{"error": res}); err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// apiJSON sends v as JSON, with an ETag computed from the response body.
+// If the request has a matching If-None-Match header, only 304 Not Modified is sent.
+func apiJSON(c echo.Context, code int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// Responses depend on who is logged in, as unapproved content is only shown to some users
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(body))
+	header := c.Response().Header()
+	header.Set("ETag", etag)
+	header.Add("Vary", "Cookie, Authorization")
+
+	if code == http.StatusOK && etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(code, body)
+}
+
+// etagMatches tells if an If-None-Match header matches etag, ignoring weak validators
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// apiSearchHit is a hit of a search, as returned by the API
+type apiSearchHit struct {
+	ID        uint                `json:"id"`
+	Type      string              `json:"type"`
+	Title     string              `json:"title"`
+	Slug      string              `json:"slug"`
+	URL       string              `json:"url"`
+	Short     string              `json:"short"`
+	City      string              `json:"city"`
+	Sector    string              `json:"sector"`
+	Fragments map[string][]string `json:"fragments"`
+}
+
+type apiSearchResponse struct {
+	Query   string            `json:"query"`
+	Filters map[string]string `json:"filters"`
+	Total   uint64            `json:"total"`
+	Page    int               `json:"page"`
+	Pages   int               `json:"pages"`
+	Hits    []apiSearchHit    `json:"hits"`
+	Facets  []index.Facet     `json:"facets"`
+	// URLs of the previous and the next pages of results, empty on the first and the last page
+	Prev string `json:"prev"`
+	Next string `json:"next"`
+}
+
+// apiSearchURL returns the url of a page of results of the search API
+func apiSearchURL(query string, filters map[string]string, page int) string {
+	values := url.Values{}
+	if query != "" {
+		values.Set("q", query)
+	}
+	for field, value := range filters {
+		values.Set(field, value)
+	}
+	values.Set("page", strconv.Itoa(page))
+	return "/api/search?" + values.Encode()
+}
+
+func (ctl *Controller) apiSearchHit(res index.SearchResult) apiSearchHit {
+	p := res.Page
+	fragments := res.Fragments
+	if fragments == nil {
+		fragments = map[string][]string{}
+	}
+	return apiSearchHit{
+		ID:        p.ID,
+		Type:      p.Type.CatName(),
+		Title:     p.Title,
+		Slug:      p.Slug,
+		URL:       ctl.appURL + PageURL(p),
+		Short:     p.Short,
+		City:      p.City,
+		Sector:    p.Sector,
+		Fragments: fragments,
+	}
+}
+
+// searchAPIH searches the index, like searchH, and returns the results as JSON.
+// Accepts the parameters q (a query string), page, and a filter for each of index.FacetFields.
+func (ctl *Controller) searchAPIH(c echo.Context) error {
+	query := strings.TrimSpace(c.QueryParam("q"))
+	filters := searchFilters(c)
+
+	if err := index.CheckQueryString(query); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid query: "+err.Error())
+	}
+	if ptype := filters["type"]; ptype != "" {
+		if _, ok := pageTypeFromCat(ptype); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid type: "+ptype)
+		}
+	}
+
+	page := 1
+	if p := c.QueryParam("page"); p != "" {
+		var err error
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid page: "+p)
+		}
+	}
+
+	results, err := ctl.index.Search(index.Query{
+		QueryString: query,
+		Filters:     filters,
+		From:        (page - 1) * index.DefaultPageSize,
+		Size:        index.DefaultPageSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	res := apiSearchResponse{
+		Query:   query,
+		Filters: filters,
+		Total:   results.Total,
+		Page:    results.Page(),
+		Pages:   results.Pages(),
+		Hits:    make([]apiSearchHit, 0, len(results.Hits)),
+		Facets:  results.Facets,
+	}
+	for _, hit := range results.Hits {
+		res.Hits = append(res.Hits, ctl.apiSearchHit(hit))
+	}
+	if results.HasPrev() {
+		res.Prev = apiSearchURL(query, filters, page-1)
+	}
+	if results.HasNext() {
+		res.Next = apiSearchURL(query, filters, page+1)
+	}
+
+	return apiJSON(c, http.StatusOK, res)
+}
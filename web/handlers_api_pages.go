@@ -0,0 +1,366 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosimple/slug"
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// apiUserRef identifies a user in the responses of the API
+type apiUserRef struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+}
+
+func newAPIUserRef(u *model.User) *apiUserRef {
+	if u == nil || u.ID == 0 {
+		return nil
+	}
+	return &apiUserRef{ID: u.ID, Username: u.Username}
+}
+
+// apiPage is a page as returned by the API. Content and Sections are only
+// set when a single page is requested.
+type apiPage struct {
+	ID                uint              `json:"id"`
+	Type              string            `json:"type"`
+	Title             string            `json:"title"`
+	Slug              string            `json:"slug"`
+	URL               string            `json:"url"`
+	Short             string            `json:"short"`
+	City              string            `json:"city"`
+	Sector            string            `json:"sector"`
+	Website           string            `json:"website"`
+	OwnerID           uint              `json:"owner_id,omitempty"`
+	Approved          bool              `json:"approved"`
+	ApprovedVersionID uint              `json:"approved_version_id"`
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+	Content           string            `json:"content,omitempty"`
+	Sections          map[string]string `json:"sections,omitempty"`
+}
+
+// apiVersion holds the metadata of a ContentVersion. Content and Sections
+// are only set when a single version is requested.
+type apiVersion struct {
+	ID         uint              `json:"id"`
+	PageID     uint              `json:"page_id"`
+	Author     *apiUserRef       `json:"author"`
+	Status     string            `json:"status"`
+	Current    bool              `json:"current"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Reviewer   *apiUserRef       `json:"reviewer,omitempty"`
+	ReviewNote string            `json:"review_note,omitempty"`
+	ReviewedAt *time.Time        `json:"reviewed_at,omitempty"`
+	RevertOfID uint              `json:"revert_of_id,omitempty"`
+	Content    string            `json:"content,omitempty"`
+	Sections   map[string]string `json:"sections,omitempty"`
+}
+
+// apiProfile is the public data of a user
+type apiProfile struct {
+	ID        uint      `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	// The professional page of the user, if approved
+	Profile *apiPage  `json:"profile"`
+	Pages   []apiPage `json:"pages"`
+}
+
+func (ctl *Controller) newAPIPage(p *model.Page, withContent bool) apiPage {
+	res := apiPage{
+		ID:                p.ID,
+		Type:              p.Type.CatName(),
+		Title:             p.Title,
+		Slug:              p.Slug,
+		URL:               ctl.appURL + PageURL(p),
+		Short:             p.Short,
+		City:              p.City,
+		Sector:            p.Sector,
+		Website:           p.Website,
+		OwnerID:           p.OwnerID,
+		Approved:          p.ApprovedVersionID != 0,
+		ApprovedVersionID: p.ApprovedVersionID,
+		CreatedAt:         p.CreatedAt,
+		UpdatedAt:         p.UpdatedAt,
+	}
+	if withContent {
+		res.Content = p.Content
+		res.Sections = model.ParseContent(p.Content)
+	}
+	return res
+}
+
+func newAPIVersion(page *model.Page, cv *model.ContentVersion, withContent bool) apiVersion {
+	res := apiVersion{
+		ID:         cv.ID,
+		PageID:     cv.PageID,
+		Author:     newAPIUserRef(&cv.User),
+		Status:     cv.Status.String(),
+		Current:    cv.ID == page.ApprovedVersionID,
+		CreatedAt:  cv.CreatedAt,
+		Reviewer:   newAPIUserRef(&cv.Reviewer),
+		ReviewNote: cv.ReviewNote,
+		ReviewedAt: cv.ReviewedAt,
+		RevertOfID: cv.RevertOfID,
+	}
+	if withContent {
+		res.Content = cv.Content
+		res.Sections = model.ParseContent(cv.Content)
+	}
+	return res
+}
+
+// apiPageParameter returns the page identified by the "id" route parameter, by id or slug.
+// Pages without an approved version are only returned to users who can approve edits to them.
+func (ctl *Controller) apiPageParameter(c echo.Context, ptype model.PageType) (*model.Page, error) {
+	page, err := ctl.pageParameter(c, ptype)
+	if err != nil {
+		return nil, err
+	}
+	if page.ApprovedVersionID == 0 && !ctl.model.CanApproveEdits(page, apiUser(c, model.ScopeRead)) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Page not found")
+	}
+	return page, nil
+}
+
+// apiVersionVisible tells if the content of a version can be shown to u.
+// Versions that were never approved are only visible to who can approve them.
+func (ctl *Controller) apiVersionVisible(page *model.Page, cv *model.ContentVersion, u *model.User) bool {
+	return cv.Status == model.VersionApproved || ctl.model.CanApproveEdits(page, u)
+}
+
+// apiPagesH lists the approved pages of a type
+func (ctl *Controller) apiPagesH(ptype model.PageType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		pages, err := ctl.model.GetPagesOfType(ptype)
+		if err != nil {
+			return err
+		}
+
+		res := make([]apiPage, 0, len(pages))
+		for i := range pages {
+			res = append(res, ctl.newAPIPage(&pages[i], false))
+		}
+		return apiJSON(c, http.StatusOK, H{"pages": res})
+	}
+}
+
+// apiPageH returns a page with its content, and the sections parsed from it
+func (ctl *Controller) apiPageH(ptype model.PageType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		page, err := ctl.apiPageParameter(c, ptype)
+		if err != nil {
+			return err
+		}
+		return apiJSON(c, http.StatusOK, ctl.newAPIPage(page, true))
+	}
+}
+
+// apiVersionsH lists the versions of a page, newest first, without their content
+func (ctl *Controller) apiVersionsH(ptype model.PageType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := apiUser(c, model.ScopeRead)
+		page, err := ctl.apiPageParameter(c, ptype)
+		if err != nil {
+			return err
+		}
+
+		versions, err := ctl.model.FindPageVersions(page)
+		if err != nil {
+			return err
+		}
+
+		res := make([]apiVersion, 0, len(versions))
+		for i := range versions {
+			if ctl.apiVersionVisible(page, &versions[i], u) {
+				res = append(res, newAPIVersion(page, &versions[i], false))
+			}
+		}
+		return apiJSON(c, http.StatusOK, H{"versions": res})
+	}
+}
+
+// apiVersionH returns a version of a page, with its content
+func (ctl *Controller) apiVersionH(ptype model.PageType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := apiUser(c, model.ScopeRead)
+		page, err := ctl.apiPageParameter(c, ptype)
+		if err != nil {
+			return err
+		}
+
+		cv := ctl.model.FindPageVersion(page, uint(intParameter(c, "version")))
+		if cv == nil || !ctl.apiVersionVisible(page, cv, u) {
+			return echo.NewHTTPError(http.StatusNotFound, "Version not found")
+		}
+		return apiJSON(c, http.StatusOK, newAPIVersion(page, cv, true))
+	}
+}
+
+// apiUserH returns the public profile of a user, and the pages they own
+func (ctl *Controller) apiUserH(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user ID")
+	}
+	u := ctl.model.RetrieveUser(uint(id))
+	if u == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+
+	owned, err := ctl.model.OwnedPages(u)
+	if err != nil {
+		return err
+	}
+
+	res := apiProfile{
+		ID:        u.ID,
+		Username:  u.Username,
+		CreatedAt: u.CreatedAt,
+		Pages:     make([]apiPage, 0, len(owned)),
+	}
+	for i := range owned {
+		p := ctl.newAPIPage(&owned[i], false)
+		if owned[i].Type == model.PageUser {
+			res.Profile = &p
+		} else {
+			res.Pages = append(res.Pages, p)
+		}
+	}
+	return apiJSON(c, http.StatusOK, res)
+}
+
+// apiPageRequest is the body of the requests creating or editing a page
+type apiPageRequest struct {
+	// Only used when creating a page, one of the urls returned by CatUrl
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	Slug    string `json:"slug"`
+	Content string `json:"content"`
+	// The version the edit is based on. If set, and the page has been changed
+	// since, the edit is refused with 409 Conflict.
+	BaseVersionID uint `json:"base_version_id"`
+}
+
+// apiSaveResponse is returned after saving a page: Version tells if the edit
+// was approved, or is waiting for approval
+type apiSaveResponse struct {
+	Page    apiPage    `json:"page"`
+	Version apiVersion `json:"version"`
+}
+
+// apiWriter returns the user of a request authenticated by an access token with the write scope
+func (ctl *Controller) apiWriter(c echo.Context) (*model.User, error) {
+	t, ok := c.Get("accessToken").(*model.AccessToken)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "An access token is required")
+	}
+	if !t.HasScope(model.ScopeWrite) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "The access token does not have the write scope")
+	}
+	if !ctl.model.IsVerified(&t.User) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "The user must verify their email to edit pages")
+	}
+	return &t.User, nil
+}
+
+// apiCreatePageH creates a page, following the same rules as updatePageH
+func (ctl *Controller) apiCreatePageH(c echo.Context) error {
+	u, err := ctl.apiWriter(c)
+	if err != nil {
+		return err
+	}
+
+	var req apiPageRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	ptype, ok := pageTypeFromCat(req.Type)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid page type")
+	}
+
+	p := model.Page{Type: ptype}
+	if ptype == model.PageUser {
+		if ctl.model.UserPage(u) != nil {
+			return echo.NewHTTPError(http.StatusConflict, "This user has a page already")
+		}
+		p.OwnerID = u.ID
+	}
+
+	return ctl.apiSavePage(c, &p, u, &req, http.StatusCreated)
+}
+
+// apiUpdatePageH saves a new version of a page, following the same rules as updatePageH
+func (ctl *Controller) apiUpdatePageH(c echo.Context) error {
+	u, err := ctl.apiWriter(c)
+	if err != nil {
+		return err
+	}
+
+	var p model.Page
+	if err := ctl.model.Db.First(&p, "id = ?", intParameter(c, "id")).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Page not found")
+	}
+	if !ctl.model.CanEdit(&p, u) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner of this page can edit it")
+	}
+
+	var req apiPageRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Type != "" && req.Type != CatUrl(p.Type) {
+		return echo.NewHTTPError(http.StatusBadRequest, "The type of a page can't be changed")
+	}
+
+	return ctl.apiSavePage(c, &p, u, &req, http.StatusOK)
+}
+
+func (ctl *Controller) apiSavePage(c echo.Context, p *model.Page, u *model.User, req *apiPageRequest, code int) error {
+	p.Title = strings.TrimSpace(req.Title)
+	if p.Title == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "The title is required")
+	}
+	if req.Slug != "" {
+		p.Slug = req.Slug
+	} else {
+		p.Slug = slug.Make(p.Title)
+	}
+	p.Content = req.Content
+	p.BaseVersionID = req.BaseVersionID
+
+	err := ctl.model.SavePage(p, u)
+	if conflict, ok := err.(*model.ConflictError); ok {
+		return echo.NewHTTPError(http.StatusConflict,
+			fmt.Sprintf("The page has been changed since version %d, its newest version is %d", p.BaseVersionID, conflict.Theirs.ID))
+	} else if err != nil {
+		return err
+	}
+
+	if err := ctl.indexStoredPage(p); err != nil {
+		return err
+	}
+
+	stored := ctl.model.FindPage(p.ID, p.Type)
+	if stored == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Saved page not found")
+	}
+	cv := ctl.model.FindPageVersion(stored, p.SavedVersionID)
+	if cv == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Saved version not found")
+	}
+
+	return apiJSON(c, code, apiSaveResponse{
+		Page:    ctl.newAPIPage(stored, true),
+		Version: newAPIVersion(stored, cv, false),
+	})
+}
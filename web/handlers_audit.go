@@ -0,0 +1,104 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// auditPageSize is how many entries are listed in a page of the audit log
+const auditPageSize = 100
+
+// auditDateFormat is the format of the dates used to filter the audit log
+const auditDateFormat = "2006-01-02"
+
+// auditURL returns the url of a page of the audit log, with the filters in values
+func auditURL(values url.Values, page int) string {
+	filters := url.Values{}
+	for key, value := range values {
+		if key != "page" && value[0] != "" {
+			filters.Set(key, value[0])
+		}
+	}
+	if page > 1 {
+		filters.Set("page", strconv.Itoa(page))
+	}
+	if len(filters) == 0 {
+		return "/admin/audit"
+	}
+	return "/admin/audit?" + filters.Encode()
+}
+
+// auditFilter reads the filters of the audit log from the query: "action", "user"
+// (the username of who did the action or was acted upon), "page_id", and the dates
+// "since" and "until", both included. "page" is the page of results, not a filter.
+func (ctl *Controller) auditFilter(c echo.Context) (model.AuditFilter, error) {
+	filter := model.AuditFilter{Action: c.QueryParam("action")}
+
+	if username := strings.TrimSpace(c.QueryParam("user")); username != "" {
+		u := ctl.model.RetrieveUserByUsername(username)
+		if u == nil {
+			return filter, fmt.Errorf("L'utente %s non esiste", username)
+		}
+		filter.UserID = u.ID
+	}
+	if page := c.QueryParam("page_id"); page != "" {
+		id, err := strconv.Atoi(page)
+		if err != nil || id <= 0 {
+			return filter, fmt.Errorf("%s non è l'ID di una pagina", page)
+		}
+		filter.PageID = uint(id)
+	}
+	if since := c.QueryParam("since"); since != "" {
+		t, err := time.ParseInLocation(auditDateFormat, since, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("Data non valida: %s", since)
+		}
+		filter.Since = t
+	}
+	if until := c.QueryParam("until"); until != "" {
+		t, err := time.ParseInLocation(auditDateFormat, until, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("Data non valida: %s", until)
+		}
+		filter.Until = t.AddDate(0, 0, 1)
+	}
+	return filter, nil
+}
+
+// auditH lists the entries of the audit log, newest first, filtered as in auditFilter
+func (ctl *Controller) auditH(c echo.Context) error {
+	query := c.QueryParams()
+	data := H{"actions": model.AuditActions, "query": query}
+
+	filter, err := ctl.auditFilter(c)
+	if err != nil {
+		data["error"] = err.Error()
+		return c.Render(http.StatusBadRequest, "adminAudit.html", data)
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	entries, total, err := ctl.model.AuditLog(filter, auditPageSize, (page-1)*auditPageSize)
+	if err != nil {
+		return err
+	}
+
+	if page > 1 {
+		data["prevURL"] = auditURL(query, page-1)
+	}
+	if page*auditPageSize < total {
+		data["nextURL"] = auditURL(query, page+1)
+	}
+	data["entries"] = entries
+	data["total"] = total
+	return c.Render(http.StatusOK, "adminAudit.html", data)
+}
@@ -1,56 +1,101 @@
 package web
 
 import (
-	"context"
-	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/vigliag/isamuni-go/model"
 
-	"github.com/spf13/viper"
-
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/facebook"
 )
 
 const SESSION_TOKEN_KEY string = "session_token"
 
-func facebookOauthConfig() *oauth2.Config {
-	clientID := viper.GetString("FB_CLIENT_ID")
-	clientSecret := viper.GetString("FB_CLIENT_SECRET")
-	redirectURL := viper.GetString("APP_URL") + "/oauth/fb"
+// reauthWindow is how long after logging in users can perform sensitive
+// actions, like linking a new login method, without logging in again
+var reauthWindow = 10 * time.Minute
 
-	return &oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		Scopes:       []string{"email"},
-		Endpoint:     facebook.Endpoint,
-		RedirectURL:  redirectURL,
+// recentlyAuthenticated tells if the user of the session logged in within reauthWindow
+func recentlyAuthenticated(c echo.Context) bool {
+	sess, err := session.Get("session", c)
+	if err != nil {
+		return false
 	}
+	authTime, ok := sess.Values["auth_time"].(int64)
+	return ok && time.Since(time.Unix(authTime, 0)) < reauthWindow
 }
 
-func (ctl *Controller) redirectToFacebookLogin(c echo.Context) error {
-	state := model.GenRandomString(18)
+// reauthURL is the login page asking the current user to log in again, before going to redir
+func reauthURL(redir string) string {
+	return "/login?" + url.Values{"reauth": {"1"}, "redir": {redir}}.Encode()
+}
+
+// localRedirect returns redir if it is a path on this site, and "/" otherwise
+func localRedirect(redir string) string {
+	if !strings.HasPrefix(redir, "/") || strings.HasPrefix(redir, "//") || strings.HasPrefix(redir, "/\\") {
+		return "/"
+	}
+	return redir
+}
+
+// loginProvider returns the login provider enabled with the given name, or nil
+func (ctl *Controller) loginProvider(name string) *OAuthProvider {
+	for _, p := range ctl.providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// callbackProvider returns the login provider redirecting users back to /oauth/<path>, or nil
+func (ctl *Controller) callbackProvider(path string) *OAuthProvider {
+	for _, p := range ctl.providers {
+		if p.CallbackPath == path {
+			return p
+		}
+	}
+	return nil
+}
+
+func (ctl *Controller) redirectToProviderLogin(c echo.Context) error {
+	provider := ctl.loginProvider(c.Param("provider"))
+	if provider == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown login provider")
+	}
+
+	// The state is bound to this session, and can only be used once
+	state, err := ctl.model.CreateToken(0, model.TokenOAuthState)
+	if err != nil {
+		return err
+	}
+
+	url, err := provider.AuthCodeURL(c.Request().Context(), state)
+	if err != nil {
+		return err
+	}
 
 	sess, _ := session.Get("session", c)
 	sess.Values["oauth_state"] = state
+	sess.Values["oauth_provider"] = provider.Name
+	sess.Values["oauth_redir"] = localRedirect(c.QueryParam("redir"))
 	sess.Save(c.Request(), c.Response())
 
-	url := facebookOauthConfig().AuthCodeURL(state, oauth2.AccessTypeOnline)
 	return c.Redirect(http.StatusSeeOther, url)
 }
 
-type facebookUserData struct {
-	ID    string  `json:"id"`
-	Email *string `json:"email"`
-	Name  string  `json:"name"`
-}
+// User is redirected back to our site after logging in with the provider
+func (ctl *Controller) completeProviderLogin(c echo.Context) error {
+	provider := ctl.callbackProvider(c.Param("provider"))
+	if provider == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown login provider")
+	}
 
-// User is redirected back to our site after accepting Facebook's permission dialog
-func (ctl *Controller) completeFacebookLogin(c echo.Context) error {
 	code := c.FormValue("code")
 	state := c.FormValue("state")
 
@@ -59,59 +104,62 @@ func (ctl *Controller) completeFacebookLogin(c echo.Context) error {
 	if !ok {
 		return echo.ErrUnauthorized
 	}
+	savedProvider := sess.Values["oauth_provider"]
+	redirect, _ := sess.Values["oauth_redir"].(string)
 
 	delete(sess.Values, "oauth_state")
+	delete(sess.Values, "oauth_provider")
+	delete(sess.Values, "oauth_redir")
 	sess.Save(c.Request(), c.Response())
 
-	if state != savedState {
+	if state != savedState || savedProvider != provider.Name {
 		return echo.ErrUnauthorized
 	}
-
-	// At this point we have a valid response
-	// and we can continue with handling the login
-	ctx := context.Background()
-	conf := facebookOauthConfig()
-
-	// Obtain the token for the user
-	tok, err := conf.Exchange(ctx, code)
-	if err != nil {
-		return err
+	if _, err := ctl.model.ConsumeToken(state, model.TokenOAuthState); err != nil {
+		return echo.ErrUnauthorized
 	}
 
-	// At this point the user is successfully authenticated
-	// We can fetch his profile
-	client := conf.Client(ctx, tok)
-	res, err := client.Get("https://graph.facebook.com/me?fields=id,name,email")
+	// At this point we have a valid response, and we can
+	// obtain the account the user logged in with
+	account, err := provider.Account(c.Request().Context(), code)
 	if err != nil {
 		return err
 	}
 
-	var fbuser facebookUserData
-
-	jsondata, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
+	// Linking a new account to the current user needs a recent login,
+	// so that it can't be done from a session left open
+	u := currentUser(c)
+	if u != nil && ctl.model.FindIdentity(account.Provider, account.Subject) == nil && !recentlyAuthenticated(c) {
+		setFlash(c, "Per collegare un nuovo account devi prima accedere di nuovo")
+		return c.Redirect(http.StatusSeeOther, reauthURL("/me"))
 	}
 
-	err = json.Unmarshal(jsondata, &fbuser)
+	user, err := ctl.model.LoginOrCreate(u, account)
 	if err != nil {
 		return err
 	}
 
-	user, err := ctl.model.LoginOrCreateFB(currentUser(c), fbuser.ID, fbuser.Name, fbuser.Email)
-	if err != nil {
-		return err
+	// Users who are already logged in don't need to give their second factor again
+	if u != nil && u.ID == user.ID {
+		setSessionUser(c, user)
+		return c.Redirect(http.StatusSeeOther, localRedirect(redirect))
 	}
+	return ctl.logIn(c, user, redirect)
+}
 
+// setSessionUser logs user in, in the session of the request
+func setSessionUser(c echo.Context, user *model.User) {
+	sess, _ := session.Get("session", c)
 	sess.Values["userid"] = user.ID
 	sess.Values[SESSION_TOKEN_KEY] = user.SessionToken
+	sess.Values["auth_time"] = time.Now().Unix()
 	sess.Save(c.Request(), c.Response())
-	return c.Redirect(http.StatusSeeOther, "/")
 }
 
 func (ctl *Controller) loginPage(c echo.Context) error {
 	redirParam := c.QueryParam("redir")
-	c.Render(200, "login.html", H{"redir": redirParam})
+	reauth := c.QueryParam("reauth") != ""
+	c.Render(200, "login.html", H{"redir": redirParam, "reauth": reauth, "providers": ctl.providers})
 	return nil
 }
 
@@ -119,6 +167,7 @@ func (ctl *Controller) logout(c echo.Context) error {
 	sess, _ := session.Get("session", c)
 	delete(sess.Values, "userid")
 	delete(sess.Values, SESSION_TOKEN_KEY)
+	delete(sess.Values, "auth_time")
 	sess.Save(c.Request(), c.Response())
 	return c.Redirect(http.StatusSeeOther, "/")
 }
@@ -135,27 +184,52 @@ func (ctl *Controller) loginWithEmail(c echo.Context) error {
 
 	if email == "" || password == "" {
 		c.Logger().Error("Empty email or password")
-		return c.Render(http.StatusBadRequest, tplName, H{"error": "Empty email or password"})
+		return c.Render(http.StatusBadRequest, tplName, H{"error": "Empty email or password", "providers": ctl.providers})
+	}
+
+	// Checking a password is expensive, so throttled attempts are refused before that
+	ip := c.RealIP()
+	if err := ctl.model.LoginAllowed(ip, email, time.Now()); err != nil {
+		return ctl.renderThrottled(c, tplName, err)
 	}
 
 	user := ctl.model.LoginEmail(email, password)
 	if user == nil {
 		c.Logger().Error("Invalid email or password")
-		return c.Render(http.StatusNotFound, tplName, H{"error": "Invalid email or password"})
+		if err := ctl.model.RecordLoginFailure(ip, email, "password", time.Now()); err != nil {
+			return err
+		}
+		return c.Render(http.StatusNotFound, tplName, H{"error": "Invalid email or password", "providers": ctl.providers})
 	}
 
-	sess, _ := session.Get("session", c)
-	sess.Values["userid"] = user.ID
-	sess.Values[SESSION_TOKEN_KEY] = user.SessionToken
-	sess.Save(c.Request(), c.Response())
+	return ctl.logIn(c, user, redirect)
+}
+
+// renderThrottled refuses an attempt to log in, after too many failed ones
+func (ctl *Controller) renderThrottled(c echo.Context, tplName string, err error) error {
+	throttled, ok := err.(*model.LoginThrottledError)
+	if !ok {
+		return err
+	}
+
+	wait := time.Until(throttled.RetryAt).Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)))
 
-	return c.Redirect(http.StatusSeeOther, redirect)
+	message := fmt.Sprintf("Troppi tentativi di accesso falliti, riprova tra %s", wait)
+	if throttled.Locked {
+		message = "L'accesso è bloccato temporaneamente per troppi tentativi falliti. Riprova più tardi, oppure contatta un amministratore"
+	}
+	return c.Render(http.StatusTooManyRequests, tplName, H{"error": message, "providers": ctl.providers})
 }
 
 func (ctl *Controller) setCurrentUserMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// If there is no session, or the user is not logged in
 		// then continue without setting the current user
+		c.Set("can", ctl.model.Permissions(nil))
 		sess, err := session.Get("session", c)
 		if err != nil || sess.Values["userid"] == nil {
 			return next(c)
@@ -165,12 +239,57 @@ func (ctl *Controller) setCurrentUserMiddleware(next echo.HandlerFunc) echo.Hand
 		user := ctl.model.RetrieveUser(sess.Values["userid"].(uint))
 
 		// If the session has been expired (for example as a result of a password change)
-		// then log out the user
-		if user == nil || (user.SessionToken != "" && user.SessionToken != sess.Values[SESSION_TOKEN_KEY]) {
+		// or the user has been blocked, then log out the user
+		if user == nil || user.Blocked || (user.SessionToken != "" && user.SessionToken != sess.Values[SESSION_TOKEN_KEY]) {
 			return ctl.logout(c)
 		}
 
-		c.Set("currentUser", user)
+		ctl.setCurrentUser(c, user)
+
+		if ctl.mustEnrollTwoFactor(user) && !twoFactorEnrollmentPath(c.Path()) {
+			setFlash(c, "Per continuare devi attivare la verifica in due passaggi")
+			return c.Redirect(http.StatusSeeOther, "/me/2fa")
+		}
+		return next(c)
+	}
+}
+
+// bearerToken returns the token in the Authorization header of a request, if any
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// HasBearerToken tells if a request to the API is authenticated by an access token.
+// Those requests do not rely on cookies, so they don't need CSRF protection.
+func HasBearerToken(c echo.Context) bool {
+	_, ok := bearerToken(c.Request())
+	return ok && isAPIRequest(c)
+}
+
+// accessTokenMiddleware authenticates the requests carrying a personal access token
+// in their Authorization header. The user of the token replaces the one of the session,
+// and the token is put in the context, so that handlers can check its scopes.
+func (ctl *Controller) accessTokenMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		value, ok := bearerToken(c.Request())
+		if !ok {
+			return next(c)
+		}
+
+		t, err := ctl.model.AuthenticateAccessToken(value)
+		if err == model.ErrInvalidAccessToken {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid access token")
+		} else if err != nil {
+			return err
+		}
+
+		ctl.setCurrentUser(c, &t.User)
+		c.Set("accessToken", t)
 		return next(c)
 	}
 }
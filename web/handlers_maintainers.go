@@ -0,0 +1,72 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// maintainedPage returns the page of the request, if the current user can manage its maintainers
+func (ctl *Controller) maintainedPage(c echo.Context) (*model.Page, error) {
+	u := currentUser(c)
+	if u == nil {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	p, err := ctl.pageByID(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ctl.model.CanManageMaintainers(p, u) {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Can't manage the maintainers of this page")
+	}
+	return p, nil
+}
+
+// addMaintainerH makes the user with the given username a co-maintainer of the page
+func (ctl *Controller) addMaintainerH(c echo.Context) error {
+	p, err := ctl.maintainedPage(c)
+	if err != nil {
+		return err
+	}
+
+	username := strings.TrimSpace(c.FormValue("username"))
+	maintainer := ctl.model.RetrieveUserByUsername(username)
+	if maintainer == nil {
+		setFlash(c, fmt.Sprintf("L'utente %s non esiste", username))
+		return c.Redirect(http.StatusSeeOther, PageURL(p))
+	}
+
+	err = ctl.model.AddMaintainer(p, maintainer, currentUser(c))
+	if err == model.ErrOwnerMaintainer {
+		setFlash(c, "Il proprietario della pagina non può esserne anche co-curatore")
+		return c.Redirect(http.StatusSeeOther, PageURL(p))
+	} else if err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("%s è ora co-curatore della pagina", maintainer.Username))
+	return c.Redirect(http.StatusSeeOther, PageURL(p))
+}
+
+// removeMaintainerH removes a user from the co-maintainers of the page
+func (ctl *Controller) removeMaintainerH(c echo.Context) error {
+	p, err := ctl.maintainedPage(c)
+	if err != nil {
+		return err
+	}
+
+	maintainer := ctl.model.RetrieveUser(uint(intParameter(c, "user")))
+	if maintainer == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	if err := ctl.model.RemoveMaintainer(p, maintainer, currentUser(c)); err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("%s non è più co-curatore della pagina", maintainer.Username))
+	return c.Redirect(http.StatusSeeOther, PageURL(p))
+}
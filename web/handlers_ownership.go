@@ -0,0 +1,193 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/mail"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// claimPageH asks for the current user to become the owner of a page with no owner
+func (ctl *Controller) claimPageH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+	p, err := ctl.pageByID(c)
+	if err != nil {
+		return err
+	}
+	if !ctl.model.CanClaim(p, u) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Can't claim this page")
+	}
+
+	_, err = ctl.model.ClaimPage(p, u, c.FormValue("justification"))
+	switch err {
+	case nil:
+		setFlash(c, "Richiesta inviata, verrà esaminata da un amministratore")
+	case model.ErrJustificationRequired:
+		setFlash(c, "Spiega perché dovresti essere il proprietario della pagina")
+	case model.ErrClaimPending:
+		setFlash(c, "Hai già richiesto questa pagina, la tua richiesta è in attesa di approvazione")
+	default:
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, PageURL(p))
+}
+
+// reviewClaimH returns a handler that approves or rejects a claim
+func (ctl *Controller) reviewClaimH(approve bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := currentUser(c)
+		if !ctl.model.CanReviewClaims(u) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Only admins can review claims")
+		}
+
+		claim := ctl.model.FindClaim(uint(intParameter(c, "id")))
+		if claim == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Claim not found")
+		}
+
+		note := strings.TrimSpace(c.FormValue("note"))
+		if approve {
+			err := ctl.model.ApproveClaim(claim, u, note)
+			switch err {
+			case nil:
+				setFlash(c, fmt.Sprintf("%s è ora il proprietario di \"%s\"", claim.User.Username, claim.Page.Title))
+			case model.ErrPageOwned:
+				setFlash(c, "La pagina ha già un proprietario")
+			case model.ErrHasUserPage:
+				setFlash(c, "L'utente ha già una pagina personale")
+			case model.ErrRequestNotPending:
+				return echo.NewHTTPError(http.StatusBadRequest, "Claim is not pending")
+			default:
+				return err
+			}
+		} else {
+			err := ctl.model.RejectClaim(claim, u, note)
+			if err == model.ErrRequestNotPending {
+				return echo.NewHTTPError(http.StatusBadRequest, "Claim is not pending")
+			} else if err != nil {
+				return err
+			}
+			setFlash(c, "Richiesta rifiutata")
+		}
+		return c.Redirect(http.StatusSeeOther, "/admin")
+	}
+}
+
+// transferPageH offers the page to the user with the given username, who is notified by email
+func (ctl *Controller) transferPageH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+	p, err := ctl.pageByID(c)
+	if err != nil {
+		return err
+	}
+	if !ctl.model.CanTransfer(p, u) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Only the owner can transfer this page")
+	}
+
+	username := strings.TrimSpace(c.FormValue("username"))
+	recipient := ctl.model.RetrieveUserByUsername(username)
+	if recipient == nil {
+		setFlash(c, fmt.Sprintf("L'utente %s non esiste", username))
+		return c.Redirect(http.StatusSeeOther, PageURL(p))
+	}
+
+	_, err = ctl.model.OfferTransfer(p, u, recipient, c.FormValue("message"))
+	if err == model.ErrSelfTransfer {
+		setFlash(c, "Sei già il proprietario della pagina")
+		return c.Redirect(http.StatusSeeOther, PageURL(p))
+	} else if err != nil {
+		return err
+	}
+
+	if recipient.Email != nil {
+		err := ctl.mailer.SendMail(mail.PageTransferEmail(recipient.Username, *recipient.Email, u.Username, p.Title, ctl.appURL+"/me"))
+		if err != nil {
+			return err
+		}
+	}
+
+	setFlash(c, fmt.Sprintf("La pagina diventerà di %s quando accetterà il trasferimento", recipient.Username))
+	return c.Redirect(http.StatusSeeOther, PageURL(p))
+}
+
+// setOwnerH lets an admin change the owner of a page to the user with the username given
+// in the "username" form value, or leave the page with no owner if it is empty
+func (ctl *Controller) setOwnerH(c echo.Context) error {
+	p, err := ctl.pageByID(c)
+	if err != nil {
+		return err
+	}
+
+	var owner *model.User
+	if username := strings.TrimSpace(c.FormValue("username")); username != "" {
+		if owner = ctl.model.RetrieveUserByUsername(username); owner == nil {
+			setFlash(c, fmt.Sprintf("L'utente %s non esiste", username))
+			return c.Redirect(http.StatusSeeOther, PageURL(p))
+		}
+	}
+
+	if err := ctl.model.SetPageOwner(p, owner, currentUser(c), strings.TrimSpace(c.FormValue("note"))); err != nil {
+		return err
+	}
+
+	if owner != nil {
+		setFlash(c, fmt.Sprintf("La pagina ora è di %s", owner.Username))
+	} else {
+		setFlash(c, "La pagina ora non ha un proprietario")
+	}
+	return c.Redirect(http.StatusSeeOther, PageURL(p))
+}
+
+// answerTransferH returns a handler with which the recipient of a transfer accepts or
+// declines it, or its owner cancels it, according to action
+func (ctl *Controller) answerTransferH(action string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := currentUser(c)
+		if u == nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+		}
+		transfer := ctl.model.FindTransfer(uint(intParameter(c, "id")))
+		if transfer == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Transfer not found")
+		}
+
+		var err error
+		var message string
+		redirect := "/me"
+		switch action {
+		case "accept":
+			err = ctl.model.AcceptTransfer(transfer, u)
+			message = fmt.Sprintf("Sei ora il proprietario di \"%s\"", transfer.Page.Title)
+			redirect = PageURL(&transfer.Page)
+		case "decline":
+			err = ctl.model.DeclineTransfer(transfer, u)
+			message = "Trasferimento rifiutato"
+		case "cancel":
+			err = ctl.model.CancelTransfer(transfer, u)
+			message = "Trasferimento annullato"
+			redirect = PageURL(&transfer.Page)
+		}
+
+		switch err {
+		case nil:
+			setFlash(c, message)
+			return c.Redirect(http.StatusSeeOther, redirect)
+		case model.ErrNotRecipient, model.ErrNotOwner:
+			return echo.NewHTTPError(http.StatusUnauthorized, "Can't answer this transfer")
+		case model.ErrRequestNotPending:
+			return echo.NewHTTPError(http.StatusBadRequest, "Transfer is not pending")
+		case model.ErrHasUserPage:
+			return echo.NewHTTPError(http.StatusBadRequest, "You have a profile page already")
+		}
+		return err
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -12,9 +13,13 @@ import (
 	"github.com/vigliag/isamuni-go/model"
 )
 
-// PageURL returns the url for a give page
+// PageURL returns the url for a give page.
+// Pages are addressed by slug, or by ID when they have no slug.
 func PageURL(p *model.Page) string {
 	typeStr := CatUrl(p.Type)
+	if p.Slug != "" {
+		return fmt.Sprintf("/%s/%s", typeStr, url.PathEscape(p.Slug))
+	}
 	return fmt.Sprintf("/%s/%d", typeStr, p.ID)
 }
 
@@ -33,6 +38,16 @@ func CatUrl(ptype model.PageType) string {
 	return typeStr
 }
 
+// pageTypeFromCat returns the PageType whose url is cat, as returned by CatUrl
+func pageTypeFromCat(cat string) (model.PageType, bool) {
+	for _, ptype := range []model.PageType{model.PageUser, model.PageCompany, model.PageCommunity, model.PageWiki} {
+		if CatUrl(ptype) == cat {
+			return ptype, true
+		}
+	}
+	return 0, false
+}
+
 func CatName(ptype model.PageType) string {
 	name := "page"
 	switch ptype {
@@ -48,6 +63,46 @@ func CatName(ptype model.PageType) string {
 	return name
 }
 
+// pageParameter returns the page of the given type identified by the "id" route parameter.
+// The parameter can be the current slug of the page, its numeric ID, or one of its old slugs.
+func (ctl *Controller) pageParameter(c echo.Context, ptype model.PageType) (*model.Page, error) {
+	param := c.Param("id")
+	if param == "" {
+		return nil, echo.NewHTTPError(404, "Invalid ID")
+	}
+
+	page := ctl.model.FindPageBySlug(param, ptype)
+	if page == nil {
+		if id := intParameter(c, "id"); id != 0 {
+			page = ctl.model.FindPage(uint(id), ptype)
+		}
+	}
+	if page == nil {
+		page = ctl.model.FindPageByOldSlug(param, ptype)
+	}
+	if page == nil {
+		log.Printf("Page not found for %v\n", param)
+		return nil, echo.NewHTTPError(404, "Page not found")
+	}
+	return page, nil
+}
+
+// pageByID returns the page with the ID given in the "id" parameter, of any type
+func (ctl *Controller) pageByID(c echo.Context) (*model.Page, error) {
+	var p model.Page
+	if err := ctl.model.Db.First(&p, "id = ?", intParameter(c, "id")).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Page not found")
+	}
+	return &p, nil
+}
+
+// redirectNotVerified sends users who haven't verified their email to their profile,
+// where they can ask for a new verification mail
+func redirectNotVerified(c echo.Context) error {
+	setFlash(c, "Conferma il tuo indirizzo email per poter modificare le pagine")
+	return c.Redirect(http.StatusSeeOther, "/me")
+}
+
 func (ctl *Controller) indexPageH(ptype model.PageType) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		pages, err := ctl.model.GetPagesOfType(ptype)
@@ -65,6 +120,9 @@ func (ctl *Controller) newPageH(ptype model.PageType) echo.HandlerFunc {
 		if u == nil {
 			return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
 		}
+		if !ctl.model.IsVerified(u) {
+			return redirectNotVerified(c)
+		}
 
 		p := model.Page{}
 		p.Type = ptype
@@ -76,29 +134,38 @@ func (ctl *Controller) newPageH(ptype model.PageType) echo.HandlerFunc {
 			shownContent, _ = ctl.renderer.RenderString("exampleCompany.html", H{})
 		}
 
-		return c.Render(200, "pageEdit.html", H{"page": p, "shownContent": shownContent})
+		return c.Render(200, "pageEdit.html", H{"page": &p, "shownContent": shownContent})
 	}
 }
 
 func (ctl *Controller) showPageH(ptype model.PageType) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		u := currentUser(c)
-		id := intParameter(c, "id")
-		if id == 0 {
-			return echo.NewHTTPError(404, "Invalid ID")
+		page, err := ctl.pageParameter(c, ptype)
+		if err != nil {
+			return err
 		}
 
-		page := ctl.model.FindPage(uint(id), ptype)
-		if page == nil {
-			log.Printf("Page not found for %v\n", id)
-			return echo.NewHTTPError(404, "Page not found")
+		// Numeric IDs and old slugs are redirected to the current url of the page
+		if page.Slug != "" && c.Param("id") != page.Slug {
+			return c.Redirect(http.StatusMovedPermanently, PageURL(page))
 		}
 
-		return c.Render(200, "pageShow.html",
-			H{"page": page, "pageURL": PageURL(page),
-				"content": RenderMarkdown(page.Content),
-				"canEdit": ctl.model.CanEdit(page, u),
-			})
+		data := H{"page": page, "pageURL": PageURL(page),
+			"content": RenderMarkdown(page.Content),
+		}
+		if ctl.model.CanManageMaintainers(page, u) {
+			if data["maintainers"], err = ctl.model.PageMaintainers(page); err != nil {
+				return err
+			}
+		}
+		if ctl.model.CanClaim(page, u) {
+			data["pendingClaim"] = ctl.model.PendingClaim(page, u)
+		}
+		if ctl.model.CanTransfer(page, u) {
+			data["pendingTransfer"] = ctl.model.PendingTransferOf(page)
+		}
+		return c.Render(200, "pageShow.html", data)
 	}
 }
 
@@ -114,18 +181,15 @@ func (ctl *Controller) editPageH(ptype model.PageType) echo.HandlerFunc {
 		if u == nil {
 			return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
 		}
-
-		id := intParameter(c, "id")
-		if id == 0 {
-			return echo.NewHTTPError(404, "Invalid ID")
+		if !ctl.model.IsVerified(u) {
+			return redirectNotVerified(c)
 		}
 
 		versionID, _ := strconv.Atoi(c.QueryParam("version"))
 
-		page := ctl.model.FindPage(uint(id), ptype)
-		if page == nil {
-			log.Printf("Page not found for %v\n", id)
-			return echo.NewHTTPError(404, "Page not found")
+		page, err := ctl.pageParameter(c, ptype)
+		if err != nil {
+			return err
 		}
 		if !ctl.model.CanEdit(page, u) {
 			return echo.NewHTTPError(http.StatusUnauthorized, "Can't edit this page")
@@ -141,10 +205,10 @@ func (ctl *Controller) editPageH(ptype model.PageType) echo.HandlerFunc {
 
 		// if a version id was specified, show that instead
 		if versionID != 0 {
-			for _, v := range versions {
+			for i, v := range versions {
 				if v.ID == uint(versionID) {
 					shownContent = v.Content
-					shownVersion = &v
+					shownVersion = &versions[i]
 				}
 			}
 		} else if len(versions) > 0 {
@@ -152,13 +216,20 @@ func (ctl *Controller) editPageH(ptype model.PageType) echo.HandlerFunc {
 			shownVersion = &versions[0]
 		}
 
+		// the edit is based on the shown version, and will conflict with newer ones
+		baseVersion := page.ApprovedVersionID
+		if shownVersion != nil {
+			baseVersion = shownVersion.ID
+		}
+
 		action := "/pages"
 		if page.ID != 0 {
 			action = fmt.Sprintf("/pages/%d", page.ID)
 		}
 		return c.Render(200, "pageEdit.html",
 			H{"page": page, "versions": versions,
-				"shownContent": shownContent, "shownVersion": shownVersion, "action": action})
+				"shownContent": shownContent, "shownVersion": shownVersion, "action": action,
+				"baseVersion": baseVersion})
 	}
 }
 
@@ -174,6 +245,9 @@ func (ctl *Controller) updatePageH(c echo.Context) error {
 	if u == nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
 	}
+	if !ctl.model.IsVerified(u) {
+		return redirectNotVerified(c)
+	}
 
 	iptype, err := strconv.Atoi(c.FormValue("type"))
 	if err != nil {
@@ -217,19 +291,57 @@ func (ctl *Controller) updatePageH(c echo.Context) error {
 	p.Content = c.FormValue("content")
 	p.Type = ptype
 	p.ID = uint(pid)
+	baseVersion, _ := strconv.Atoi(c.FormValue("base_version"))
+	p.BaseVersionID = uint(baseVersion)
 
 	// Save the page
 	err = ctl.model.SavePage(&p, u)
-	if err != nil {
+	if conflict, ok := err.(*model.ConflictError); ok {
+		return ctl.renderConflict(c, &p, conflict)
+	} else if err != nil {
 		log.Println(err)
-		return c.Render(http.StatusBadRequest, "pageEdit.html", H{"page": p, "error": "Could not save page"})
+		return c.Render(http.StatusBadRequest, "pageEdit.html", H{"page": &p, "error": "Could not save page"})
 	}
 
-	// Index the page
-	err = ctl.index.IndexPage(&p)
-	if err != nil {
+	if err := ctl.indexStoredPage(&p); err != nil {
 		return err
 	}
 
 	return c.Redirect(http.StatusSeeOther, PageURL(&p))
 }
+
+// indexStoredPage indexes a page after it has been saved. The page is indexed as
+// it is stored, as the saved version could be waiting for approval.
+func (ctl *Controller) indexStoredPage(p *model.Page) error {
+	if stored := ctl.model.FindPage(p.ID, p.Type); stored != nil {
+		return ctl.index.IndexPage(stored)
+	}
+	return nil
+}
+
+// renderConflict shows a three-way merge between the version an edit started
+// from, the newest version of the page, and the content that was submitted.
+// Submitting the merge form saves the merged content on top of the newest version.
+func (ctl *Controller) renderConflict(c echo.Context, p *model.Page, conflict *model.ConflictError) error {
+	var baseContent string
+	if conflict.Base != nil {
+		baseContent = conflict.Base.Content
+	}
+	theirs := conflict.Theirs
+
+	chunks := model.Merge3(baseContent, conflict.Mine, theirs.Content)
+	merged := model.MergeText(chunks, "la tua versione", fmt.Sprintf("versione %d", theirs.ID))
+
+	return c.Render(http.StatusConflict, "pageConflict.html", H{
+		"page":         p,
+		"base":         conflict.Base,
+		"theirs":       theirs,
+		"chunks":       chunks,
+		"hasConflicts": model.HasConflicts(chunks),
+		"theirsDiff":   model.DiffLines(baseContent, theirs.Content),
+		"mineDiff":     model.DiffLines(baseContent, conflict.Mine),
+		"shownContent": merged,
+		"action":       fmt.Sprintf("/pages/%d", p.ID),
+		"baseVersion":  theirs.ID,
+	})
+}
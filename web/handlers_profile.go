@@ -3,7 +3,9 @@ package web
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -20,7 +22,8 @@ func (ctl *Controller) mePageH(c echo.Context) error {
 	if page == nil {
 		fmt.Printf("User page not found")
 		page = &model.Page{
-			Title: u.Username,
+			Title:   u.Username,
+			OwnerID: u.ID,
 		}
 	}
 
@@ -37,12 +40,49 @@ func (ctl *Controller) mePageH(c echo.Context) error {
 			shownContent = exampleContent
 		}
 	}
+	tokens, err := ctl.model.UserAccessTokens(u)
+	if err != nil {
+		return err
+	}
+	identities, err := ctl.model.UserIdentities(u)
+	if err != nil {
+		return err
+	}
+	transfers, err := ctl.model.PendingTransfersTo(u)
+	if err != nil {
+		return err
+	}
+
+	// Providers not linked yet can be linked, and the titles of the others are shown
+	providerTitles := make(map[string]string)
+	linked := make(map[string]bool)
+	for _, identity := range identities {
+		linked[identity.Provider] = true
+	}
+	var linkable []*OAuthProvider
+	for _, p := range ctl.providers {
+		providerTitles[p.Name] = p.Title
+		if !linked[p.Name] {
+			linkable = append(linkable, p)
+		}
+	}
+
+	loginMethods := len(identities)
+	if u.HasPasswordLogin() {
+		loginMethods++
+	}
+
 	shownVersion := "Current"
-	return c.Render(200, "profileEdit.html", H{"page": page, "action": action, "shownContent": shownContent, "shownVersion": shownVersion, "user": u})
+	return c.Render(200, "profileEdit.html", H{"page": page, "action": action, "shownContent": shownContent, "shownVersion": shownVersion, "user": u,
+		"baseVersion": page.ApprovedVersionID, "tokens": tokens, "scopes": model.AccessTokenScopes,
+		"verified": ctl.model.IsVerified(u), "identities": identities, "providerTitles": providerTitles,
+		"linkable": linkable, "canUnlink": loginMethods > 1, "transfers": transfers})
 }
 
+// setMailH starts the change of the email of the current user. The new email
+// is pending until it is confirmed through the link sent to it, and the old
+// email is notified of the change.
 func (ctl *Controller) setMailH(c echo.Context) error {
-	// TODO no tests yet
 	u := currentUser(c)
 	if u == nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
@@ -51,19 +91,25 @@ func (ctl *Controller) setMailH(c echo.Context) error {
 	email := strings.TrimSpace(c.FormValue("email"))
 
 	// do nothing if the mail has not been updated
-	if email == "" || (u.Email != nil && *u.Email == email) {
+	if email == "" {
 		return c.Redirect(http.StatusSeeOther, "/me")
 	}
 
-	// update the email
-	u.Email = &email
-	u.EmailVerified = false
-	err := ctl.model.SaveUser(u)
-	if err != nil {
-		//TODO better error handling
+	err := ctl.model.RequestEmailChange(u, email)
+	if err == model.ErrSameEmail {
+		return c.Redirect(http.StatusSeeOther, "/me")
+	} else if message, ok := signupErrors[err]; ok {
+		setFlash(c, message)
+		return c.Redirect(http.StatusSeeOther, "/me")
+	} else if err != nil {
 		return err
 	}
 
+	if err := ctl.SendEmailChangeConfirmation(u); err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("Ti abbiamo inviato un'email a %s per confermare il nuovo indirizzo", email))
 	return c.Redirect(http.StatusSeeOther, "/me")
 }
 
@@ -73,7 +119,7 @@ func (ctl *Controller) setPasswordH(c echo.Context) error {
 	if u == nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
 	}
-	if u.Email != nil {
+	if u.Email == nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "User must have an email set first")
 	}
 
@@ -86,8 +132,7 @@ func (ctl *Controller) setPasswordH(c echo.Context) error {
 	newpwd := c.FormValue("newpwd")
 
 	if u.HashedPassword == "" || u.CheckPassword(currpwd) {
-		u.SetPassword(newpwd)
-		err := ctl.model.SaveUser(u)
+		err := ctl.model.ChangePassword(u, newpwd)
 
 		//TODO display errors better
 		if err != nil {
@@ -106,3 +151,107 @@ func (ctl *Controller) setPasswordH(c echo.Context) error {
 	setFlash(c, "Error while changing password. Does the old password match?")
 	return c.Redirect(http.StatusSeeOther, "/me")
 }
+
+// createAccessTokenH creates a personal access token for the current user,
+// and shows its value, which can't be retrieved later
+func (ctl *Controller) createAccessTokenH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" {
+		setFlash(c, "Inserisci un nome per il token")
+		return c.Redirect(http.StatusSeeOther, "/me")
+	}
+
+	params, err := c.FormParams()
+	if err != nil {
+		return err
+	}
+	days, _ := strconv.Atoi(c.FormValue("expires"))
+	if days < 0 {
+		days = 0
+	}
+
+	t, value, err := ctl.model.CreateAccessToken(u, name, params["scopes"], time.Duration(days)*24*time.Hour)
+	if err != nil {
+		setFlash(c, "Seleziona almeno un permesso per il token")
+		return c.Redirect(http.StatusSeeOther, "/me")
+	}
+
+	return c.Render(http.StatusOK, "tokenCreated.html", H{"token": t, "value": value})
+}
+
+func (ctl *Controller) revokeAccessTokenH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	if err := ctl.model.RevokeAccessToken(u, uint(intParameter(c, "id"))); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Token not found")
+	}
+
+	setFlash(c, "Token revocato")
+	return c.Redirect(http.StatusSeeOther, "/me")
+}
+
+// linkProviderH starts linking a login provider to the current user,
+// asking them to log in again if they didn't recently
+func (ctl *Controller) linkProviderH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	provider := ctl.loginProvider(c.Param("provider"))
+	if provider == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown login provider")
+	}
+
+	if !recentlyAuthenticated(c) {
+		setFlash(c, "Per collegare un nuovo account devi prima accedere di nuovo")
+		return c.Redirect(http.StatusSeeOther, reauthURL(c.Request().URL.Path))
+	}
+	return c.Redirect(http.StatusSeeOther, "/login/"+provider.Name+"?redir=/me")
+}
+
+// unlinkIdentityH removes a login provider from the current user
+func (ctl *Controller) unlinkIdentityH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	err := ctl.model.UnlinkIdentity(u, uint(intParameter(c, "id")))
+	if err == model.ErrLastLoginMethod {
+		setFlash(c, "Non puoi rimuovere l'unico metodo di accesso al tuo account")
+		return c.Redirect(http.StatusSeeOther, "/me")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Login method not found")
+	}
+
+	setFlash(c, "Account scollegato")
+	return c.Redirect(http.StatusSeeOther, "/me")
+}
+
+// removePasswordH disables the login with email and password for the current user
+func (ctl *Controller) removePasswordH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	err := ctl.model.RemovePassword(u)
+	if err == model.ErrLastLoginMethod {
+		setFlash(c, "Non puoi rimuovere l'unico metodo di accesso al tuo account")
+		return c.Redirect(http.StatusSeeOther, "/me")
+	} else if err != nil {
+		return err
+	}
+
+	setFlash(c, "Password rimossa: potrai accedere solo con gli account collegati")
+	return c.Redirect(http.StatusSeeOther, "/me")
+}
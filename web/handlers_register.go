@@ -0,0 +1,83 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// signupErrors are the messages shown for the errors returned by model.Signup
+var signupErrors = map[error]string{
+	model.ErrInvalidUsername: "Il nome utente deve avere da 3 a 30 caratteri, tra lettere, numeri, punti, trattini e underscore",
+	model.ErrInvalidEmail:    "L'indirizzo email non è valido",
+	model.ErrUsernameTaken:   "Il nome utente è già in uso",
+	model.ErrEmailTaken:      "L'indirizzo email è già registrato",
+	model.ErrWeakPassword:    "La password deve avere almeno 8 caratteri, e contenere lettere e numeri o simboli. Non può contenere il nome utente o l'email",
+}
+
+func (ctl *Controller) registerPageH(c echo.Context) error {
+	if currentUser(c) != nil {
+		return c.Redirect(http.StatusSeeOther, "/me")
+	}
+	return c.Render(http.StatusOK, "register.html", H{})
+}
+
+// registerH creates a new user, logs them in, and sends them the mail to verify their email
+func (ctl *Controller) registerH(c echo.Context) error {
+	if currentUser(c) != nil {
+		return c.Redirect(http.StatusSeeOther, "/me")
+	}
+
+	username := c.FormValue("username")
+	email := c.FormValue("email")
+	password := c.FormValue("password")
+
+	renderError := func(message string) error {
+		return c.Render(http.StatusBadRequest, "register.html", H{"error": message, "username": username, "email": email})
+	}
+
+	if password != c.FormValue("password2") {
+		return renderError("Le password non coincidono")
+	}
+
+	u, err := ctl.model.Signup(username, email, password)
+	if message, ok := signupErrors[err]; ok {
+		return renderError(message)
+	} else if err != nil {
+		return err
+	}
+
+	if err := ctl.SendEmailVerification(u); err != nil {
+		c.Logger().Error(err)
+		setFlash(c, "Registrazione completata, ma non è stato possibile inviare l'email di conferma. Riprova dal tuo profilo.")
+	} else {
+		setFlash(c, "Registrazione completata! Ti abbiamo inviato un'email per confermare il tuo indirizzo.")
+	}
+
+	if err := ctl.model.RecordLogin(u, c.RealIP()); err != nil {
+		return err
+	}
+	setSessionUser(c, u)
+	return c.Redirect(http.StatusSeeOther, "/me")
+}
+
+// resendVerificationH sends again the mail to verify the email of the current user
+func (ctl *Controller) resendVerificationH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	if u.Email == nil || u.EmailVerified {
+		setFlash(c, "Non ci sono indirizzi email da confermare")
+		return c.Redirect(http.StatusSeeOther, "/me")
+	}
+
+	if err := ctl.SendEmailVerification(u); err != nil {
+		return err
+	}
+
+	setFlash(c, "Ti abbiamo inviato di nuovo l'email di conferma")
+	return c.Redirect(http.StatusSeeOther, "/me")
+}
@@ -2,29 +2,135 @@ package web
 
 import (
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/vigliag/isamuni-go/index"
 	"github.com/vigliag/isamuni-go/model"
 )
 
+// facetTitles are the names shown for each of index.FacetFields
+var facetTitles = map[string]string{
+	"type":   "Tipo",
+	"city":   "Città",
+	"sector": "Settore",
+}
+
+// facetLink is a value of a facet, linking to the search filtered by it.
+// If the filter is already active, the link removes it.
+type facetLink struct {
+	Label  string
+	Count  int
+	URL    string
+	Active bool
+}
+
+type facetView struct {
+	Title string
+	Links []facetLink
+}
+
+// searchFilters reads the values of index.FacetFields from the request
+func searchFilters(c echo.Context) map[string]string {
+	filters := make(map[string]string)
+	for _, field := range index.FacetFields {
+		if value := strings.TrimSpace(c.FormValue(field)); value != "" {
+			filters[field] = value
+		}
+	}
+	return filters
+}
+
+// searchURL returns the url of a page of results of the search page.
+// A page of zero is omitted from the url.
+func searchURL(query string, filters map[string]string, page int) string {
+	values := url.Values{}
+	if query != "" {
+		values.Set("query", query)
+	}
+	for field, value := range filters {
+		values.Set(field, value)
+	}
+	if page > 0 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	return "/search?" + values.Encode()
+}
+
+func facetLabel(field, term string) string {
+	if field == "type" {
+		if ptype, ok := pageTypeFromCat(term); ok {
+			return strings.Title(CatName(ptype))
+		}
+	}
+	return term
+}
+
+// facetViews turns the facets of the results in links toggling the corresponding filter
+func facetViews(results *index.SearchResults, query string, filters map[string]string) []facetView {
+	var views []facetView
+	for _, facet := range results.Facets {
+		if len(facet.Terms) == 0 {
+			continue
+		}
+
+		view := facetView{Title: facetTitles[facet.Field]}
+		for _, term := range facet.Terms {
+			toggled := make(map[string]string)
+			for field, value := range filters {
+				toggled[field] = value
+			}
+
+			active := filters[facet.Field] == term.Term
+			if active {
+				delete(toggled, facet.Field)
+			} else {
+				toggled[facet.Field] = term.Term
+			}
+
+			view.Links = append(view.Links, facetLink{
+				Label:  facetLabel(facet.Field, term.Term),
+				Count:  term.Count,
+				URL:    searchURL(query, toggled, 0),
+				Active: active,
+			})
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
 func (ctl *Controller) searchH(c echo.Context) error {
 	query := c.FormValue("query")
+	filters := searchFilters(c)
 
 	var resProfessionals []index.SearchResult
 	var resCompanies []index.SearchResult
 	var resCommunities []index.SearchResult
+	var resWiki []index.SearchResult
 
-	if query == "" {
+	if query == "" && len(filters) == 0 {
 		return c.Render(http.StatusOK, "pageSearch.html", H{})
 	}
 
-	results, err := ctl.index.SearchPagesByQueryString(query)
+	page, _ := strconv.Atoi(c.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	results, err := ctl.index.Search(index.Query{
+		QueryString: query,
+		Filters:     filters,
+		From:        (page - 1) * index.DefaultPageSize,
+		Size:        index.DefaultPageSize,
+	})
 	if err != nil {
 		return err
 	}
 
-	for _, res := range results {
+	for _, res := range results.Hits {
 		switch res.Page.Type {
 		case model.PageUser:
 			resProfessionals = append(resProfessionals, res)
@@ -32,12 +138,29 @@ func (ctl *Controller) searchH(c echo.Context) error {
 			resCommunities = append(resCommunities, res)
 		case model.PageCompany:
 			resCompanies = append(resCompanies, res)
+		case model.PageWiki:
+			resWiki = append(resWiki, res)
 		}
 	}
 
+	var prevURL, nextURL string
+	if results.HasPrev() {
+		prevURL = searchURL(query, filters, page-1)
+	}
+	if results.HasNext() {
+		nextURL = searchURL(query, filters, page+1)
+	}
+
 	return c.Render(http.StatusOK, "pageSearch.html",
 		H{"professionals": resProfessionals,
 			"communities": resCommunities,
 			"companies":   resCompanies,
+			"wiki":        resWiki,
+			"results":     results,
+			"facets":      facetViews(results, query, filters),
+			"filters":     filters,
+			"prevURL":     prevURL,
+			"nextURL":     nextURL,
+			"searched":    true,
 			"query":       query})
 }
@@ -0,0 +1,104 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// DeletePage moves a page to the trash and removes it from the search index.
+// u is the user deleting the page, and can be nil when deleting from the command line.
+func (ctl *Controller) DeletePage(p *model.Page, u *model.User, reason string) error {
+	if err := ctl.model.DeletePage(p, u, reason); err != nil {
+		return err
+	}
+	return ctl.index.RemovePage(p)
+}
+
+// RestorePage takes a page out of the trash and indexes it again.
+// u is the user restoring the page, and can be nil from the command line.
+func (ctl *Controller) RestorePage(p *model.Page, u *model.User) error {
+	if err := ctl.model.RestorePage(p, u); err != nil {
+		return err
+	}
+	return ctl.index.IndexPage(p)
+}
+
+// PurgePage permanently deletes a page, its versions, and its document in the search index.
+// u is the user purging the page, and can be nil from the command line.
+func (ctl *Controller) PurgePage(p *model.Page, u *model.User) error {
+	if err := ctl.model.PurgePage(p, u); err != nil {
+		return err
+	}
+	return ctl.index.RemovePage(p)
+}
+
+func (ctl *Controller) deletePageH(c echo.Context) error {
+	u := currentUser(c)
+	if !ctl.model.CanDeletePages(u) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Only admins and moderators can delete pages")
+	}
+
+	var p model.Page
+	if err := ctl.model.Db.First(&p, "id = ?", intParameter(c, "id")).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Page not found")
+	}
+
+	reason := strings.TrimSpace(c.FormValue("reason"))
+	if err := ctl.DeletePage(&p, u, reason); err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("Pagina \"%s\" spostata nel cestino", p.Title))
+	return c.Redirect(http.StatusSeeOther, "/trash")
+}
+
+func (ctl *Controller) trashH(c echo.Context) error {
+	u := currentUser(c)
+	if !ctl.model.CanDeletePages(u) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Only admins and moderators can see deleted pages")
+	}
+
+	pages, err := ctl.model.DeletedPages()
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "trash.html", H{"pages": pages})
+}
+
+// trashActionH returns a handler that restores a deleted page, or purges it if purge is true.
+// Moderators can restore pages, but only admins can purge them.
+func (ctl *Controller) trashActionH(purge bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := currentUser(c)
+		if !ctl.model.CanDeletePages(u) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Only admins and moderators can manage deleted pages")
+		}
+		if purge && !ctl.model.CanPurgePages(u) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Only admins can purge pages")
+		}
+
+		p := ctl.model.FindDeletedPage(uint(intParameter(c, "id")))
+		if p == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Page not found in the trash")
+		}
+
+		if purge {
+			if err := ctl.PurgePage(p, u); err != nil {
+				return err
+			}
+			setFlash(c, fmt.Sprintf("Pagina \"%s\" eliminata definitivamente", p.Title))
+			return c.Redirect(http.StatusSeeOther, "/trash")
+		}
+
+		if err := ctl.RestorePage(p, u); err != nil {
+			return err
+		}
+		setFlash(c, fmt.Sprintf("Pagina \"%s\" ripristinata", p.Title))
+		return c.Redirect(http.StatusSeeOther, PageURL(p))
+	}
+}
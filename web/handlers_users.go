@@ -0,0 +1,270 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// usersPageSize is how many users are listed in a page of the user console
+const usersPageSize = 50
+
+// usersURL returns the url of a page of the users matching query
+func usersURL(query string, page int) string {
+	values := url.Values{}
+	if query != "" {
+		values.Set("q", query)
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if len(values) == 0 {
+		return "/admin/users"
+	}
+	return "/admin/users?" + values.Encode()
+}
+
+// usersH lists the users matching the "q" parameter, with their username or email
+func (ctl *Controller) usersH(c echo.Context) error {
+	query := strings.TrimSpace(c.QueryParam("q"))
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	users, total, err := ctl.model.SearchUsers(query, usersPageSize, (page-1)*usersPageSize)
+	if err != nil {
+		return err
+	}
+
+	var prevURL, nextURL string
+	if page > 1 {
+		prevURL = usersURL(query, page-1)
+	}
+	if page*usersPageSize < total {
+		nextURL = usersURL(query, page+1)
+	}
+	return c.Render(http.StatusOK, "adminUsers.html", H{
+		"query": query, "users": users, "total": total, "prevURL": prevURL, "nextURL": nextURL,
+	})
+}
+
+// targetUser returns the user given in the "id" parameter
+func (ctl *Controller) targetUser(c echo.Context) (*model.User, error) {
+	target := ctl.model.RetrieveUser(uint(intParameter(c, "id")))
+	if target == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	return target, nil
+}
+
+// userURL is the page of a user in the user console
+func userURL(u *model.User) string {
+	return fmt.Sprintf("/admin/users/%d", u.ID)
+}
+
+// userH shows a user, their pages and their contributions, and the actions admins can take on them
+func (ctl *Controller) userH(c echo.Context) error {
+	target, err := ctl.targetUser(c)
+	if err != nil {
+		return err
+	}
+
+	pages, err := ctl.model.PagesOwnedBy(target)
+	if err != nil {
+		return err
+	}
+	contributions, err := ctl.model.UserContributions(target, 50)
+	if err != nil {
+		return err
+	}
+	identities, err := ctl.model.UserIdentities(target)
+	if err != nil {
+		return err
+	}
+	blocks, err := ctl.model.UserBlocks(target)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "adminUser.html", H{
+		"user": target, "pages": pages, "contributions": contributions, "identities": identities,
+		"blocks": blocks, "roles": model.Roles, "verified": ctl.model.IsVerified(target),
+		"self": target.ID == currentUser(c).ID,
+	})
+}
+
+// setRoleH changes the role of a user. Admins can't change their own role,
+// so that there is always an admin left.
+func (ctl *Controller) setRoleH(c echo.Context) error {
+	target, err := ctl.targetUser(c)
+	if err != nil {
+		return err
+	}
+	if target.ID == currentUser(c).ID {
+		return echo.NewHTTPError(http.StatusBadRequest, "Can't change your own role")
+	}
+
+	err = ctl.model.SetRole(target, c.FormValue("role"), currentUser(c))
+	if err == model.ErrInvalidRole {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid role")
+	} else if err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("%s ha ora il ruolo %s", target.Username, target.Role))
+	return c.Redirect(http.StatusSeeOther, userURL(target))
+}
+
+// logoutUserH logs a user out of all their sessions
+func (ctl *Controller) logoutUserH(c echo.Context) error {
+	target, err := ctl.targetUser(c)
+	if err != nil {
+		return err
+	}
+	if err := ctl.model.LogoutEverywhere(target, currentUser(c)); err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("%s è stato disconnesso da tutte le sessioni", target.Username))
+	return c.Redirect(http.StatusSeeOther, userURL(target))
+}
+
+// verifyUserEmailH marks the email of a user as verified
+func (ctl *Controller) verifyUserEmailH(c echo.Context) error {
+	target, err := ctl.targetUser(c)
+	if err != nil {
+		return err
+	}
+
+	err = ctl.model.MarkEmailVerified(target, currentUser(c))
+	if err == model.ErrInvalidEmail {
+		return echo.NewHTTPError(http.StatusBadRequest, "The user has no email")
+	} else if err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("Email di %s verificata", target.Username))
+	return c.Redirect(http.StatusSeeOther, userURL(target))
+}
+
+// blockUserH blocks a user and rejects their pending versions. With the "rollback" form
+// value, the pages they edited last are also rolled back to the version of another author,
+// or moved to the trash if they have none.
+func (ctl *Controller) blockUserH(c echo.Context) error {
+	u := currentUser(c)
+	target, err := ctl.targetUser(c)
+	if err != nil {
+		return err
+	}
+	if target.ID == u.ID {
+		return echo.NewHTTPError(http.StatusBadRequest, "Can't block yourself")
+	}
+	if target.Blocked {
+		return echo.NewHTTPError(http.StatusBadRequest, "User is blocked already")
+	}
+
+	reason := strings.TrimSpace(c.FormValue("reason"))
+	block, pages, err := ctl.model.BlockUser(target, u, reason, c.FormValue("rollback") != "")
+	if err != nil {
+		return err
+	}
+	if err := ctl.reindexPages(pages); err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("%s è stato bloccato, %d modifiche rifiutate e %d pagine ripristinate o spostate nel cestino",
+		target.Username, len(block.RejectedVersions), len(block.Rollbacks)))
+	return c.Redirect(http.StatusSeeOther, userURL(target))
+}
+
+// unblockUserH lets a blocked user log in again, leaving their contributions as they are
+func (ctl *Controller) unblockUserH(c echo.Context) error {
+	target, err := ctl.targetUser(c)
+	if err != nil {
+		return err
+	}
+	if err := ctl.model.SetBlocked(target, false, currentUser(c)); err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("%s è stato sbloccato", target.Username))
+	return c.Redirect(http.StatusSeeOther, userURL(target))
+}
+
+// undoBlockH undoes a block, unblocking the user and restoring their contributions
+func (ctl *Controller) undoBlockH(c echo.Context) error {
+	target, err := ctl.targetUser(c)
+	if err != nil {
+		return err
+	}
+	block := ctl.model.FindBlock(uint(intParameter(c, "block")))
+	if block == nil || block.UserID != target.ID {
+		return echo.NewHTTPError(http.StatusNotFound, "Block not found")
+	}
+
+	pages, err := ctl.model.UndoBlock(block, currentUser(c))
+	if err == model.ErrBlockUndone {
+		return echo.NewHTTPError(http.StatusBadRequest, "Block has been undone already")
+	} else if err != nil {
+		return err
+	}
+	if err := ctl.reindexPages(pages); err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("Il blocco di %s è stato annullato", target.Username))
+	return c.Redirect(http.StatusSeeOther, userURL(target))
+}
+
+// reindexPages updates the index after the content of pages changed, removing
+// the pages moved to the trash
+func (ctl *Controller) reindexPages(pages []*model.Page) error {
+	for _, p := range pages {
+		if p.DeletedAt != nil {
+			if err := ctl.index.RemovePage(p); err != nil {
+				return err
+			}
+		} else if err := ctl.index.IndexPage(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeUserH merges the user into the one with the username given in the "into" form value,
+// for users who created two accounts, e.g. one with Facebook and one with their email
+func (ctl *Controller) mergeUserH(c echo.Context) error {
+	dup, err := ctl.targetUser(c)
+	if err != nil {
+		return err
+	}
+	username := strings.TrimSpace(c.FormValue("into"))
+	keep := ctl.model.RetrieveUserByUsername(username)
+	if keep == nil {
+		setFlash(c, fmt.Sprintf("L'utente %s non esiste", username))
+		return c.Redirect(http.StatusSeeOther, userURL(dup))
+	}
+	if dup.ID == currentUser(c).ID {
+		return echo.NewHTTPError(http.StatusBadRequest, "Can't merge your own account into another one")
+	}
+
+	err = ctl.model.MergeUsers(keep, dup, currentUser(c))
+	if err == model.ErrSameUser {
+		setFlash(c, "Non puoi unire un utente con sé stesso")
+		return c.Redirect(http.StatusSeeOther, userURL(dup))
+	} else if err == model.ErrHasUserPage {
+		setFlash(c, "Entrambi gli utenti hanno una pagina personale, eliminane una prima di unirli")
+		return c.Redirect(http.StatusSeeOther, userURL(dup))
+	} else if err != nil {
+		return err
+	}
+
+	setFlash(c, fmt.Sprintf("%s è stato unito a %s", dup.Username, keep.Username))
+	return c.Redirect(http.StatusSeeOther, userURL(keep))
+}
@@ -0,0 +1,130 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// diffPageH shows the differences between two versions of a page.
+// The "from" and "to" query parameters are ContentVersion IDs. When one of them
+// is missing, the currently approved content of the page is used in its place.
+func (ctl *Controller) diffPageH(ptype model.PageType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := currentUser(c)
+		if u == nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+		}
+
+		page, err := ctl.pageParameter(c, ptype)
+		if err != nil {
+			return err
+		}
+		if !ctl.model.CanEdit(page, u) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Can't see the versions of this page")
+		}
+
+		fromID, _ := strconv.Atoi(c.QueryParam("from"))
+		toID, _ := strconv.Atoi(c.QueryParam("to"))
+
+		fromContent, fromVersion, err := ctl.versionContent(page, uint(fromID))
+		if err != nil {
+			return err
+		}
+		toContent, toVersion, err := ctl.versionContent(page, uint(toID))
+		if err != nil {
+			return err
+		}
+
+		return c.Render(http.StatusOK, "pageDiff.html", H{
+			"page":        page,
+			"fromVersion": fromVersion,
+			"toVersion":   toVersion,
+			"lines":       model.DiffLines(fromContent, toContent),
+			"tooLarge":    model.DiffTooLarge(fromContent, toContent),
+			"sections":    model.DiffSections(fromContent, toContent),
+		})
+	}
+}
+
+// versionContent returns the content of a version of the page. When versionID
+// is zero, the approved content of the page is returned, with a nil version.
+func (ctl *Controller) versionContent(page *model.Page, versionID uint) (string, *model.ContentVersion, error) {
+	if versionID == 0 {
+		return page.Content, nil, nil
+	}
+	cv := ctl.model.FindPageVersion(page, versionID)
+	if cv == nil {
+		return "", nil, echo.NewHTTPError(http.StatusNotFound, "Version not found")
+	}
+	return cv.Content, cv, nil
+}
+
+// historyPageH lists every version of a page, with its author and review state
+func (ctl *Controller) historyPageH(ptype model.PageType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := currentUser(c)
+
+		page, err := ctl.pageParameter(c, ptype)
+		if err != nil {
+			return err
+		}
+
+		versions, err := ctl.model.FindPageVersions(page)
+		if err != nil {
+			return err
+		}
+		ownership, err := ctl.model.OwnershipHistory(page)
+		if err != nil {
+			return err
+		}
+
+		return c.Render(http.StatusOK, "pageHistory.html", H{
+			"page":       page,
+			"versions":   versions,
+			"ownership":  ownership,
+			"canEdit":    ctl.model.CanEdit(page, u),
+			"canApprove": ctl.model.CanApproveEdits(page, u),
+		})
+	}
+}
+
+// revertPageH restores the content of the version given in the "version" form value.
+// Only users who can approve edits to the page can revert it.
+func (ctl *Controller) revertPageH(ptype model.PageType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := currentUser(c)
+		if u == nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+		}
+
+		page, err := ctl.pageParameter(c, ptype)
+		if err != nil {
+			return err
+		}
+		if !ctl.model.CanApproveEdits(page, u) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Can't revert this page")
+		}
+
+		versionID, _ := strconv.Atoi(c.FormValue("version"))
+		old := ctl.model.FindPageVersion(page, uint(versionID))
+		if old == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Version not found")
+		}
+		if _, err := ctl.model.RevertPage(page, old, u); err == model.ErrVersionNotRevertible {
+			return echo.NewHTTPError(http.StatusBadRequest, "Only earlier approved versions can be restored")
+		} else if err != nil {
+			return err
+		}
+
+		if err := ctl.index.IndexPage(page); err != nil {
+			return err
+		}
+
+		setFlash(c, fmt.Sprintf("Pagina riportata alla versione %d", old.ID))
+		return c.Redirect(http.StatusSeeOther, PageURL(page)+"/history")
+	}
+}
@@ -0,0 +1,300 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"github.com/vigliag/isamuni-go/model"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/facebook"
+	"golang.org/x/oauth2/github"
+)
+
+// OAuthProvider is an external service users can log in with
+type OAuthProvider struct {
+	// Name identifies the provider, and the identities linked through it.
+	// Users start the login at /login/<Name>.
+	Name string
+	// Title is shown to the users
+	Title string
+	// The provider redirects the users back to /oauth/<CallbackPath>
+	CallbackPath string
+
+	config oauth2.Config
+
+	// Issuer of an OpenID Connect provider, whose endpoints are discovered
+	// the first time they are needed
+	issuer     string
+	discovery  sync.Mutex
+	discovered bool
+
+	// userInfoURL returns the profile of the user who logged in
+	userInfoURL string
+	// fetchAccount retrieves the profile of the user through an authenticated client
+	fetchAccount func(ctx context.Context, p *OAuthProvider, client *http.Client) (*model.ExternalAccount, error)
+}
+
+func callbackURL(appURL, callbackPath string) string {
+	return strings.TrimSuffix(appURL, "/") + "/oauth/" + callbackPath
+}
+
+// getJSON fetches url with client, and decodes the JSON response into v
+func getJSON(client *http.Client, url string, v interface{}) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// NewFacebookProvider returns the provider to log in with Facebook
+func NewFacebookProvider(clientID, clientSecret, appURL string) *OAuthProvider {
+	return &OAuthProvider{
+		Name:         model.ProviderFacebook,
+		Title:        "Facebook",
+		CallbackPath: "fb",
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       []string{"email"},
+			Endpoint:     facebook.Endpoint,
+			RedirectURL:  callbackURL(appURL, "fb"),
+		},
+		userInfoURL:  "https://graph.facebook.com/me?fields=id,name,email",
+		fetchAccount: fetchFacebookAccount,
+	}
+}
+
+func fetchFacebookAccount(ctx context.Context, p *OAuthProvider, client *http.Client) (*model.ExternalAccount, error) {
+	var fbuser struct {
+		ID    string  `json:"id"`
+		Email *string `json:"email"`
+		Name  string  `json:"name"`
+	}
+	if err := getJSON(client, p.userInfoURL, &fbuser); err != nil {
+		return nil, err
+	}
+
+	// Facebook only shares emails that have been confirmed
+	return &model.ExternalAccount{
+		Provider:      p.Name,
+		Subject:       fbuser.ID,
+		Name:          fbuser.Name,
+		Email:         fbuser.Email,
+		EmailVerified: fbuser.Email != nil,
+	}, nil
+}
+
+// NewGitHubProvider returns the provider to log in with GitHub
+func NewGitHubProvider(clientID, clientSecret, appURL string) *OAuthProvider {
+	return &OAuthProvider{
+		Name:         "github",
+		Title:        "GitHub",
+		CallbackPath: "github",
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       []string{"read:user", "user:email"},
+			Endpoint:     github.Endpoint,
+			RedirectURL:  callbackURL(appURL, "github"),
+		},
+		userInfoURL:  "https://api.github.com/user",
+		fetchAccount: fetchGitHubAccount,
+	}
+}
+
+func fetchGitHubAccount(ctx context.Context, p *OAuthProvider, client *http.Client) (*model.ExternalAccount, error) {
+	var ghuser struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := getJSON(client, p.userInfoURL, &ghuser); err != nil {
+		return nil, err
+	}
+
+	account := &model.ExternalAccount{
+		Provider: p.Name,
+		Subject:  strconv.FormatInt(ghuser.ID, 10),
+		Name:     ghuser.Name,
+	}
+	if account.Name == "" {
+		account.Name = ghuser.Login
+	}
+
+	// The email in the profile may be missing or unverified, so we look for the primary one
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(client, p.userInfoURL+"/emails", &emails); err != nil {
+		return nil, err
+	}
+	for _, e := range emails {
+		if e.Primary {
+			email := e.Email
+			account.Email = &email
+			account.EmailVerified = e.Verified
+		}
+	}
+	return account, nil
+}
+
+// NewOIDCProvider returns a provider implementing OpenID Connect.
+// Its endpoints are discovered from the configuration published by the issuer.
+func NewOIDCProvider(name, title, issuer, clientID, clientSecret, appURL string) *OAuthProvider {
+	return &OAuthProvider{
+		Name:         name,
+		Title:        title,
+		CallbackPath: name,
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       []string{"openid", "profile", "email"},
+			RedirectURL:  callbackURL(appURL, name),
+		},
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		fetchAccount: fetchOIDCAccount,
+	}
+}
+
+// discover retrieves the endpoints of an OpenID Connect provider
+func (p *OAuthProvider) discover(ctx context.Context) error {
+	p.discovery.Lock()
+	defer p.discovery.Unlock()
+	if p.issuer == "" || p.discovered {
+		return nil
+	}
+
+	var conf struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	client := oauth2.NewClient(ctx, nil)
+	if err := getJSON(client, p.issuer+"/.well-known/openid-configuration", &conf); err != nil {
+		return err
+	}
+	if strings.TrimSuffix(conf.Issuer, "/") != p.issuer {
+		return fmt.Errorf("issuer mismatch: expected %s, got %s", p.issuer, conf.Issuer)
+	}
+	if conf.AuthorizationEndpoint == "" || conf.TokenEndpoint == "" || conf.UserinfoEndpoint == "" {
+		return errors.New("incomplete OpenID configuration for " + p.issuer)
+	}
+
+	p.config.Endpoint = oauth2.Endpoint{AuthURL: conf.AuthorizationEndpoint, TokenURL: conf.TokenEndpoint}
+	p.userInfoURL = conf.UserinfoEndpoint
+	p.discovered = true
+	return nil
+}
+
+// fetchOIDCAccount reads the claims of the user from the userinfo endpoint.
+// It is reached directly with the access token, so the ID token doesn't need to be verified.
+func fetchOIDCAccount(ctx context.Context, p *OAuthProvider, client *http.Client) (*model.ExternalAccount, error) {
+	var claims struct {
+		Subject           string  `json:"sub"`
+		Name              string  `json:"name"`
+		PreferredUsername string  `json:"preferred_username"`
+		Email             *string `json:"email"`
+		EmailVerified     bool    `json:"email_verified"`
+	}
+	if err := getJSON(client, p.userInfoURL, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing subject in userinfo response")
+	}
+
+	account := &model.ExternalAccount{
+		Provider:      p.Name,
+		Subject:       claims.Subject,
+		Name:          claims.Name,
+		Email:         claims.Email,
+		EmailVerified: claims.Email != nil && claims.EmailVerified,
+	}
+	if account.Name == "" {
+		account.Name = claims.PreferredUsername
+	}
+	return account, nil
+}
+
+// AuthCodeURL returns the url where the users log in with the provider
+func (p *OAuthProvider) AuthCodeURL(ctx context.Context, state string) (string, error) {
+	if err := p.discover(ctx); err != nil {
+		return "", err
+	}
+	return p.config.AuthCodeURL(state, oauth2.AccessTypeOnline), nil
+}
+
+// Account exchanges the code the provider redirected the user with,
+// and returns the account the user logged in with
+func (p *OAuthProvider) Account(ctx context.Context, code string) (*model.ExternalAccount, error) {
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	tok, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := p.fetchAccount(ctx, p, p.config.Client(ctx, tok))
+	if err != nil {
+		return nil, err
+	}
+	if account.Subject == "" {
+		return nil, errors.New("no account id returned by " + p.Name)
+	}
+	return account, nil
+}
+
+// LoginProvidersFromConfig returns the login providers enabled in the configuration.
+// A provider is enabled when its client id is set, e.g. OAUTH_GITHUB_CLIENT_ID and
+// OAUTH_GITHUB_CLIENT_SECRET. Facebook keeps using FB_CLIENT_ID and FB_CLIENT_SECRET.
+// GitLab can be self-hosted by setting OAUTH_GITLAB_ISSUER, and any other OpenID Connect
+// provider can be added with OAUTH_OIDC_ISSUER and OAUTH_OIDC_TITLE.
+func LoginProvidersFromConfig(appURL string) []*OAuthProvider {
+	var providers []*OAuthProvider
+
+	if id := viper.GetString("FB_CLIENT_ID"); id != "" {
+		providers = append(providers, NewFacebookProvider(id, viper.GetString("FB_CLIENT_SECRET"), appURL))
+	}
+	if id := viper.GetString("OAUTH_GITHUB_CLIENT_ID"); id != "" {
+		providers = append(providers, NewGitHubProvider(id, viper.GetString("OAUTH_GITHUB_CLIENT_SECRET"), appURL))
+	}
+	if id := viper.GetString("OAUTH_GOOGLE_CLIENT_ID"); id != "" {
+		providers = append(providers, NewOIDCProvider("google", "Google", "https://accounts.google.com",
+			id, viper.GetString("OAUTH_GOOGLE_CLIENT_SECRET"), appURL))
+	}
+	if id := viper.GetString("OAUTH_GITLAB_CLIENT_ID"); id != "" {
+		issuer := viper.GetString("OAUTH_GITLAB_ISSUER")
+		if issuer == "" {
+			issuer = "https://gitlab.com"
+		}
+		providers = append(providers, NewOIDCProvider("gitlab", "GitLab", issuer,
+			id, viper.GetString("OAUTH_GITLAB_CLIENT_SECRET"), appURL))
+	}
+	if id := viper.GetString("OAUTH_OIDC_CLIENT_ID"); id != "" {
+		title := viper.GetString("OAUTH_OIDC_TITLE")
+		if title == "" {
+			title = "OpenID Connect"
+		}
+		providers = append(providers, NewOIDCProvider("oidc", title, viper.GetString("OAUTH_OIDC_ISSUER"),
+			id, viper.GetString("OAUTH_OIDC_CLIENT_SECRET"), appURL))
+	}
+	return providers
+}
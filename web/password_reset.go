@@ -0,0 +1,119 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vigliag/isamuni-go/mail"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// SendPasswordReset sends u a mail with a single-use link to choose a new password
+func (ctl *Controller) SendPasswordReset(u *model.User) error {
+	if u.Email == nil {
+		return fmt.Errorf("Can't reset password, no mail set for user")
+	}
+
+	token, err := ctl.model.CreateToken(u.ID, model.TokenPasswordReset)
+	if err != nil {
+		return err
+	}
+
+	resetURL := ctl.appURL + "/resetPassword?token=" + url.QueryEscape(token)
+	return ctl.mailer.SendMail(mail.PasswordResetEmail(u.Username, *u.Email, resetURL))
+}
+
+func (ctl *Controller) forgotPasswordPageH(c echo.Context) error {
+	return c.Render(http.StatusOK, "forgotPassword.html", H{})
+}
+
+// forgotPasswordH sends a password reset mail to the user with the given email.
+// The response is the same whether or not the email is registered, so that it
+// can't be used to find out who has an account.
+func (ctl *Controller) forgotPasswordH(c echo.Context) error {
+	email := strings.TrimSpace(c.FormValue("email"))
+	if email == "" {
+		return c.Render(http.StatusBadRequest, "forgotPassword.html", H{"error": "Inserisci il tuo indirizzo email"})
+	}
+
+	var u model.User
+	if err := ctl.model.Db.First(&u, "lower(email) = lower(?)", email).Error; err == nil {
+		if err := ctl.SendPasswordReset(&u); err != nil {
+			c.Logger().Error(err)
+		}
+	}
+
+	setFlash(c, "Se l'indirizzo è registrato, riceverai un'email con le istruzioni per reimpostare la password")
+	return c.Redirect(http.StatusSeeOther, "/login")
+}
+
+// resetToken returns the password reset token in the request, and its user.
+// The token is not consumed.
+func (ctl *Controller) resetToken(c echo.Context) (string, *model.User, error) {
+	value := c.FormValue("token")
+	if value == "" {
+		return "", nil, echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	t, err := ctl.model.GetToken(value, model.TokenPasswordReset)
+	if err != nil {
+		return "", nil, echo.NewHTTPError(http.StatusNotFound, "The link is invalid or has expired")
+	}
+
+	u := ctl.model.RetrieveUser(t.Identifier)
+	if u == nil {
+		return "", nil, echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	return value, u, nil
+}
+
+func (ctl *Controller) resetPasswordPageH(c echo.Context) error {
+	token, _, err := ctl.resetToken(c)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "resetPassword.html", H{"token": token})
+}
+
+// resetPasswordH sets a new password for the user of a reset token. All the other
+// sessions of the user are logged out, and the token can't be used again.
+func (ctl *Controller) resetPasswordH(c echo.Context) error {
+	token, u, err := ctl.resetToken(c)
+	if err != nil {
+		return err
+	}
+
+	password := c.FormValue("password")
+	if password != c.FormValue("password2") {
+		return c.Render(http.StatusBadRequest, "resetPassword.html", H{"token": token, "error": "Le password non coincidono"})
+	}
+	var email string
+	if u.Email != nil {
+		email = *u.Email
+	}
+	if err := model.CheckPasswordStrength(password, u.Username, email); err != nil {
+		return c.Render(http.StatusBadRequest, "resetPassword.html", H{"token": token, "error": signupErrors[err]})
+	}
+
+	// Claim the token, in case it is being used by another request too
+	if _, err := ctl.model.ConsumeToken(token, model.TokenPasswordReset); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "The link is invalid or has expired")
+	}
+
+	// Rotates SessionToken, logging out the other sessions.
+	// Receiving the mail also proves the user owns the email.
+	u.EmailVerified = true
+	if err := ctl.model.ChangePassword(u, password); err != nil {
+		return err
+	}
+	// Links sent earlier can't be used anymore
+	if err := ctl.model.DeleteUserTokens(u.ID, model.TokenPasswordReset); err != nil {
+		return err
+	}
+
+	setFlash(c, "Password aggiornata")
+	return ctl.logIn(c, u, "/")
+}
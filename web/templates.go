@@ -31,6 +31,7 @@ func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Con
 	// add common variables from context
 	if viewContext, isMap := data.(H); isMap {
 		viewContext["currentUser"] = c.Get("currentUser")
+		viewContext["can"] = c.Get("can")
 		viewContext["path"] = c.Request().URL.Path
 		viewContext["csrf"] = c.Get("csrf")
 		if err == nil {
@@ -97,6 +98,21 @@ func LoadTemplates() *Template {
 	loadTemplateFromBox(templateBox, t, "exampleCommunity.html")
 	loadTemplateFromBox(templateBox, t, "exampleCompany.html")
 	loadTemplateFromBox(templateBox, t, "admin.html")
+	loadTemplateFromBox(templateBox, t, "reviews.html")
+	loadTemplateFromBox(templateBox, t, "pageDiff.html")
+	loadTemplateFromBox(templateBox, t, "pageHistory.html")
+	loadTemplateFromBox(templateBox, t, "pageConflict.html")
+	loadTemplateFromBox(templateBox, t, "trash.html")
+	loadTemplateFromBox(templateBox, t, "tokenCreated.html")
+	loadTemplateFromBox(templateBox, t, "register.html")
+	loadTemplateFromBox(templateBox, t, "forgotPassword.html")
+	loadTemplateFromBox(templateBox, t, "resetPassword.html")
+	loadTemplateFromBox(templateBox, t, "twoFactorLogin.html")
+	loadTemplateFromBox(templateBox, t, "twoFactorSetup.html")
+	loadTemplateFromBox(templateBox, t, "recoveryCodes.html")
+	loadTemplateFromBox(templateBox, t, "adminUsers.html")
+	loadTemplateFromBox(templateBox, t, "adminUser.html")
+	loadTemplateFromBox(templateBox, t, "adminAudit.html")
 
 	return &Template{templates: t}
 }
@@ -55,3 +55,24 @@ func (c *TestClient) Run(req *http.Request) *http.Response {
 func (c *TestClient) Get(url string) *http.Response {
 	return c.Run(httptest.NewRequest("GET", url, nil))
 }
+
+// KeepCookies replaces the cookies of the client with the ones set by res, if any.
+// When a cookie is set more than once, the last value is kept.
+func (c *TestClient) KeepCookies(res *http.Response) {
+	byName := make(map[string]*http.Cookie)
+	var names []string
+	for _, cookie := range res.Cookies() {
+		if _, ok := byName[cookie.Name]; !ok {
+			names = append(names, cookie.Name)
+		}
+		byName[cookie.Name] = cookie
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	c.cookies = nil
+	for _, name := range names {
+		c.cookies = append(c.cookies, byName[name])
+	}
+}
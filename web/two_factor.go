@@ -0,0 +1,306 @@
+package web
+
+import (
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/skip2/go-qrcode"
+	"github.com/vigliag/isamuni-go/model"
+)
+
+// totpIssuer is the name the accounts are shown with in the authenticator apps
+const totpIssuer = "Isamuni"
+
+const (
+	// twoFactorTimeout is how long users have to give their code after the first step of the login
+	twoFactorTimeout = 5 * time.Minute
+	// twoFactorAttempts is how many wrong codes are accepted before the login has to start again
+	twoFactorAttempts = 5
+)
+
+// RequireTwoFactor makes two-factor authentication mandatory for the users with the given role.
+// Those who did not enable it can only set it up, until they do.
+func (ctl *Controller) RequireTwoFactor(role string) {
+	if ctl.twoFactorRoles == nil {
+		ctl.twoFactorRoles = make(map[string]bool)
+	}
+	ctl.twoFactorRoles[role] = true
+}
+
+// mustEnrollTwoFactor tells if u has to enable two-factor authentication before using the site
+func (ctl *Controller) mustEnrollTwoFactor(u *model.User) bool {
+	return ctl.twoFactorRoles[u.Role] && !u.TOTPEnabled
+}
+
+// twoFactorEnrollmentPath tells if path is accessible to the users who must enable
+// two-factor authentication before doing anything else
+func twoFactorEnrollmentPath(path string) bool {
+	return strings.HasPrefix(path, "/me/2fa") || strings.HasPrefix(path, "/static/") || path == "/logout"
+}
+
+// throttledAccount is the account the failed logins of u are counted for
+func throttledAccount(u *model.User) string {
+	if u.Email != nil {
+		return *u.Email
+	}
+	return u.Username
+}
+
+// logIn logs user in after they proved their identity, and sends them to redirect.
+// Users with two-factor authentication are only half-authenticated: the session remembers
+// who they are until they give their code at /twoFactor, and only then they are logged in.
+// The failed attempts to log in to the account are only forgotten then, so that giving
+// the right password again doesn't allow to keep guessing the code.
+func (ctl *Controller) logIn(c echo.Context, user *model.User, redirect string) error {
+	redirect = localRedirect(redirect)
+	if user.Blocked {
+		return c.Render(http.StatusForbidden, "login.html", H{"error": "Il tuo account è stato bloccato", "providers": ctl.providers})
+	}
+	if !user.TOTPEnabled {
+		if err := ctl.model.RecordLoginSuccess(throttledAccount(user)); err != nil {
+			return err
+		}
+		if err := ctl.model.RecordLogin(user, c.RealIP()); err != nil {
+			return err
+		}
+		setSessionUser(c, user)
+		return c.Redirect(http.StatusSeeOther, redirect)
+	}
+
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "userid")
+	delete(sess.Values, SESSION_TOKEN_KEY)
+	sess.Values["2fa_userid"] = user.ID
+	sess.Values["2fa_session_token"] = user.SessionToken
+	sess.Values["2fa_expires"] = time.Now().Add(twoFactorTimeout).Unix()
+	sess.Values["2fa_attempts"] = 0
+	sess.Values["2fa_redir"] = redirect
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(http.StatusSeeOther, "/twoFactor")
+}
+
+// clearTwoFactorLogin forgets the half-authenticated user of the session
+func clearTwoFactorLogin(c echo.Context) {
+	sess, _ := session.Get("session", c)
+	for _, key := range []string{"2fa_userid", "2fa_session_token", "2fa_expires", "2fa_attempts", "2fa_redir"} {
+		delete(sess.Values, key)
+	}
+	sess.Save(c.Request(), c.Response())
+}
+
+// twoFactorUser returns the half-authenticated user of the session, or nil if
+// there is none, or the time to complete the login has passed
+func (ctl *Controller) twoFactorUser(c echo.Context) *model.User {
+	sess, err := session.Get("session", c)
+	if err != nil {
+		return nil
+	}
+	id, ok := sess.Values["2fa_userid"].(uint)
+	expires, _ := sess.Values["2fa_expires"].(int64)
+	if !ok || time.Now().Unix() > expires {
+		return nil
+	}
+
+	user := ctl.model.RetrieveUser(id)
+	// a change of password in the meantime invalidates the login
+	if user == nil || user.SessionToken != sess.Values["2fa_session_token"] || !user.TOTPEnabled || user.Blocked {
+		return nil
+	}
+	return user
+}
+
+func (ctl *Controller) twoFactorPageH(c echo.Context) error {
+	if ctl.twoFactorUser(c) == nil {
+		clearTwoFactorLogin(c)
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return c.Render(http.StatusOK, "twoFactorLogin.html", H{})
+}
+
+// twoFactorH completes the login of a half-authenticated user, checking their code
+func (ctl *Controller) twoFactorH(c echo.Context) error {
+	user := ctl.twoFactorUser(c)
+	if user == nil {
+		clearTwoFactorLogin(c)
+		setFlash(c, "Il tempo per completare l'accesso è scaduto, accedi di nuovo")
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+
+	// Wrong codes count as failed logins, like wrong passwords
+	account := throttledAccount(user)
+	if err := ctl.model.LoginAllowed(c.RealIP(), account, time.Now()); err != nil {
+		return ctl.renderThrottled(c, "twoFactorLogin.html", err)
+	}
+
+	err := ctl.model.CheckSecondFactor(user, c.FormValue("code"))
+	if err == model.ErrInvalidSecondFactor {
+		if err := ctl.model.RecordLoginFailure(c.RealIP(), account, "second_factor", time.Now()); err != nil {
+			return err
+		}
+
+		sess, _ := session.Get("session", c)
+		attempts, _ := sess.Values["2fa_attempts"].(int)
+		attempts++
+		if attempts >= twoFactorAttempts {
+			clearTwoFactorLogin(c)
+			setFlash(c, "Troppi codici errati, accedi di nuovo")
+			return c.Redirect(http.StatusSeeOther, "/login")
+		}
+		sess.Values["2fa_attempts"] = attempts
+		sess.Save(c.Request(), c.Response())
+		return c.Render(http.StatusUnauthorized, "twoFactorLogin.html", H{"error": "Codice non valido"})
+	} else if err != nil {
+		return err
+	}
+
+	sess, _ := session.Get("session", c)
+	redirect, _ := sess.Values["2fa_redir"].(string)
+	clearTwoFactorLogin(c)
+	if err := ctl.model.RecordLoginSuccess(account); err != nil {
+		return err
+	}
+	if err := ctl.model.RecordLogin(user, c.RealIP()); err != nil {
+		return err
+	}
+	setSessionUser(c, user)
+	return c.Redirect(http.StatusSeeOther, localRedirect(redirect))
+}
+
+// qrCodeURL returns a data url of a QR code image encoding content
+func qrCodeURL(content string) (template.URL, error) {
+	png, err := qrcode.Encode(content, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+// twoFactorSetupPageH shows the secret to add to an authenticator app,
+// or the status of two-factor authentication if it is enabled already
+func (ctl *Controller) twoFactorSetupPageH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	if u.TOTPEnabled {
+		return c.Render(http.StatusOK, "twoFactorSetup.html", H{
+			"remainingCodes": ctl.model.RemainingRecoveryCodes(u),
+			"required":       ctl.twoFactorRoles[u.Role],
+		})
+	}
+	return ctl.renderTwoFactorEnrollment(c, u, http.StatusOK, "")
+}
+
+func (ctl *Controller) renderTwoFactorEnrollment(c echo.Context, u *model.User, code int, errorMessage string) error {
+	secret, err := ctl.model.TOTPEnrollmentSecret(u)
+	if err != nil {
+		return err
+	}
+	qr, err := qrCodeURL(model.TOTPURL(secret, totpIssuer, u.Username))
+	if err != nil {
+		return err
+	}
+	return c.Render(code, "twoFactorSetup.html", H{"secret": secret, "qr": qr, "error": errorMessage,
+		"required": ctl.mustEnrollTwoFactor(u)})
+}
+
+// enableTwoFactorH completes the enrollment, showing the recovery codes
+func (ctl *Controller) enableTwoFactorH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	codes, err := ctl.model.EnableTOTP(u, c.FormValue("code"))
+	if err == model.ErrInvalidSecondFactor {
+		return ctl.renderTwoFactorEnrollment(c, u, http.StatusBadRequest, "Codice non valido, controlla l'ora del tuo dispositivo e riprova")
+	} else if err == model.ErrTOTPEnabled {
+		return c.Redirect(http.StatusSeeOther, "/me/2fa")
+	} else if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "recoveryCodes.html", H{"codes": codes})
+}
+
+// checkSettingsCode checks the code with which u confirms a change to their two-factor
+// authentication. As in twoFactorH, wrong codes count as failed logins to the account,
+// and the session is logged out after twoFactorAttempts of them, so that whoever took
+// over a session can't guess the code. When ok is false, err is the response to give.
+func (ctl *Controller) checkSettingsCode(c echo.Context, u *model.User) (ok bool, err error) {
+	account := throttledAccount(u)
+	if err := ctl.model.LoginAllowed(c.RealIP(), account, time.Now()); err != nil {
+		return false, echo.NewHTTPError(http.StatusTooManyRequests, "Too many failed attempts")
+	}
+
+	sess, _ := session.Get("session", c)
+	err = ctl.model.CheckSecondFactor(u, c.FormValue("code"))
+	if err == model.ErrInvalidSecondFactor {
+		if err := ctl.model.RecordLoginFailure(c.RealIP(), account, "second_factor", time.Now()); err != nil {
+			return false, err
+		}
+
+		attempts, _ := sess.Values["2fa_settings_attempts"].(int)
+		attempts++
+		if attempts >= twoFactorAttempts {
+			delete(sess.Values, "2fa_settings_attempts")
+			setFlash(c, "Troppi codici errati, accedi di nuovo")
+			return false, ctl.logout(c)
+		}
+		sess.Values["2fa_settings_attempts"] = attempts
+		sess.Save(c.Request(), c.Response())
+		setFlash(c, "Codice non valido")
+		return false, c.Redirect(http.StatusSeeOther, "/me/2fa")
+	} else if err != nil {
+		return false, err
+	}
+
+	delete(sess.Values, "2fa_settings_attempts")
+	sess.Save(c.Request(), c.Response())
+	return true, nil
+}
+
+// disableTwoFactorH turns off two-factor authentication for the current user,
+// who has to confirm it with a code. It can't be turned off when it is required.
+func (ctl *Controller) disableTwoFactorH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+	if ctl.twoFactorRoles[u.Role] {
+		return echo.NewHTTPError(http.StatusForbidden, "Two-factor authentication is required for this account")
+	}
+
+	if ok, err := ctl.checkSettingsCode(c, u); !ok {
+		return err
+	}
+	if err := ctl.model.DisableTOTP(u); err != nil {
+		return err
+	}
+
+	setFlash(c, "Verifica in due passaggi disattivata")
+	return c.Redirect(http.StatusSeeOther, "/me")
+}
+
+// recoveryCodesH replaces the recovery codes of the current user, who has to confirm it with a code
+func (ctl *Controller) recoveryCodesH(c echo.Context) error {
+	u := currentUser(c)
+	if u == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	if ok, err := ctl.checkSettingsCode(c, u); !ok {
+		return err
+	}
+	codes, err := ctl.model.RegenerateRecoveryCodes(u)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "recoveryCodes.html", H{"codes": codes})
+}
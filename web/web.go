@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/vigliag/isamuni-go/index"
 	"github.com/vigliag/isamuni-go/mail"
@@ -25,10 +26,36 @@ type Controller struct {
 	mailer   mail.Mailer
 	renderer *Template
 	appURL   string
+
+	// providers users can log in with, besides email and password
+	providers []*OAuthProvider
+	// roles required to use two-factor authentication
+	twoFactorRoles map[string]bool
 }
 
 func NewController(appURL string, model *model.Model, index *index.Index, mailer mail.Mailer, renderer *Template) *Controller {
-	return &Controller{model, index, mailer, renderer, appURL}
+	return &Controller{model: model, index: index, mailer: mailer, renderer: renderer, appURL: appURL}
+}
+
+// AddLoginProvider lets users log in with an external provider
+func (ctl *Controller) AddLoginProvider(p *OAuthProvider) {
+	ctl.providers = append(ctl.providers, p)
+}
+
+// Model returns the model the controller works with
+func (ctl *Controller) Model() *model.Model {
+	return ctl.model
+}
+
+// Close closes the database and the search index of the controller
+func (ctl *Controller) Close() {
+	ctl.model.Close()
+	ctl.index.Close()
+}
+
+// StartTokenCleanup periodically deletes the expired tokens, until the returned function is called
+func (ctl *Controller) StartTokenCleanup(interval time.Duration) (stop func()) {
+	return ctl.model.StartTokenCleanup(interval)
 }
 
 // Helpers
@@ -49,6 +76,13 @@ func currentUser(c echo.Context) *model.User {
 	return nil
 }
 
+// setCurrentUser makes u the user of the request, and puts their permissions in the
+// context, where templates find them as .can
+func (ctl *Controller) setCurrentUser(c echo.Context, u *model.User) {
+	c.Set("currentUser", u)
+	c.Set("can", ctl.model.Permissions(u))
+}
+
 func serveTemplate(templateName string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		c.Render(200, templateName+".html", H{})
@@ -71,6 +105,10 @@ func customHTTPErrorHandler(err error, c echo.Context) {
 	if he, ok := err.(*echo.HTTPError); ok {
 		code = he.Code
 	}
+	if isAPIRequest(c) {
+		apiErrorHandler(err, c)
+		return
+	}
 	if err := c.Render(code, "error.html", H{"code": code}); err != nil {
 		c.HTML(http.StatusInternalServerError, "<h3>Internal Server Error</h3>")
 		c.Logger().Error(err)
@@ -78,6 +116,9 @@ func customHTTPErrorHandler(err error, c echo.Context) {
 	c.Logger().Error(err)
 }
 
+// maxPageSize limits the size of the requests saving a page
+const maxPageSize = "1M"
+
 // CreateServer attaches the app's routes and middlewares to an Echo server
 func CreateServer(r *echo.Echo, ctl *Controller) *echo.Echo {
 	t := LoadTemplates()
@@ -105,6 +146,14 @@ func CreateServer(r *echo.Echo, ctl *Controller) *echo.Echo {
 	}
 	cs.MaxAge(cs.Options.MaxAge)
 
+	// The address of the clients is used to throttle failed logins, so it is only read
+	// from X-Forwarded-For when BEHIND_PROXY says that a trusted proxy sets it
+	if viper.GetBool("BEHIND_PROXY") {
+		r.IPExtractor = echo.ExtractIPFromXFFHeader()
+	} else {
+		r.IPExtractor = echo.ExtractIPDirect()
+	}
+
 	r.Pre(middleware.RemoveTrailingSlash())
 	r.Use(session.Middleware(cs))
 	r.Use(middleware.Logger())
@@ -120,9 +169,18 @@ func CreateServer(r *echo.Echo, ctl *Controller) *echo.Echo {
 	r.GET("/logout", ctl.loginPage)
 	r.POST("/login", ctl.loginWithEmail)
 	r.POST("/logout", ctl.logout)
-
-	r.GET("/login/facebook", ctl.redirectToFacebookLogin)
-	r.GET("/oauth/fb", ctl.completeFacebookLogin)
+	r.GET("/register", ctl.registerPageH)
+	r.POST("/register", ctl.registerH)
+	r.POST("/resendVerification", ctl.resendVerificationH)
+	r.GET("/forgotPassword", ctl.forgotPasswordPageH)
+	r.POST("/forgotPassword", ctl.forgotPasswordH)
+	r.GET("/resetPassword", ctl.resetPasswordPageH)
+	r.POST("/resetPassword", ctl.resetPasswordH)
+	r.GET("/twoFactor", ctl.twoFactorPageH)
+	r.POST("/twoFactor", ctl.twoFactorH)
+
+	r.GET("/login/:provider", ctl.redirectToProviderLogin)
+	r.GET("/oauth/:provider", ctl.completeProviderLogin)
 
 	r.GET("/professionals/:id", ctl.showPageH(model.PageUser))
 	r.GET("/wiki/:id", ctl.showPageH(model.PageWiki))
@@ -139,24 +197,116 @@ func CreateServer(r *echo.Echo, ctl *Controller) *echo.Echo {
 	r.GET("/companies/:id/edit", ctl.editPageH(model.PageCompany))
 	r.GET("/communities/:id/edit", ctl.editPageH(model.PageCommunity))
 
+	r.GET("/professionals/:id/diff", ctl.diffPageH(model.PageUser))
+	r.GET("/wiki/:id/diff", ctl.diffPageH(model.PageWiki))
+	r.GET("/companies/:id/diff", ctl.diffPageH(model.PageCompany))
+	r.GET("/communities/:id/diff", ctl.diffPageH(model.PageCommunity))
+
+	r.GET("/professionals/:id/history", ctl.historyPageH(model.PageUser))
+	r.GET("/wiki/:id/history", ctl.historyPageH(model.PageWiki))
+	r.GET("/companies/:id/history", ctl.historyPageH(model.PageCompany))
+	r.GET("/communities/:id/history", ctl.historyPageH(model.PageCommunity))
+
+	r.POST("/professionals/:id/revert", ctl.revertPageH(model.PageUser))
+	r.POST("/wiki/:id/revert", ctl.revertPageH(model.PageWiki))
+	r.POST("/companies/:id/revert", ctl.revertPageH(model.PageCompany))
+	r.POST("/communities/:id/revert", ctl.revertPageH(model.PageCommunity))
+
 	r.GET("/professionals", ctl.indexPageH(model.PageUser))
 	r.GET("/wiki", ctl.indexPageH(model.PageWiki))
 	r.GET("/companies", ctl.indexPageH(model.PageCompany))
 	r.GET("/communities", ctl.indexPageH(model.PageCommunity))
 
-	r.GET("/admin", ctl.adminH)
+	// Edits are reviewed by staff, and by the owners and co-maintainers of each page
+	r.GET("/reviews", ctl.reviewsH)
+	r.POST("/versions/:id/approve", ctl.reviewVersionH(true))
+	r.POST("/versions/:id/reject", ctl.reviewVersionH(false))
+
+	r.POST("/pages/:id/delete", ctl.deletePageH)
+	r.GET("/trash", ctl.trashH)
+	r.POST("/trash/:id/restore", ctl.trashActionH(false))
+
+	// The admin area is for admins only
+	admin := r.Group("/admin", ctl.requirePermission(ctl.model.CanManageUsers))
+	admin.GET("", ctl.adminH)
+	admin.POST("/claims/:id/approve", ctl.reviewClaimH(true))
+	admin.POST("/claims/:id/reject", ctl.reviewClaimH(false))
+	admin.POST("/pages/:id/owner", ctl.setOwnerH)
+	admin.POST("/trash/:id/purge", ctl.trashActionH(true))
+
+	users := admin.Group("/users")
+	users.GET("", ctl.usersH)
+	users.GET("/:id", ctl.userH)
+	users.POST("/:id/unlock", ctl.unlockUserH)
+	users.POST("/:id/role", ctl.setRoleH)
+	users.POST("/:id/logout", ctl.logoutUserH)
+	users.POST("/:id/verify", ctl.verifyUserEmailH)
+	users.POST("/:id/block", ctl.blockUserH)
+	users.POST("/:id/unblock", ctl.unblockUserH)
+	users.POST("/:id/blocks/:block/undo", ctl.undoBlockH)
+	users.POST("/:id/merge", ctl.mergeUserH)
+
+	admin.GET("/audit", ctl.auditH)
+
 	r.GET("/me", ctl.mePageH)
 	r.POST("/setMail", ctl.setMailH)
+	r.POST("/cancelEmailChange", ctl.cancelEmailChangeH)
 	r.POST("/setPassword", ctl.setPasswordH)
+	r.POST("/me/password/remove", ctl.removePasswordH)
+	r.GET("/me/link/:provider", ctl.linkProviderH)
+	r.POST("/me/identities/:id/unlink", ctl.unlinkIdentityH)
+	r.GET("/me/2fa", ctl.twoFactorSetupPageH)
+	r.POST("/me/2fa", ctl.enableTwoFactorH)
+	r.POST("/me/2fa/disable", ctl.disableTwoFactorH)
+	r.POST("/me/2fa/recoveryCodes", ctl.recoveryCodesH)
+	r.POST("/me/tokens", ctl.createAccessTokenH)
+	r.POST("/me/tokens/:id/revoke", ctl.revokeAccessTokenH)
 
 	r.GET("/search", ctl.searchH)
 
+	api := r.Group("/api", middleware.CORS(), ctl.accessTokenMiddleware)
+	api.GET("/search", ctl.searchAPIH)
+
+	v1 := api.Group("/v1")
+	v1.GET("/professionals", ctl.apiPagesH(model.PageUser))
+	v1.GET("/wiki", ctl.apiPagesH(model.PageWiki))
+	v1.GET("/companies", ctl.apiPagesH(model.PageCompany))
+	v1.GET("/communities", ctl.apiPagesH(model.PageCommunity))
+
+	v1.GET("/professionals/:id", ctl.apiPageH(model.PageUser))
+	v1.GET("/wiki/:id", ctl.apiPageH(model.PageWiki))
+	v1.GET("/companies/:id", ctl.apiPageH(model.PageCompany))
+	v1.GET("/communities/:id", ctl.apiPageH(model.PageCommunity))
+
+	v1.GET("/professionals/:id/versions", ctl.apiVersionsH(model.PageUser))
+	v1.GET("/wiki/:id/versions", ctl.apiVersionsH(model.PageWiki))
+	v1.GET("/companies/:id/versions", ctl.apiVersionsH(model.PageCompany))
+	v1.GET("/communities/:id/versions", ctl.apiVersionsH(model.PageCommunity))
+
+	v1.GET("/professionals/:id/versions/:version", ctl.apiVersionH(model.PageUser))
+	v1.GET("/wiki/:id/versions/:version", ctl.apiVersionH(model.PageWiki))
+	v1.GET("/companies/:id/versions/:version", ctl.apiVersionH(model.PageCompany))
+	v1.GET("/communities/:id/versions/:version", ctl.apiVersionH(model.PageCommunity))
+
+	v1.GET("/users/:id", ctl.apiUserH)
+
+	v1.POST("/pages", ctl.apiCreatePageH, middleware.BodyLimit(maxPageSize))
+	v1.PUT("/pages/:id", ctl.apiUpdatePageH, middleware.BodyLimit(maxPageSize))
+
 	r.GET("/privacy", serveTemplate("privacy"))
 
-	r.POST("/pages", ctl.updatePageH)
-	r.POST("/pages/:id", ctl.updatePageH)
+	r.POST("/pages", ctl.updatePageH, middleware.BodyLimit(maxPageSize))
+	r.POST("/pages/:id", ctl.updatePageH, middleware.BodyLimit(maxPageSize))
+	r.POST("/pages/:id/maintainers", ctl.addMaintainerH)
+	r.POST("/pages/:id/maintainers/:user/remove", ctl.removeMaintainerH)
+	r.POST("/pages/:id/claim", ctl.claimPageH)
+	r.POST("/pages/:id/transfer", ctl.transferPageH)
+	r.POST("/transfers/:id/accept", ctl.answerTransferH("accept"))
+	r.POST("/transfers/:id/decline", ctl.answerTransferH("decline"))
+	r.POST("/transfers/:id/cancel", ctl.answerTransferH("cancel"))
 
 	r.GET("/confirmMail", ctl.mailVerificationH)
+	r.GET("/confirmEmailChange", ctl.emailChangeConfirmationH)
 
 	r.GET("/robots.txt", func(c echo.Context) error {
 		return c.String(http.StatusOK, "User-agent: *\nDisallow: /")
@@ -1,6 +1,8 @@
 package web
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,6 +12,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/vigliag/isamuni-go/mail"
 
@@ -68,11 +71,30 @@ func formRequest(addr string, values url.Values) *http.Request {
 	return req
 }
 
+// apiRequest returns a request to the API with body encoded as JSON, authenticated by token if not empty
+func apiRequest(method, addr, token string, body interface{}) *http.Request {
+	encoded, err := json.Marshal(body)
+	panicIfNotNull(err)
+	req := httptest.NewRequest(method, addr, bytes.NewReader(encoded))
+	req.Header.Add("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
 func assertHTMLReturned(t *testing.T, res *http.Response) {
 	assert.Equal(t, 200, res.StatusCode)
 	assert.Equal(t, "text/html; charset=utf-8", strings.ToLower(res.Header.Get("content-type")))
 }
 
+// decodeJSON asserts that res is a JSON response with the given status code, and decodes its body in v
+func decodeJSON(t *testing.T, res *http.Response, code int, v interface{}) {
+	assert.Equal(t, code, res.StatusCode)
+	assert.Equal(t, "application/json; charset=utf-8", strings.ToLower(res.Header.Get("content-type")))
+	panicIfNotNull(json.NewDecoder(res.Body).Decode(v))
+}
+
 func (t *TestEnvironment) registerTestAdmin() *model.User {
 	u, err := t.model.RegisterEmail("vigliag", "vigliag@gmail.com", "password", "admin")
 	if err != nil {
@@ -208,6 +230,18 @@ func TestUserPages(t *testing.T) {
 	assertHTMLReturned(t, client.Get("/login"))
 }
 
+func TestLoginRedirect(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+	user := env.registerTestUser()
+
+	for redir, location := range map[string]string{"/me": "/me", "https://example.org": "/", "//example.org": "/"} {
+		res := env.TestClient().Run(formRequest("/login", url.Values{"email": {*user.Email}, "password": {"password"}, "redir": {redir}}))
+		assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+		assert.Equal(t, location, res.Header.Get("Location"))
+	}
+}
+
 func TestSearch(t *testing.T) {
 	env := GetTestEnv()
 	defer env.Close()
@@ -245,4 +279,1477 @@ func TestSendMailVerification(t *testing.T) {
 	// Check the user email was verified
 	u = env.model.RetrieveUser(u.ID)
 	assert.Equal(t, true, u.EmailVerified)
+
+	// The link can only be used once
+	res = client.Get(confirmationAddr)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestReviewVersion(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	user := env.registerTestUser()
+
+	p := &model.Page{Content: "Ciao", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	p.Content = "Ciao, promuove"
+	panicIfNotNull(env.model.SavePage(p, user))
+
+	versions, err := env.model.FindNewerPageVersions(p)
+	panicIfNotNull(err)
+	assert.Len(t, versions, 1)
+	approveURL := fmt.Sprintf("/versions/%d/approve", versions[0].ID)
+
+	// Users who can't approve edits to the page are refused
+	client := env.TestClient()
+	client.MustLogin(*user.Email, "password")
+	res := client.Run(formRequest(approveURL, url.Values{}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// The admin can approve the version, which gets indexed
+	client = env.TestClient()
+	client.MustLogin(*admin.Email, "password")
+	res = client.Run(formRequest(approveURL, url.Values{"note": {"ok"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	p = env.model.FindPage(p.ID, model.PageCompany)
+	assert.Equal(t, versions[0].ID, p.ApprovedVersionID)
+	assert.Equal(t, "Ciao, promuove", p.Content)
+
+	results, err := env.index.SearchPagesByQueryString("promuove", 0, 0)
+	panicIfNotNull(err)
+	assert.Len(t, results.Hits, 1)
+
+	// The version can't be reviewed twice
+	res = client.Run(formRequest(fmt.Sprintf("/versions/%d/reject", versions[0].ID), url.Values{}))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	assertHTMLReturned(t, client.Get("/reviews"))
+}
+
+func TestDiffPage(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	p := &model.Page{Content: "Ciao\n\n### Links\n\n- vecchio", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	first := p.ApprovedVersionID
+	p.Content = "Ciao\n\n### Links\n\n- nuovo"
+	panicIfNotNull(env.model.SavePage(p, admin))
+
+	client := env.TestClient()
+	res := client.Get(fmt.Sprintf("/companies/%d/diff?to=%d", p.ID, first))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	client.MustLogin(*admin.Email, "password")
+	res = client.Get(fmt.Sprintf("/companies/%d/diff?from=%d&to=%d", p.ID, first, p.ApprovedVersionID))
+	assertHTMLReturned(t, res)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), `<span class="diff-delete">- vecchio</span>`)
+	assert.Contains(t, string(body), `<span class="diff-insert">- nuovo</span>`)
+
+	res = client.Get(fmt.Sprintf("/companies/%d/diff?to=12345", p.ID))
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// Versions too different are not diffed line by line
+	var a, b strings.Builder
+	for i := 0; i < 30000; i++ {
+		fmt.Fprintf(&a, "riga %d\n", i)
+		fmt.Fprintf(&b, "linea %d\n", i)
+	}
+	p.Content = a.String()
+	panicIfNotNull(env.model.SavePage(p, admin))
+	from := p.ApprovedVersionID
+	p.Content = b.String()
+	panicIfNotNull(env.model.SavePage(p, admin))
+	res = client.Get(fmt.Sprintf("/companies/%d/diff?from=%d&to=%d", p.ID, from, p.ApprovedVersionID))
+	assertHTMLReturned(t, res)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "troppo diverse")
+
+	// and pages can't be too large
+	form := url.Values{"title": {"Example company"}, "content": {strings.Repeat("a", 2<<20)}, "type": {"1"}}
+	res = client.Run(formRequest(fmt.Sprintf("/pages/%d", p.ID), form))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
+
+func TestPageHistoryAndRevert(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	user := env.registerTestUser()
+
+	p := &model.Page{Content: "Prima versione", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	first := p.ApprovedVersionID
+	p.Content = "Seconda versione, promuove"
+	panicIfNotNull(env.model.SavePage(p, admin))
+	panicIfNotNull(env.index.IndexPage(p))
+
+	historyURL := fmt.Sprintf("/companies/%d/history", p.ID)
+	revertURL := fmt.Sprintf("/companies/%d/revert", p.ID)
+	revertForm := url.Values{"version": {fmt.Sprintf("%d", first)}}
+
+	// History is public
+	assertHTMLReturned(t, env.TestClient().Get(historyURL))
+
+	// Only users who can approve edits can revert
+	client := env.TestClient()
+	client.MustLogin(*user.Email, "password")
+	res := client.Run(formRequest(revertURL, revertForm))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	client = env.TestClient()
+	client.MustLogin(*admin.Email, "password")
+	res = client.Run(formRequest(revertURL, revertForm))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	p = env.model.FindPage(p.ID, model.PageCompany)
+	assert.Equal(t, "Prima versione", p.Content)
+	assert.NotEqual(t, first, p.ApprovedVersionID)
+
+	// The index no longer contains the reverted content
+	results, err := env.index.SearchPagesByQueryString("promuove", 0, 0)
+	panicIfNotNull(err)
+	assert.Empty(t, results.Hits)
+
+	// Pending versions are listed too
+	p.Content = "Proposta"
+	panicIfNotNull(env.model.SavePage(p, user))
+	res = client.Get(historyURL)
+	assertHTMLReturned(t, res)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "In attesa di approvazione")
+
+	// But only earlier approved versions can be restored
+	assert.Equal(t, 2, strings.Count(string(body), `value="Ripristina"`))
+	versions, err := env.model.FindPageVersions(p)
+	panicIfNotNull(err)
+	res = client.Run(formRequest(revertURL, url.Values{"version": {fmt.Sprintf("%d", versions[0].ID)}}))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestSlugRedirects(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	p := &model.Page{Content: "Ciao", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	assert.Equal(t, "/companies/example-company", PageURL(p))
+
+	p.Title = "Renamed company"
+	p.Slug = ""
+	panicIfNotNull(env.model.SavePage(p, admin))
+
+	client := env.TestClient()
+	assertHTMLReturned(t, client.Get("/companies/renamed-company"))
+
+	for _, old := range []string{fmt.Sprintf("/companies/%d", p.ID), "/companies/example-company"} {
+		res := client.Get(old)
+		assert.Equal(t, http.StatusMovedPermanently, res.StatusCode)
+		location, _ := res.Location()
+		assert.Equal(t, "/companies/renamed-company", location.Path)
+	}
+
+	// Pages are only found in their own category
+	res := client.Get("/communities/renamed-company")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	client.MustLogin(*admin.Email, "password")
+	assertHTMLReturned(t, client.Get("/companies/renamed-company/edit"))
+}
+
+func TestEditConflict(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	user := env.registerTestUser()
+
+	p := &model.Page{Content: "uno\ndue\ntre", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	base := p.ApprovedVersionID
+
+	edit := func(client *TestClient, content string, baseVersion uint) *http.Response {
+		form := url.Values{}
+		form.Set("title", p.Title)
+		form.Set("type", fmt.Sprintf("%d", int(model.PageCompany)))
+		form.Set("content", content)
+		form.Set("base_version", fmt.Sprintf("%d", baseVersion))
+		return client.Run(formRequest(fmt.Sprintf("/pages/%d", p.ID), form))
+	}
+
+	userClient := env.TestClient()
+	userClient.MustLogin(*user.Email, "password")
+	adminClient := env.TestClient()
+	adminClient.MustLogin(*admin.Email, "password")
+
+	// Both start from the same version, the first to save wins
+	res := edit(userClient, "uno\ndue da loro\ntre", base)
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	res = edit(adminClient, "uno\ndue da me\ntre", base)
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "&lt;&lt;&lt;&lt;&lt;&lt;&lt; la tua versione\ndue da me\n=======\ndue da loro\n")
+
+	p = env.model.FindPage(p.ID, model.PageCompany)
+	assert.Equal(t, "uno\ndue\ntre", p.Content)
+}
+
+func TestDeletePage(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	user := env.registerTestUser()
+
+	p := &model.Page{Content: "Ciao, promuove", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	panicIfNotNull(env.index.IndexPage(p))
+
+	deleteURL := fmt.Sprintf("/pages/%d/delete", p.ID)
+
+	client := env.TestClient()
+	client.MustLogin(*user.Email, "password")
+	res := client.Run(formRequest(deleteURL, url.Values{}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	client = env.TestClient()
+	client.MustLogin(*admin.Email, "password")
+	res = client.Run(formRequest(deleteURL, url.Values{"reason": {"spam"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	// The page disappears right away
+	res = client.Get(PageURL(p))
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	results, err := env.index.SearchPagesByQueryString("promuove", 0, 0)
+	panicIfNotNull(err)
+	assert.Empty(t, results.Hits)
+	assertHTMLReturned(t, client.Get("/search?query=promuove"))
+
+	// And can be found in the trash
+	res = client.Get("/trash")
+	assertHTMLReturned(t, res)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "spam")
+
+	res = client.Run(formRequest(fmt.Sprintf("/trash/%d/restore", p.ID), url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assertHTMLReturned(t, client.Get(PageURL(p)))
+	results, err = env.index.SearchPagesByQueryString("promuove", 0, 0)
+	panicIfNotNull(err)
+	assert.Len(t, results.Hits, 1)
+
+	// Purging only works on pages in the trash
+	purgeURL := fmt.Sprintf("/admin/trash/%d/purge", p.ID)
+	res = client.Run(formRequest(purgeURL, url.Values{}))
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	panicIfNotNull(env.ctl.DeletePage(p, admin, ""))
+
+	// Moderators can restore pages, but only admins can purge them
+	moderator, err := env.model.RegisterEmail("moderator", "moderator@example.com", "password", model.RoleModerator)
+	panicIfNotNull(err)
+	moderatorClient := env.TestClient()
+	moderatorClient.MustLogin(*moderator.Email, "password")
+	res = moderatorClient.Run(formRequest(purgeURL, url.Values{}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.NotNil(t, env.model.FindDeletedPage(p.ID))
+
+	res = client.Run(formRequest(purgeURL, url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Nil(t, env.model.FindDeletedPage(p.ID))
+}
+
+func TestUnapprovedContentNotSearchable(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	user := env.registerTestUser()
+	client := env.TestClient()
+	client.MustLogin(*user.Email, "password")
+
+	search := func(query string) []index.SearchResult {
+		results, err := env.index.SearchPagesByQueryString(query, 0, 0)
+		panicIfNotNull(err)
+		return results.Hits
+	}
+
+	// A new page by a normal user is waiting for approval, and is not indexed
+	form := url.Values{}
+	form.Set("title", "Unapproved company")
+	form.Set("type", fmt.Sprintf("%d", int(model.PageCompany)))
+	form.Set("content", "Contenuto nascosto")
+	res := client.Run(formRequest("/pages", form))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Empty(t, search("nascosto"))
+
+	// Pending edits to an approved page do not replace the indexed content
+	p := &model.Page{Content: "Contenuto approvato", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	panicIfNotNull(env.index.IndexPage(p))
+
+	form = url.Values{}
+	form.Set("title", p.Title)
+	form.Set("type", fmt.Sprintf("%d", int(model.PageCompany)))
+	form.Set("content", "Contenuto proposto")
+	res = client.Run(formRequest(fmt.Sprintf("/pages/%d", p.ID), form))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Empty(t, search("proposto"))
+	assert.Len(t, search("approvato"), 1)
+
+	// Documents of pages that have been unlisted since indexing are dropped
+	env.model.Db.Model(p).UpdateColumn("approved_version_id", 0)
+	assert.Empty(t, search("approvato"))
+
+	// Unlisted pages are removed when indexed again
+	p = env.model.FindPage(p.ID, model.PageCompany)
+	panicIfNotNull(env.index.IndexPage(p))
+	env.model.Db.Model(p).UpdateColumn("approved_version_id", 1)
+	assert.Empty(t, search("approvato"))
+}
+
+func TestSearchPagination(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	for i := 0; i < 25; i++ {
+		p := &model.Page{Content: "Sviluppo software", Type: model.PageCompany, Title: fmt.Sprintf("Company %d", i)}
+		panicIfNotNull(env.model.SavePage(p, admin))
+		panicIfNotNull(env.index.IndexPage(p))
+	}
+
+	results, err := env.index.SearchPagesByQueryString("software", 0, 10)
+	panicIfNotNull(err)
+	assert.Equal(t, uint64(25), results.Total)
+	assert.Len(t, results.Hits, 10)
+	assert.Equal(t, 3, results.Pages())
+	assert.False(t, results.HasPrev())
+	assert.True(t, results.HasNext())
+
+	results, err = env.index.SearchPagesByQueryString("software", 20, 10)
+	panicIfNotNull(err)
+	assert.Len(t, results.Hits, 5)
+	assert.Equal(t, 3, results.Page())
+	assert.True(t, results.HasPrev())
+	assert.False(t, results.HasNext())
+
+	client := env.TestClient()
+	res := client.Get("/search?query=software&page=2")
+	assertHTMLReturned(t, res)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Pagina 2 di 2")
+	assert.Contains(t, string(body), "page=1")
+}
+
+func TestSearchFacets(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	pages := []*model.Page{
+		{Title: "Etna Soft", Type: model.PageCompany, Content: "### Dati\n- Città: Catania\n- Settore: Tecnologia"},
+		{Title: "Palermo Soft", Type: model.PageCompany, Content: "### Dati\n- Città: Palermo\n- Settore: Tecnologia"},
+		{Title: "Catania Dev", Type: model.PageCommunity, Content: "### Dati\n- Città: Catania"},
+	}
+	for _, p := range pages {
+		panicIfNotNull(env.model.SavePage(p, admin))
+		panicIfNotNull(env.index.IndexPage(p))
+	}
+	assert.Equal(t, "Catania", pages[0].City)
+	assert.Equal(t, "Tecnologia", pages[0].Sector)
+
+	results, err := env.index.Search(index.Query{Filters: map[string]string{"city": "Catania"}})
+	panicIfNotNull(err)
+	assert.Equal(t, uint64(2), results.Total)
+	assert.Equal(t, "type", results.Facets[0].Field)
+	assert.Len(t, results.Facets[0].Terms, 2)
+
+	results, err = env.index.Search(index.Query{Filters: map[string]string{"city": "Catania", "type": "companies"}})
+	panicIfNotNull(err)
+	assert.Len(t, results.Hits, 1)
+	assert.Equal(t, "Etna Soft", results.Hits[0].Page.Title)
+
+	client := env.TestClient()
+	res := client.Get("/search?type=companies&city=Catania")
+	assertHTMLReturned(t, res)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Etna Soft")
+	assert.NotContains(t, string(body), "Palermo Soft")
+	assert.NotContains(t, string(body), "Catania Dev")
+	assert.Contains(t, string(body), "facet-active")
+	assert.Contains(t, string(body), "Tecnologia (1)")
+}
+
+func TestSearchAPI(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	for i := 0; i < 25; i++ {
+		p := &model.Page{Title: fmt.Sprintf("Company %d", i), Type: model.PageCompany,
+			Content: "### Dati\n- Città: Catania\n- In breve: Sviluppo software"}
+		panicIfNotNull(env.model.SavePage(p, admin))
+		panicIfNotNull(env.index.IndexPage(p))
+	}
+	p := &model.Page{Title: "Catania Dev", Type: model.PageCommunity, Content: "### Dati\n- Città: Catania"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	panicIfNotNull(env.index.IndexPage(p))
+
+	client := env.TestClient()
+
+	var res apiSearchResponse
+	decodeJSON(t, client.Get("/api/search?q=software&type=companies&city=Catania"), http.StatusOK, &res)
+	assert.Equal(t, uint64(25), res.Total)
+	assert.Equal(t, 1, res.Page)
+	assert.Equal(t, 2, res.Pages)
+	assert.Len(t, res.Hits, index.DefaultPageSize)
+	assert.Equal(t, "companies", res.Hits[0].Type)
+	assert.Equal(t, "http://localhost:8080/companies/"+res.Hits[0].Slug, res.Hits[0].URL)
+	assert.Contains(t, res.Hits[0].Fragments["short"][0], "<mark>software</mark>")
+	assert.Empty(t, res.Prev)
+	assert.Contains(t, res.Next, "page=2")
+	assert.Equal(t, "type", res.Facets[0].Field)
+	assert.Equal(t, index.FacetTerm{Term: "companies", Count: 25}, res.Facets[0].Terms[0])
+
+	var next apiSearchResponse
+	decodeJSON(t, client.Get(res.Next), http.StatusOK, &next)
+	assert.Len(t, next.Hits, 5)
+	assert.Contains(t, next.Prev, "page=1")
+	assert.Empty(t, next.Next)
+
+	var all apiSearchResponse
+	decodeJSON(t, client.Get("/api/search?city=Catania"), http.StatusOK, &all)
+	assert.Equal(t, uint64(26), all.Total)
+
+	var apiErr struct{ Error apiError }
+	decodeJSON(t, client.Get("/api/search?page=abc"), http.StatusBadRequest, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Error.Code)
+	assert.Contains(t, apiErr.Error.Message, "Invalid page")
+
+	decodeJSON(t, client.Get("/api/search?q=%22software"), http.StatusBadRequest, &apiErr)
+	assert.Contains(t, apiErr.Error.Message, "Invalid query")
+
+	decodeJSON(t, client.Get("/api/nothing"), http.StatusNotFound, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.Error.Code)
+}
+
+func TestReadAPI(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	other := env.registerTestUser()
+
+	p := &model.Page{Title: "Etna Soft", Type: model.PageCompany, Content: "Software\n### Dati\n- Città: Catania"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	edit := &model.Page{Title: "Etna Soft", Type: model.PageCompany, Content: "Spam"}
+	edit.ID = p.ID
+	panicIfNotNull(env.model.SavePage(edit, other))
+	pending := &model.Page{Title: "Pending Co", Type: model.PageCompany, Content: "Spam"}
+	panicIfNotNull(env.model.SavePage(pending, other))
+	profile := &model.Page{Title: "Vigliag", Type: model.PageUser, Content: "Ciao", OwnerID: admin.ID}
+	panicIfNotNull(env.model.SavePage(profile, admin))
+
+	versions, err := env.model.FindPageVersions(p)
+	panicIfNotNull(err)
+	pendingVersion := versions[0].ID
+
+	anon := env.TestClient()
+
+	var list struct{ Pages []apiPage }
+	decodeJSON(t, anon.Get("/api/v1/companies"), http.StatusOK, &list)
+	if assert.Len(t, list.Pages, 1) {
+		assert.Equal(t, "etna-soft", list.Pages[0].Slug)
+		assert.Empty(t, list.Pages[0].Content)
+	}
+
+	res := anon.Get("/api/v1/companies/etna-soft")
+	var page apiPage
+	decodeJSON(t, res, http.StatusOK, &page)
+	assert.Equal(t, p.ID, page.ID)
+	assert.Equal(t, "Catania", page.City)
+	assert.Equal(t, "Software\n### Dati\n- Città: Catania", page.Content)
+	assert.Equal(t, "Catania", page.Sections["area"])
+
+	// The same page by ID, and the ETag of the response
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/companies/%d", p.ID), nil)
+	req.Header.Set("If-None-Match", etag)
+	res = anon.Run(req)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+
+	var apiErr struct{ Error apiError }
+	decodeJSON(t, anon.Get("/api/v1/companies/pending-co"), http.StatusNotFound, &apiErr)
+	decodeJSON(t, anon.Get("/api/v1/wiki/etna-soft"), http.StatusNotFound, &apiErr)
+
+	var history struct{ Versions []apiVersion }
+	decodeJSON(t, anon.Get("/api/v1/companies/etna-soft/versions"), http.StatusOK, &history)
+	if assert.Len(t, history.Versions, 1) {
+		assert.Equal(t, "approved", history.Versions[0].Status)
+		assert.True(t, history.Versions[0].Current)
+		assert.Equal(t, "vigliag", history.Versions[0].Author.Username)
+	}
+	decodeJSON(t, anon.Get(fmt.Sprintf("/api/v1/companies/etna-soft/versions/%d", pendingVersion)), http.StatusNotFound, &apiErr)
+
+	// Who can approve edits sees unapproved content
+	client := env.TestClient()
+	client.MustLogin("vigliag@gmail.com", "password")
+
+	decodeJSON(t, client.Get("/api/v1/companies/pending-co"), http.StatusOK, &page)
+	assert.False(t, page.Approved)
+	assert.Equal(t, "Spam", page.Content)
+
+	decodeJSON(t, client.Get("/api/v1/companies/etna-soft/versions"), http.StatusOK, &history)
+	assert.Len(t, history.Versions, 2)
+
+	var version apiVersion
+	decodeJSON(t, client.Get(fmt.Sprintf("/api/v1/companies/etna-soft/versions/%d", pendingVersion)), http.StatusOK, &version)
+	assert.Equal(t, "pending", version.Status)
+	assert.Equal(t, "Spam", version.Content)
+	assert.Equal(t, "otheruser", version.Author.Username)
+
+	res = anon.Get(fmt.Sprintf("/api/v1/users/%d", admin.ID))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.NotContains(t, string(body), "vigliag@gmail.com")
+	var user apiProfile
+	panicIfNotNull(json.Unmarshal(body, &user))
+	assert.Equal(t, "vigliag", user.Username)
+	if assert.NotNil(t, user.Profile) {
+		assert.Equal(t, profile.ID, user.Profile.ID)
+	}
+	assert.Empty(t, user.Pages)
+
+	decodeJSON(t, anon.Get("/api/v1/users/1000"), http.StatusNotFound, &apiErr)
+}
+
+func TestWriteAPI(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	env.registerTestAdmin()
+	user := env.registerTestUser()
+
+	client := env.TestClient()
+	client.MustLogin("other@example.com", "password")
+
+	res := client.Get("/me")
+	assertHTMLReturned(t, res)
+
+	// Create a token from /me, its value is only shown once
+	res = client.Run(formRequest("/me/tokens", url.Values{"name": {"cms"}, "scopes": {"read", "write"}, "expires": {"30"}}))
+	assertHTMLReturned(t, res)
+	body, _ := ioutil.ReadAll(res.Body)
+	token := regexp.MustCompile(`isa_[A-Z2-7]+`).FindString(string(body))
+	assert.NotEmpty(t, token)
+
+	tokens, err := env.model.UserAccessTokens(user)
+	panicIfNotNull(err)
+	assert.Len(t, tokens, 1)
+
+	var apiErr struct{ Error apiError }
+	anon := env.TestClient()
+	newPage := apiPageRequest{Type: "companies", Title: "Etna Soft", Content: "Software"}
+
+	decodeJSON(t, anon.Run(apiRequest("POST", "/api/v1/pages", "", newPage)), http.StatusUnauthorized, &apiErr)
+	decodeJSON(t, anon.Run(apiRequest("POST", "/api/v1/pages", "isa_WRONG", newPage)), http.StatusUnauthorized, &apiErr)
+	decodeJSON(t, anon.Run(apiRequest("POST", "/api/v1/pages", token, apiPageRequest{Type: "nothing", Title: "x"})), http.StatusBadRequest, &apiErr)
+
+	// The new page waits for approval, as the user can't approve edits
+	var saved apiSaveResponse
+	decodeJSON(t, anon.Run(apiRequest("POST", "/api/v1/pages", token, newPage)), http.StatusCreated, &saved)
+	assert.Equal(t, "etna-soft", saved.Page.Slug)
+	assert.False(t, saved.Page.Approved)
+	assert.Equal(t, "pending", saved.Version.Status)
+	assert.Equal(t, "otheruser", saved.Version.Author.Username)
+
+	// Approved edits are applied right away
+	admin := env.model.LoginEmail("vigliag@gmail.com", "password")
+	_, adminToken, err := env.model.CreateAccessToken(admin, "admin", []string{model.ScopeWrite}, 0)
+	panicIfNotNull(err)
+	edit := apiPageRequest{Title: "Etna Soft", Content: "Sviluppo software", BaseVersionID: saved.Version.ID}
+	var approved apiSaveResponse
+	decodeJSON(t, anon.Run(apiRequest("PUT", fmt.Sprintf("/api/v1/pages/%d", saved.Page.ID), adminToken, edit)), http.StatusOK, &approved)
+	assert.True(t, approved.Page.Approved)
+	assert.Equal(t, "Sviluppo software", approved.Page.Content)
+	assert.Equal(t, "approved", approved.Version.Status)
+
+	results, err := env.index.SearchPagesByQueryString("sviluppo", 0, 0)
+	panicIfNotNull(err)
+	assert.Len(t, results.Hits, 1)
+
+	// Edits based on an older version conflict
+	decodeJSON(t, anon.Run(apiRequest("PUT", fmt.Sprintf("/api/v1/pages/%d", saved.Page.ID), token, edit)), http.StatusConflict, &apiErr)
+	decodeJSON(t, anon.Run(apiRequest("PUT", "/api/v1/pages/1000", token, edit)), http.StatusNotFound, &apiErr)
+
+	// Tokens without the write scope can't edit
+	_, readToken, err := env.model.CreateAccessToken(user, "read", []string{model.ScopeRead}, 0)
+	panicIfNotNull(err)
+	decodeJSON(t, anon.Run(apiRequest("POST", "/api/v1/pages", readToken, newPage)), http.StatusForbidden, &apiErr)
+
+	// Revoked tokens are refused
+	res = client.Run(formRequest(fmt.Sprintf("/me/tokens/%d/revoke", tokens[0].ID), url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	decodeJSON(t, anon.Run(apiRequest("POST", "/api/v1/pages", token, newPage)), http.StatusUnauthorized, &apiErr)
+}
+
+func TestRegister(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	env.registerTestUser()
+	client := env.TestClient()
+
+	res := client.Get("/register")
+	assertHTMLReturned(t, res)
+
+	register := func(username, email, password, password2 string) *http.Response {
+		return client.Run(formRequest("/register", url.Values{
+			"username": {username}, "email": {email}, "password": {password}, "password2": {password2},
+		}))
+	}
+
+	res = register("mario", "mario@example.com", "correct horse 7", "correct horse 8")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Le password non coincidono")
+	assert.Contains(t, string(body), "mario@example.com")
+
+	res = register("mario", "other@example.com", "correct horse 7", "correct horse 7")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "già registrato")
+
+	res = register("mario", "mario@example.com", "correct horse 7", "correct horse 7")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "/me", res.Header.Get("Location"))
+	assert.Len(t, env.mailer.Mails, 1)
+	client.MustLogin("mario@example.com", "correct horse 7")
+
+	// Unverified users can't edit
+	res = client.Get("/wiki/new")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	res = client.Run(formRequest("/pages", url.Values{"title": {"Spam"}, "content": {"spam"}, "type": {"3"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "/me", res.Header.Get("Location"))
+	var count int
+	env.model.Db.Model(&model.Page{}).Count(&count)
+	assert.Equal(t, 0, count)
+
+	res = client.Get("/me")
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "/resendVerification")
+
+	res = client.Run(formRequest("/resendVerification", url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Len(t, env.mailer.Mails, 2)
+
+	// Confirm the email with the last mail
+	confirmationAddr := regexp.MustCompile(`http[s]?:\/\/\S+`).FindString(env.mailer.Mails[1].Body)
+	res = client.Get(confirmationAddr)
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+
+	res = client.Get("/wiki/new")
+	assertHTMLReturned(t, res)
+}
+
+func TestPasswordReset(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	u := env.registerTestUser()
+	session := env.TestClient()
+	session.MustLogin("other@example.com", "password")
+	assertHTMLReturned(t, session.Get("/me"))
+
+	client := env.TestClient()
+	assertHTMLReturned(t, client.Get("/forgotPassword"))
+
+	// Unknown emails get the same response, but no mail
+	res := client.Run(formRequest("/forgotPassword", url.Values{"email": {"nobody@example.com"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Empty(t, env.mailer.Mails)
+
+	res = client.Run(formRequest("/forgotPassword", url.Values{"email": {"Other@example.com"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "/login", res.Header.Get("Location"))
+	if !assert.Len(t, env.mailer.Mails, 1) {
+		return
+	}
+	resetAddr := regexp.MustCompile(`http[s]?:\/\/\S+`).FindString(env.mailer.Mails[0].Body)
+	resetURL, err := url.Parse(resetAddr)
+	panicIfNotNull(err)
+	token := resetURL.Query().Get("token")
+
+	// Tokens for other purposes can't be used
+	confirmToken, err := env.model.CreateToken(u.ID, model.TokenEmailConfirmation)
+	panicIfNotNull(err)
+	res = client.Get("/resetPassword?token=" + url.QueryEscape(confirmToken))
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	assertHTMLReturned(t, client.Get(resetURL.RequestURI()))
+
+	res = client.Run(formRequest("/resetPassword", url.Values{"token": {token}, "password": {"short"}, "password2": {"short"}}))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = client.Run(formRequest("/resetPassword", url.Values{"token": {token}, "password": {"new secret 42"}, "password2": {"new secret 42"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.NotNil(t, env.model.LoginEmail("other@example.com", "new secret 42"))
+	assert.Nil(t, env.model.LoginEmail("other@example.com", "password"))
+
+	// Other sessions are logged out
+	res = session.Get("/me")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	// The link can't be used again
+	res = client.Run(formRequest("/resetPassword", url.Values{"token": {token}, "password": {"other secret 42"}, "password2": {"other secret 42"}}))
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestChangeEmail(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	env.registerTestAdmin()
+	u := env.registerTestUser()
+	client := env.TestClient()
+	client.MustLogin("other@example.com", "password")
+
+	// Emails of other users are refused, with a message instead of an error
+	res := client.Run(formRequest("/setMail", url.Values{"email": {"vigliag@gmail.com"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Nil(t, env.model.RetrieveUser(u.ID).PendingEmail)
+	assert.Empty(t, env.mailer.Mails)
+
+	res = client.Run(formRequest("/setMail", url.Values{"email": {"new@example.com"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	// A confirmation is sent to the new address, and a notice to the old one
+	if !assert.Len(t, env.mailer.Mails, 2) {
+		return
+	}
+	assert.Equal(t, "new@example.com", env.mailer.Mails[0].To[0].Mail)
+	assert.Equal(t, "other@example.com", env.mailer.Mails[1].To[0].Mail)
+	assert.Contains(t, env.mailer.Mails[1].Body, "new@example.com")
+
+	// The old email still works until the new one is confirmed
+	assert.Equal(t, "other@example.com", *env.model.RetrieveUser(u.ID).Email)
+	res = client.Get("/me")
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "new@example.com")
+
+	confirmationAddr := regexp.MustCompile(`http[s]?:\/\/\S+`).FindString(env.mailer.Mails[0].Body)
+	res = client.Get(confirmationAddr)
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	u = env.model.RetrieveUser(u.ID)
+	assert.Equal(t, "new@example.com", *u.Email)
+	assert.True(t, u.EmailVerified)
+	assert.Nil(t, u.PendingEmail)
+	assert.NotNil(t, env.model.LoginEmail("new@example.com", "password"))
+
+	res = client.Get(confirmationAddr)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+// fakeOAuthServer simulates an OpenID Connect provider, also answering like
+// GitHub's API. It logs in the account with the given claims whatever the code.
+func fakeOAuthServer(claims map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Authorization") != "Bearer fake-access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, map[string]string{"access_token": "fake-access-token", "token_type": "bearer"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			writeJSON(w, claims)
+		}
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			writeJSON(w, map[string]interface{}{"id": 4242, "login": "ghuser", "name": ""})
+		}
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			writeJSON(w, []map[string]interface{}{
+				{"email": "old@example.com", "primary": false, "verified": true},
+				{"email": "gh@example.com", "primary": true, "verified": true},
+			})
+		}
+	})
+	return srv
+}
+
+// providerLogin goes through the login with a provider, returning the response to the callback
+func providerLogin(t *testing.T, client *TestClient, loginURL, callbackURL, code string) *http.Response {
+	res := client.Get(loginURL)
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	client.KeepCookies(res)
+
+	authURL, err := res.Location()
+	panicIfNotNull(err)
+	state := authURL.Query().Get("state")
+	assert.NotEmpty(t, state)
+
+	res = client.Get(callbackURL + "?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	if res.StatusCode == http.StatusSeeOther {
+		client.KeepCookies(res)
+	}
+	return res
+}
+
+func TestOAuthLogin(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	srv := fakeOAuthServer(map[string]interface{}{
+		"sub": "oidc-1", "name": "Mario Rossi", "email": "mario@example.com", "email_verified": true,
+	})
+	defer srv.Close()
+
+	env.ctl.AddLoginProvider(NewOIDCProvider("oidc", "Example", srv.URL, "client", "secret", env.ctl.appURL))
+	github := NewGitHubProvider("client", "secret", env.ctl.appURL)
+	github.config.Endpoint.AuthURL = srv.URL + "/authorize"
+	github.config.Endpoint.TokenURL = srv.URL + "/token"
+	github.userInfoURL = srv.URL + "/user"
+	env.ctl.AddLoginProvider(github)
+	env.ctl.AddLoginProvider(NewFacebookProvider("client", "secret", env.ctl.appURL))
+
+	// Enabled providers are shown in the login page
+	client := env.TestClient()
+	res := client.Get("/login")
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), `href="/login/oidc"`)
+	assert.Contains(t, string(body), `href="/login/github"`)
+
+	res = client.Get("/login/unknown")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// Facebook keeps its old urls
+	res = client.Get("/login/facebook")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Location"), "facebook.com")
+	assert.Contains(t, res.Header.Get("Location"), url.QueryEscape("http://localhost:8080/oauth/fb"))
+
+	// A new account on an OpenID Connect provider creates a verified user
+	res = providerLogin(t, client, "/login/oidc", "/oauth/oidc", "good-code")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, http.StatusOK, client.Get("/me").StatusCode)
+
+	identity := env.model.FindIdentity("oidc", "oidc-1")
+	if assert.NotNil(t, identity) {
+		u := env.model.RetrieveUser(identity.UserID)
+		assert.Equal(t, "Mario Rossi", u.Username)
+		assert.Equal(t, "mario@example.com", *u.Email)
+		assert.True(t, u.EmailVerified)
+	}
+
+	// While logged in, GitHub is linked to the same user, with its primary email
+	res = providerLogin(t, client, "/login/github", "/oauth/github", "good-code")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	ghIdentity := env.model.FindIdentity("github", "4242")
+	if assert.NotNil(t, ghIdentity) && assert.NotNil(t, identity) {
+		assert.Equal(t, identity.UserID, ghIdentity.UserID)
+		assert.Equal(t, "gh@example.com", ghIdentity.Email)
+	}
+
+	// A failed exchange does not log in
+	client = env.TestClient()
+	res = providerLogin(t, client, "/login/oidc", "/oauth/oidc", "bad-code")
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+
+	// The state can't be used without the session that started the login,
+	// nor with another provider
+	client = env.TestClient()
+	res = client.Get("/login/oidc")
+	authURL, _ := res.Location()
+	state := authURL.Query().Get("state")
+	res = client.Get("/oauth/oidc?code=good-code&state=" + url.QueryEscape(state))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	client.KeepCookies(res)
+	res = client.Get("/login/oidc")
+	client.KeepCookies(res)
+	authURL, _ = res.Location()
+	state = authURL.Query().Get("state")
+	res = client.Get("/oauth/github?code=good-code&state=" + url.QueryEscape(state))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestManageLoginMethods(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	srv := fakeOAuthServer(map[string]interface{}{"sub": "oidc-1", "name": "Luca"})
+	defer srv.Close()
+	env.ctl.AddLoginProvider(NewOIDCProvider("oidc", "Example", srv.URL, "client", "secret", env.ctl.appURL))
+
+	u := env.registerTestAdmin()
+	client := env.TestClient()
+	client.MustLogin(*u.Email, "password")
+
+	res := client.Get("/me")
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Email e password")
+	assert.Contains(t, string(body), `href="/me/link/oidc"`)
+
+	// Linking a provider needs a recent login
+	window := reauthWindow
+	defer func() { reauthWindow = window }()
+	reauthWindow = 0
+	res = client.Get("/me/link/oidc")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "/login?reauth=1&redir=%2Fme%2Flink%2Foidc", res.Header.Get("Location"))
+
+	// which is also checked when the provider redirects back
+	res = providerLogin(t, client, "/login/oidc", "/oauth/oidc", "good-code")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.True(t, strings.HasPrefix(res.Header.Get("Location"), "/login?reauth=1"))
+	assert.Nil(t, env.model.FindIdentity("oidc", "oidc-1"))
+
+	reauthWindow = window
+	client = env.TestClient()
+	client.MustLogin(*u.Email, "password")
+	res = client.Get("/me/link/oidc")
+	assert.Equal(t, "/login/oidc?redir=/me", res.Header.Get("Location"))
+
+	res = providerLogin(t, client, "/login/oidc?redir=/me", "/oauth/oidc", "good-code")
+	assert.Equal(t, "/me", res.Header.Get("Location"))
+	identity := env.model.FindIdentity("oidc", "oidc-1")
+	if !assert.NotNil(t, identity) {
+		return
+	}
+	assert.Equal(t, u.ID, identity.UserID)
+
+	// Other users can't unlink the identity
+	other := env.registerTestUser()
+	otherClient := env.TestClient()
+	otherClient.MustLogin(*other.Email, "password")
+	res = otherClient.Run(formRequest(fmt.Sprintf("/me/identities/%d/unlink", identity.ID), url.Values{}))
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// The password can be removed, keeping the identity as the only login method
+	res = client.Run(formRequest("/me/password/remove", url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.False(t, env.model.RetrieveUser(u.ID).HasPasswordLogin())
+
+	res = client.Run(formRequest(fmt.Sprintf("/me/identities/%d/unlink", identity.ID), url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.NotNil(t, env.model.FindIdentity("oidc", "oidc-1"))
+}
+
+var recoveryCodeRegexp = regexp.MustCompile(`\b[a-z2-7]{4}-[a-z2-7]{4}\b`)
+
+func TestTwoFactorLogin(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	u := env.registerTestAdmin()
+	client := env.TestClient()
+	client.MustLogin(*u.Email, "password")
+
+	// Enrollment shows the secret as a QR code, and needs a valid code
+	res := client.Get("/me/2fa")
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, string(body), "data:image/png;base64,")
+	secret := env.model.RetrieveUser(u.ID).TOTPSecret
+	assert.Contains(t, string(body), secret)
+
+	res = client.Run(formRequest("/me/2fa", url.Values{"code": {"abcdef"}}))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.False(t, env.model.RetrieveUser(u.ID).TOTPEnabled)
+
+	code, _ := model.TOTPCode(secret, time.Now())
+	res = client.Run(formRequest("/me/2fa", url.Values{"code": {code}}))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body, _ = ioutil.ReadAll(res.Body)
+	codes := recoveryCodeRegexp.FindAllString(string(body), -1)
+	assert.Len(t, codes, model.RecoveryCodesCount)
+	assert.True(t, env.model.RetrieveUser(u.ID).TOTPEnabled)
+
+	// The password alone only leads to the second step
+	client = env.TestClient()
+	res = client.Login(*u.Email, "password")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "/twoFactor", res.Header.Get("Location"))
+	assert.Equal(t, http.StatusFound, client.Get("/me").StatusCode)
+	assert.Equal(t, http.StatusOK, client.Get("/twoFactor").StatusCode)
+
+	res = client.Run(formRequest("/twoFactor", url.Values{"code": {"000000"}}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	client.KeepCookies(res)
+
+	res = client.Run(formRequest("/twoFactor", url.Values{"code": {codes[0]}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "/", res.Header.Get("Location"))
+	client.KeepCookies(res)
+	assert.Equal(t, http.StatusOK, client.Get("/me").StatusCode)
+
+	// Recovery codes can only be used once
+	client = env.TestClient()
+	client.MustLogin(*u.Email, "password")
+	res = client.Run(formRequest("/twoFactor", url.Values{"code": {codes[0]}}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// After too many wrong codes the login has to start again.
+	// The throttling of the account is tested in TestLoginThrottling.
+	defer func(p model.ThrottlePolicy) { model.AccountThrottle = p }(model.AccountThrottle)
+	model.AccountThrottle.FreeAttempts = 10
+	client = env.TestClient()
+	client.MustLogin(*u.Email, "password")
+	for i := 0; i < 5; i++ {
+		res = client.Run(formRequest("/twoFactor", url.Values{"code": {"000000"}}))
+		client.KeepCookies(res)
+	}
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "/login", res.Header.Get("Location"))
+	next, _ := model.TOTPCode(secret, time.Now().Add(30*time.Second))
+	res = client.Run(formRequest("/twoFactor", url.Values{"code": {next}}))
+	assert.Equal(t, "/login", res.Header.Get("Location"))
+
+	// The code of the app works too
+	client = env.TestClient()
+	client.MustLogin(*u.Email, "password")
+	res = client.Run(formRequest("/twoFactor", url.Values{"code": {next}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	client.KeepCookies(res)
+	assert.Equal(t, http.StatusOK, client.Get("/me").StatusCode)
+}
+
+func TestTwoFactorThrottling(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	u := env.registerTestAdmin()
+	secret, err := env.model.TOTPEnrollmentSecret(u)
+	panicIfNotNull(err)
+	code, _ := model.TOTPCode(secret, time.Now())
+	_, err = env.model.EnableTOTP(u, code)
+	panicIfNotNull(err)
+
+	defer func(p model.ThrottlePolicy) { model.AccountThrottle = p }(model.AccountThrottle)
+	model.AccountThrottle.FreeAttempts = 10
+	model.AccountThrottle.LockoutAttempts = 4
+
+	// Giving the right password again doesn't forget the wrong codes
+	for i := 0; i < model.AccountThrottle.LockoutAttempts; i++ {
+		client := env.TestClient()
+		res := client.Login(*u.Email, "password")
+		assert.Equal(t, "/twoFactor", res.Header.Get("Location"))
+		res = client.Run(formRequest("/twoFactor", url.Values{"code": {"000000"}}))
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+
+	res := env.TestClient().Login(*u.Email, "password")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+}
+
+func TestTwoFactorSettingsThrottling(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	u := env.registerTestUser()
+	client := env.TestClient()
+	client.MustLogin(*u.Email, "password")
+	secret, err := env.model.TOTPEnrollmentSecret(u)
+	panicIfNotNull(err)
+	code, _ := model.TOTPCode(secret, time.Now())
+	_, err = env.model.EnableTOTP(u, code)
+	panicIfNotNull(err)
+
+	defer func(p model.ThrottlePolicy) { model.AccountThrottle = p }(model.AccountThrottle)
+	model.AccountThrottle.FreeAttempts = 10
+	model.AccountThrottle.LockoutAttempts = 4
+
+	// Wrong codes given to change the settings count as failed logins
+	for i := 0; i < model.AccountThrottle.LockoutAttempts; i++ {
+		res := client.Run(formRequest("/me/2fa/disable", url.Values{"code": {"000000"}}))
+		assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+		assert.Equal(t, "/me/2fa", res.Header.Get("Location"))
+	}
+
+	res := client.Run(formRequest("/me/2fa/recoveryCodes", url.Values{"code": {"000000"}}))
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	next, _ := model.TOTPCode(secret, time.Now().Add(30*time.Second))
+	res = client.Run(formRequest("/me/2fa/disable", url.Values{"code": {next}}))
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.True(t, env.model.RetrieveUser(u.ID).TOTPEnabled)
+}
+
+func TestTwoFactorRequired(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+	env.ctl.RequireTwoFactor("admin")
+
+	admin := env.registerTestAdmin()
+	user := env.registerTestUser()
+
+	// Users without the role are not affected
+	client := env.TestClient()
+	client.MustLogin(*user.Email, "password")
+	assert.Equal(t, http.StatusOK, client.Get("/me").StatusCode)
+
+	// Admins can't do anything before enabling it
+	client = env.TestClient()
+	client.MustLogin(*admin.Email, "password")
+	res := client.Get("/admin")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "/me/2fa", res.Header.Get("Location"))
+	res = client.Get("/me/2fa")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	secret := env.model.RetrieveUser(admin.ID).TOTPSecret
+	code, _ := model.TOTPCode(secret, time.Now())
+	res = client.Run(formRequest("/me/2fa", url.Values{"code": {code}}))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, http.StatusOK, client.Get("/admin").StatusCode)
+
+	// and can't disable it
+	next, _ := model.TOTPCode(secret, time.Now().Add(30*time.Second))
+	res = client.Run(formRequest("/me/2fa/disable", url.Values{"code": {next}}))
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.True(t, env.model.RetrieveUser(admin.ID).TOTPEnabled)
+}
+
+func TestLoginThrottling(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	u := env.registerTestUser()
+	client := env.TestClient()
+
+	for i := 0; i <= model.AccountThrottle.FreeAttempts; i++ {
+		res := client.Login(*u.Email, "wrong")
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	}
+
+	// Now even the right password has to wait
+	res := client.Login(*u.Email, "password")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "1", res.Header.Get("Retry-After"))
+
+	// Other accounts can still log in from the same address
+	adminClient := env.TestClient()
+	adminClient.MustLogin(*admin.Email, "password")
+
+	// Admins see the failed attempts, and can unlock the account
+	res = adminClient.Get("/admin")
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "other@example.com")
+
+	res = client.Run(formRequest(fmt.Sprintf("/admin/users/%d/unlock", u.ID), url.Values{}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res = adminClient.Run(formRequest(fmt.Sprintf("/admin/users/%d/unlock", u.ID), url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	res = client.Login(*u.Email, "password")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+}
+
+func TestPageMaintainers(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	owner := env.registerTestUser()
+	maintainer, err := env.model.RegisterEmail("maintainer", "maintainer@example.com", "password", model.RoleUser)
+	panicIfNotNull(err)
+
+	p := &model.Page{Content: "Ciao", Type: model.PageUser, Title: "Other user", OwnerID: owner.ID}
+	panicIfNotNull(env.model.SavePage(p, owner))
+	addURL := fmt.Sprintf("/pages/%d/maintainers", p.ID)
+
+	// Only the owner can add maintainers
+	maintainerClient := env.TestClient()
+	maintainerClient.MustLogin(*maintainer.Email, "password")
+	res := maintainerClient.Run(formRequest(addURL, url.Values{"username": {"maintainer"}}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	ownerClient := env.TestClient()
+	ownerClient.MustLogin(*owner.Email, "password")
+	res = ownerClient.Run(formRequest(addURL, url.Values{"username": {"maintainer"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.True(t, env.model.IsMaintainer(p, maintainer))
+
+	res = ownerClient.Get(PageURL(p))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "maintainer")
+
+	// The maintainer can now edit the page
+	res = maintainerClient.Get(fmt.Sprintf("/professionals/%d/edit", p.ID))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// and review the edits to it, but not those to other pages
+	contributor, err := env.model.RegisterEmail("contributor", "contributor@example.com", "password", model.RoleUser)
+	panicIfNotNull(err)
+	panicIfNotNull(env.model.MarkEmailVerified(contributor, nil))
+	other := &model.Page{Content: "Ciao", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(other, env.registerTestAdmin()))
+	for _, edited := range []*model.Page{p, other} {
+		edited.Content = "Ciao da contributor"
+		panicIfNotNull(env.model.SavePage(edited, contributor))
+	}
+	res = maintainerClient.Get("/reviews")
+	assertHTMLReturned(t, res)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Other user")
+	assert.NotContains(t, string(body), "Example company")
+
+	res = ownerClient.Run(formRequest(fmt.Sprintf("%s/%d/remove", addURL, maintainer.ID), url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.False(t, env.model.IsMaintainer(p, maintainer))
+
+	res = maintainerClient.Get(fmt.Sprintf("/professionals/%d/edit", p.ID))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestPageOwnership(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	employee := env.registerTestUser()
+	colleague, err := env.model.RegisterEmail("colleague", "colleague@example.com", "password", model.RoleUser)
+	panicIfNotNull(err)
+
+	p := &model.Page{Content: "Ciao", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+
+	// An employee claims the page, and the admin approves the claim
+	employeeClient := env.TestClient()
+	employeeClient.MustLogin(*employee.Email, "password")
+	res := employeeClient.Get(PageURL(p))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Rivendica questa pagina")
+
+	res = employeeClient.Run(formRequest(fmt.Sprintf("/pages/%d/claim", p.ID), url.Values{"justification": {"Ci lavoro"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	claims, err := env.model.PendingClaims()
+	panicIfNotNull(err)
+	assert.Len(t, claims, 1)
+
+	res = employeeClient.Run(formRequest(fmt.Sprintf("/admin/claims/%d/approve", claims[0].ID), url.Values{}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	adminClient := env.TestClient()
+	adminClient.MustLogin(*admin.Email, "password")
+	res = adminClient.Get("/admin")
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Ci lavoro")
+	res = adminClient.Run(formRequest(fmt.Sprintf("/admin/claims/%d/approve", claims[0].ID), url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	p = env.model.FindPage(p.ID, model.PageCompany)
+	assert.Equal(t, employee.ID, p.OwnerID)
+
+	// The owner offers the page to a colleague, who is notified and accepts it
+	res = employeeClient.Run(formRequest(fmt.Sprintf("/pages/%d/transfer", p.ID), url.Values{"username": {"colleague"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Len(t, env.mailer.Mails, 1)
+	assert.Equal(t, "colleague@example.com", env.mailer.Mails[0].To[0].Mail)
+
+	colleagueClient := env.TestClient()
+	colleagueClient.MustLogin(*colleague.Email, "password")
+	res = colleagueClient.Get("/me")
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Example company")
+
+	transfer := env.model.PendingTransferOf(p)
+	res = employeeClient.Run(formRequest(fmt.Sprintf("/transfers/%d/accept", transfer.ID), url.Values{}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res = colleagueClient.Run(formRequest(fmt.Sprintf("/transfers/%d/accept", transfer.ID), url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, colleague.ID, env.model.FindPage(p.ID, model.PageCompany).OwnerID)
+
+	// Both changes are in the history of the page
+	res = colleagueClient.Get(PageURL(p) + "/history")
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Richiesta approvata da vigliag")
+	assert.Contains(t, string(body), "Trasferimento")
+
+	// Admins can change the owner at any time
+	ownerURL := fmt.Sprintf("/admin/pages/%d/owner", p.ID)
+	res = colleagueClient.Run(formRequest(ownerURL, url.Values{"username": {"colleague"}}))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res = adminClient.Run(formRequest(ownerURL, url.Values{"username": {""}, "note": {"Pagina contesa"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Zero(t, env.model.FindPage(p.ID, model.PageCompany).OwnerID)
+	res = adminClient.Get(PageURL(p) + "/history")
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Assegnata da vigliag")
+	assert.Contains(t, string(body), "Pagina contesa")
+}
+
+func TestUserConsole(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	u := env.registerTestUser()
+	moderator, err := env.model.RegisterEmail("moderator", "moderator@example.com", "password", model.RoleModerator)
+	panicIfNotNull(err)
+	userURL := fmt.Sprintf("/admin/users/%d", u.ID)
+
+	// Moderators review edits, but can't manage users
+	moderatorClient := env.TestClient()
+	moderatorClient.MustLogin(*moderator.Email, "password")
+	assertHTMLReturned(t, moderatorClient.Get("/reviews"))
+	assertHTMLReturned(t, moderatorClient.Get("/trash"))
+	res := moderatorClient.Get("/admin")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res = moderatorClient.Get("/admin/users")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	client := env.TestClient()
+	client.MustLogin(*u.Email, "password")
+	res = client.Get("/admin")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	adminClient := env.TestClient()
+	adminClient.MustLogin(*admin.Email, "password")
+	res = adminClient.Get("/admin/users?q=OTHER")
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "other@example.com")
+	assert.NotContains(t, string(body), "moderator@example.com")
+	assertHTMLReturned(t, adminClient.Get(userURL))
+
+	res = adminClient.Run(formRequest(userURL+"/role", url.Values{"role": {model.RoleEditor}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, model.RoleEditor, env.model.RetrieveUser(u.ID).Role)
+	res = adminClient.Run(formRequest(fmt.Sprintf("/admin/users/%d/role", admin.ID), url.Values{"role": {model.RoleUser}}))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// Blocked users are logged out, and can't log in again
+	res = adminClient.Run(formRequest(userURL+"/block", url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	res = client.Get("/admin")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "/", res.Header.Get("Location"))
+	res = client.Login(*u.Email, "password")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res = adminClient.Run(formRequest(userURL+"/unblock", url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	res = client.Login(*u.Email, "password")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	// The moderator account is merged into the user
+	res = adminClient.Run(formRequest(fmt.Sprintf("/admin/users/%d/merge", moderator.ID), url.Values{"into": {u.Username}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, userURL, res.Header.Get("Location"))
+	assert.Nil(t, env.model.RetrieveUser(moderator.ID))
+	assert.Equal(t, model.RoleModerator, env.model.RetrieveUser(u.ID).Role)
+}
+
+func TestBlockSpammer(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	spammer, err := env.model.RegisterEmail("spammer", "spammer@example.com", "password", model.RoleEditor)
+	panicIfNotNull(err)
+
+	p := &model.Page{Content: "Ciao", Type: model.PageCompany, Title: "Example company"}
+	panicIfNotNull(env.model.SavePage(p, admin))
+	p.Content = "Spam"
+	panicIfNotNull(env.model.SavePage(p, spammer))
+
+	adminClient := env.TestClient()
+	adminClient.MustLogin(*admin.Email, "password")
+	userURL := fmt.Sprintf("/admin/users/%d", spammer.ID)
+	res := adminClient.Run(formRequest(userURL+"/block", url.Values{"reason": {"spam"}, "rollback": {"1"}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "Ciao", env.model.FindPage(p.ID, model.PageCompany).Content)
+
+	res = env.TestClient().Login(*spammer.Email, "password")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res = adminClient.Get(userURL)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Example company")
+	assert.Contains(t, string(body), "Annulla")
+
+	blocks, err := env.model.UserBlocks(spammer)
+	panicIfNotNull(err)
+	undoURL := fmt.Sprintf("%s/blocks/%d/undo", userURL, blocks[0].ID)
+	res = adminClient.Run(formRequest(undoURL, url.Values{}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "Spam", env.model.FindPage(p.ID, model.PageCompany).Content)
+	res = adminClient.Run(formRequest(undoURL, url.Values{}))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = env.TestClient().Login(*spammer.Email, "password")
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+}
+
+func TestAuditLog(t *testing.T) {
+	env := GetTestEnv()
+	defer env.Close()
+
+	admin := env.registerTestAdmin()
+	u := env.registerTestUser()
+	moderator, err := env.model.RegisterEmail("moderator", "moderator@example.com", "password", model.RoleModerator)
+	panicIfNotNull(err)
+
+	// Only admins can see the log
+	moderatorClient := env.TestClient()
+	moderatorClient.MustLogin(*moderator.Email, "password")
+	res := moderatorClient.Get("/admin/audit")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	adminClient := env.TestClient()
+	adminClient.MustLogin(*admin.Email, "password")
+	res = adminClient.Run(formRequest(fmt.Sprintf("/admin/users/%d/role", u.ID), url.Values{"role": {model.RoleEditor}}))
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+
+	res = adminClient.Get("/admin/audit?action=user.role")
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "user to editor")
+	assert.NotContains(t, string(body), "192.0.2.1")
+
+	res = adminClient.Get("/admin/audit?user=moderator")
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "192.0.2.1")
+	assert.NotContains(t, string(body), "user to editor")
+
+	res = adminClient.Get("/admin/audit?since=yesterday")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = adminClient.Get("/admin/audit?user=nobody")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
 }